@@ -0,0 +1,189 @@
+// Who clients are, and what they may do to blobs.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Checks the credential a client sends when it connects
+type Authenticator interface {
+	Authenticate(credential string) (*Identity, error)
+}
+
+// Tokens signed with a secret the leader and the auth tool share, like
+// <claims>.<signature>
+type HMAC struct {
+	secret []byte
+}
+
+func NewHMAC(secret []byte) *HMAC {
+	return &HMAC{secret}
+}
+
+type claims struct {
+	User    string
+	Groups  []string
+	Expires int64
+}
+
+var ErrBadToken = NewError(PermissionDenied, "Invalid or expired token")
+
+func (self *HMAC) Issue(id Identity, ttl time.Duration) string {
+	data, err := json.Marshal(claims{id.User, id.Groups, time.Now().Add(ttl).Unix()})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(self.sign(payload))
+}
+
+func (self *HMAC) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, self.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (self *HMAC) Authenticate(token string) (*Identity, error) {
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 {
+		return nil, ErrBadToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil || !hmac.Equal(signature, self.sign(token[:dot])) {
+		return nil, ErrBadToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token[:dot])
+	if err != nil {
+		return nil, ErrBadToken
+	}
+	var c claims
+	if err := json.Unmarshal(data, &c); err != nil || c.User == "" || time.Now().Unix() > c.Expires {
+		return nil, ErrBadToken
+	}
+	return &Identity{c.User, c.Groups}, nil
+}
+
+// Reads a hex-encoded secret, making a new one if there's no file
+func LoadSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		log.Println("Writing new secret to", path)
+		return secret, ioutil.WriteFile(path, []byte(hex.EncodeToString(secret)+"\n"), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// Anyone called this can do anything
+const Superuser = "root"
+
+// Permission bits
+const (
+	Read  = 4
+	Write = 2
+)
+
+// POSIX-style: the owner's bits if it's the owner, or a named user's ACL
+// entry, otherwise everything granted to any group it's in, by the owning
+// group or an ACL entry, otherwise the other bits. A nil identity is
+// anonymous and only gets the other bits.
+func Allows(p *Permissions, id *Identity, want uint32) bool {
+	if id != nil && id.User == Superuser {
+		return true
+	}
+	granted := p.Mode & 7
+	if id != nil {
+		if id.User == p.Owner {
+			return (p.Mode>>6)&want == want
+		}
+		for _, entry := range p.ACL {
+			if entry.User != "" && entry.User == id.User {
+				return entry.Mode&want == want
+			}
+		}
+		inGroup := false
+		var groupBits uint32
+		for _, group := range id.Groups {
+			if group == p.Group {
+				inGroup = true
+				groupBits |= (p.Mode >> 3) & 7
+			}
+			for _, entry := range p.ACL {
+				if entry.Group != "" && entry.Group == group {
+					inGroup = true
+					groupBits |= entry.Mode
+				}
+			}
+		}
+		if inGroup {
+			granted = groupBits
+		}
+	}
+	return granted&want == want
+}
+
+// Parses entries like user:alice:rw,group:eng:r
+func ParseACL(s string) ([]ACLEntry, error) {
+	var acl []ACLEntry
+	for _, field := range strings.Split(s, ",") {
+		if field == "" {
+			continue
+		}
+		parts := strings.Split(field, ":")
+		if len(parts) != 3 || parts[1] == "" {
+			return nil, NewError(InvalidArgument, "Bad ACL entry '"+field+"'")
+		}
+		var entry ACLEntry
+		switch parts[0] {
+		case "user":
+			entry.User = parts[1]
+		case "group":
+			entry.Group = parts[1]
+		default:
+			return nil, NewError(InvalidArgument, "Bad ACL entry '"+field+"'")
+		}
+		for _, c := range parts[2] {
+			switch c {
+			case 'r':
+				entry.Mode |= Read
+			case 'w':
+				entry.Mode |= Write
+			case 'x':
+				entry.Mode |= 1
+			case '-':
+			default:
+				return nil, NewError(InvalidArgument, "Bad ACL entry '"+field+"'")
+			}
+		}
+		acl = append(acl, entry)
+	}
+	return acl, nil
+}
+
+// Octal, like 640
+func ParseMode(s string) (uint32, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, NewError(InvalidArgument, "Bad mode '"+s+"'")
+	}
+	return uint32(mode), nil
+}
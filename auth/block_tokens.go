@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+var (
+	ErrNoBlockToken  = NewError(PermissionDenied, "Block token required")
+	ErrBadBlockToken = NewError(PermissionDenied, "Invalid block token")
+	ErrNoBlockKeys   = NewError(Retryable, "No block keys from the leader yet")
+)
+
+// Stands in for a block in tokens that let admins ask DataNodes how they're
+// doing. Real blocks always have a colon in them.
+const StatsBlock BlockID = "stats"
+
+// Keys that block tokens are signed with. The leader makes a new one every
+// so often and hands them all to the DataNodes with heartbeats, and keeps
+// each around long enough to check any token signed with it.
+type BlockKeys struct {
+	// Refuse everything until there are keys, instead of letting everything
+	// through
+	Required bool
+
+	mutex sync.Mutex
+	keys  []BlockKey
+}
+
+// Swaps in the keys the leader sent. None turns checking off, unless
+// they're Required.
+func (self *BlockKeys) Set(keys []BlockKey) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.keys = keys
+}
+
+// Whether tokens are being checked at all
+func (self *BlockKeys) Checking() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.Required || len(self.keys) > 0
+}
+
+// Makes a new key if the newest is more than interval old, and drops ones
+// tokens signed with can't be valid any more. Tokens last for lifetime.
+// Returns what's left, and whether there's a new one.
+func (self *BlockKeys) Roll(interval, lifetime time.Duration) ([]BlockKey, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	now := time.Now()
+	var live []BlockKey
+	for _, key := range self.keys {
+		if key.Expires > now.Unix() {
+			live = append(live, key)
+		}
+	}
+	stale := len(live) == 0
+	if !stale {
+		made := time.Unix(live[len(live)-1].Expires, 0).Add(-interval - lifetime)
+		stale = now.Sub(made) >= interval
+	}
+	if stale {
+		id, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalln(err)
+		}
+		live = append(live, BlockKey{id.Int64(), secret, now.Add(interval + lifetime).Unix()})
+	}
+	self.keys = live
+	return append([]BlockKey{}, live...), stale
+}
+
+// Lets whoever has it do mode to the block, or any of its internal blocks
+// if it's a block group. Nil if there are no keys.
+func (self *BlockKeys) Sign(block BlockID, mode uint32, lifetime time.Duration) *BlockToken {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if len(self.keys) == 0 {
+		return nil
+	}
+	key := self.keys[len(self.keys)-1]
+	token := &BlockToken{block, mode, time.Now().Add(lifetime).Unix(), key.ID, nil}
+	token.MAC = blockTokenMAC(key, token)
+	return token
+}
+
+// Whether the token lets its holder do mode to the block. Anything goes if
+// there are no keys and they aren't Required.
+func (self *BlockKeys) Verify(token *BlockToken, block BlockID, mode uint32) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if len(self.keys) == 0 {
+		if self.Required {
+			return ErrNoBlockKeys
+		}
+		return nil
+	}
+	if token == nil {
+		return ErrNoBlockToken
+	}
+	if token.BlockID != block {
+		if group, _, ok := SplitCellID(block); !ok || token.BlockID != group {
+			return ErrBadBlockToken
+		}
+	}
+	if token.Mode&mode != mode || time.Now().Unix() > token.Expires {
+		return ErrBadBlockToken
+	}
+	for _, key := range self.keys {
+		if key.ID == token.KeyID {
+			if !hmac.Equal(token.MAC, blockTokenMAC(key, token)) {
+				return ErrBadBlockToken
+			}
+			return nil
+		}
+	}
+	return ErrBadBlockToken
+}
+
+func blockTokenMAC(key BlockKey, token *BlockToken) []byte {
+	fields, err := json.Marshal([]interface{}{token.BlockID, token.Mode, token.Expires, token.KeyID})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write(fields)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,100 @@
+// Compression codecs for blobs, and the framed format compressed blocks are
+// stored in.
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+type Codec interface {
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	// size is how long src was before it was compressed
+	Decompress(src []byte, size int) ([]byte, error)
+}
+
+// The empty name means no compression, and gives nil
+func Get(name string) (Codec, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "gzip":
+		return gzipCodec{}, nil
+	case "flate":
+		return flateCodec{}, nil
+	case "lz":
+		return lzCodec{}, nil
+	default:
+		return nil, errors.New("Unknown codec '" + name + "'")
+	}
+}
+
+var ErrCorrupt = errors.New("Compressed data is corrupt")
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(src []byte, size int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return readSize(r, size)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Name() string {
+	return "flate"
+}
+
+func (flateCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(src []byte, size int) ([]byte, error) {
+	return readSize(flate.NewReader(bytes.NewReader(src)), size)
+}
+
+// Exactly size bytes, and then the end
+func readSize(r io.Reader, size int) ([]byte, error) {
+	out := make([]byte, size)
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, err
+	}
+	if n, _ := io.Copy(ioutil.Discard, r); n != 0 {
+		return nil, ErrCorrupt
+	}
+	return out, nil
+}
@@ -0,0 +1,131 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// A compressed block is cut into frames of FrameSize bytes, each compressed
+// on its own so reading part of a block only decodes the frames it covers.
+// After the frames comes an index of how long each one is stored, then a
+// trailer:
+//
+//	frames  []byte
+//	index   []uint32, with rawFrame set for frames that didn't compress
+//	trailer uint64 uncompressed size, uint32 frame count, "DFSZ"
+const FrameSize = 64 * 1024
+
+const (
+	TrailerSize = 16
+	magic       = "DFSZ"
+	rawFrame    = 1 << 31
+)
+
+// Reads size bytes of data and compresses them into a block
+func CompressBlock(c Codec, data io.Reader, size int64) ([]byte, error) {
+	var out, index []byte
+	frame := make([]byte, FrameSize)
+	count := 0
+	for remaining := size; remaining > 0; remaining -= FrameSize {
+		n := FrameSize
+		if remaining < FrameSize {
+			n = int(remaining)
+		}
+		if _, err := io.ReadFull(data, frame[:n]); err != nil {
+			return nil, err
+		}
+		compressed, err := c.Compress(frame[:n])
+		if err != nil {
+			return nil, err
+		}
+		length := uint32(len(compressed))
+		if len(compressed) >= n {
+			compressed = frame[:n]
+			length = uint32(n) | rawFrame
+		}
+		out = append(out, compressed...)
+		index = binary.LittleEndian.AppendUint32(index, length)
+		count++
+	}
+	out = append(out, index...)
+	out = binary.LittleEndian.AppendUint64(out, uint64(size))
+	out = binary.LittleEndian.AppendUint32(out, uint32(count))
+	return append(out, magic...), nil
+}
+
+var errTrailer = errors.New("Not a compressed block")
+
+// Where each frame of a compressed block is stored
+type BlockIndex struct {
+	Size    int64
+	offsets []int64
+	raw     []bool
+}
+
+// How many frames there are, and so how many bytes of index precede the
+// trailer
+func ParseTrailer(trailer []byte) (frames int, size int64, err error) {
+	if len(trailer) != TrailerSize || string(trailer[12:]) != magic {
+		return 0, 0, errTrailer
+	}
+	size = int64(binary.LittleEndian.Uint64(trailer))
+	frames = int(binary.LittleEndian.Uint32(trailer[8:]))
+	if int64(frames) != (size+FrameSize-1)/FrameSize {
+		return 0, 0, errTrailer
+	}
+	return frames, size, nil
+}
+
+func IndexSize(frames int) int64 {
+	return 4 * int64(frames)
+}
+
+func ParseIndex(index []byte, size int64) (*BlockIndex, error) {
+	idx := &BlockIndex{Size: size, offsets: []int64{0}}
+	for i := 0; i+4 <= len(index); i += 4 {
+		length := binary.LittleEndian.Uint32(index[i:])
+		idx.raw = append(idx.raw, length&rawFrame != 0)
+		idx.offsets = append(idx.offsets, idx.offsets[len(idx.offsets)-1]+int64(length&^rawFrame))
+	}
+	if int64(len(idx.raw)) != (size+FrameSize-1)/FrameSize {
+		return nil, errTrailer
+	}
+	return idx, nil
+}
+
+// The frames holding length bytes at offset
+func (self *BlockIndex) Frames(offset, length int64) (first, last int) {
+	return int(offset / FrameSize), int((offset + length - 1) / FrameSize)
+}
+
+// Where frames first through last are stored in the block
+func (self *BlockIndex) Span(first, last int) (offset, length int64) {
+	return self.offsets[first], self.offsets[last+1] - self.offsets[first]
+}
+
+// Decompresses frames first through last, read from their Span
+func (self *BlockIndex) Decode(c Codec, first, last int, stored []byte) ([]byte, error) {
+	var out []byte
+	base := self.offsets[first]
+	for i := first; i <= last; i++ {
+		frame := stored[self.offsets[i]-base : self.offsets[i+1]-base]
+		size := FrameSize
+		if remaining := self.Size - int64(i)*FrameSize; remaining < FrameSize {
+			size = int(remaining)
+		}
+		if self.raw[i] {
+			if len(frame) != size {
+				return nil, ErrCorrupt
+			}
+			out = append(out, frame...)
+			continue
+		}
+		decoded, err := c.Decompress(frame, size)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, decoded...)
+	}
+	return out, nil
+}
@@ -0,0 +1,143 @@
+package codec
+
+import (
+	"encoding/binary"
+)
+
+// A small LZ77 codec in the style of LZ4, for when gzip is too slow. The
+// compressed data is a run of sequences, each a token byte, some literal
+// bytes, and a match to copy from earlier in the output:
+//
+//	token    high 4 bits literal length, low 4 bits match length - 4
+//	         (15 means more length bytes follow, added up until one
+//	         isn't 255)
+//	literals [literal length]byte
+//	offset   uint16, how far back the match starts
+//
+// The last sequence only has literals.
+type lzCodec struct{}
+
+const (
+	lzMinMatch  = 4
+	lzMaxOffset = 1<<16 - 1
+	lzHashBits  = 14
+)
+
+func (lzCodec) Name() string {
+	return "lz"
+}
+
+func (lzCodec) Compress(src []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(src)/2+16)
+	if len(src) == 0 {
+		return dst, nil
+	}
+	// Where each hash of 4 bytes was last seen, plus one
+	var table [1 << lzHashBits]int
+	anchor := 0
+	for i := 0; i+lzMinMatch <= len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lzHashBits)
+		candidate := table[h] - 1
+		table[h] = i + 1
+		if candidate < 0 || i-candidate > lzMaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != seq {
+			i++
+			continue
+		}
+		length := lzMinMatch
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = lzSequence(dst, src[anchor:i], i-candidate, length)
+		i += length
+		anchor = i
+	}
+	return lzSequence(dst, src[anchor:], 0, 0), nil
+}
+
+// A match length of 0 is the last sequence
+func lzSequence(dst []byte, literals []byte, offset, length int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if length > 0 {
+		token |= byte(min(length-lzMinMatch, 15))
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lzLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if length > 0 {
+		dst = append(dst, byte(offset), byte(offset>>8))
+		if length-lzMinMatch >= 15 {
+			dst = lzLength(dst, length-lzMinMatch-15)
+		}
+	}
+	return dst
+}
+
+func lzLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (lzCodec) Decompress(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	readLength := func(i *int, n int) (int, bool) {
+		if n < 15 {
+			return n, true
+		}
+		for {
+			if *i >= len(src) {
+				return 0, false
+			}
+			b := src[*i]
+			*i++
+			n += int(b)
+			if b != 255 {
+				return n, true
+			}
+		}
+	}
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		literals, ok := readLength(&i, int(token>>4))
+		if !ok || literals > len(src)-i || len(dst)+literals > size {
+			return nil, ErrCorrupt
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			break
+		}
+		if i+2 > len(src) {
+			return nil, ErrCorrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		length, ok := readLength(&i, int(token&15))
+		length += lzMinMatch
+		if !ok || offset == 0 || offset > len(dst) || len(dst)+length > size {
+			return nil, ErrCorrupt
+		}
+		// The match can overlap what it's writing, so a byte at a time
+		start := len(dst) - offset
+		for k := 0; k < length; k++ {
+			dst = append(dst, dst[start+k])
+		}
+	}
+	if len(dst) != size {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
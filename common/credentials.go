@@ -0,0 +1,59 @@
+package common
+
+import (
+	"context"
+	"net/rpc"
+	"sync"
+)
+
+// Sent to the leader on every connection by calls that don't bring a token
+// of their own with WithToken
+var (
+	tokenLock    sync.RWMutex
+	defaultToken string
+)
+
+func SetToken(token string) {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	defaultToken = token
+}
+
+type tokenKey struct{}
+
+// Calls made with the context authenticate with token, whatever SetToken
+// says. An empty token makes them anonymous.
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// Who calls made with the context authenticate as
+func TokenOf(ctx context.Context) string {
+	if token, ok := ctx.Value(tokenKey{}).(string); ok {
+		return token
+	}
+	tokenLock.RLock()
+	defer tokenLock.RUnlock()
+	return defaultToken
+}
+
+// Connects to the leader's client port, authenticating first if there's a
+// token
+func DialLeader(addr string, debug bool) (*rpc.Client, error) {
+	return DialLeaderContext(context.Background(), addr, debug)
+}
+
+func DialLeaderContext(ctx context.Context, addr string, debug bool) (*rpc.Client, error) {
+	client, err := DialRPCContext(ctx, addr, debug)
+	if err != nil {
+		return nil, err
+	}
+	if token := TokenOf(ctx); token != "" {
+		var id Identity
+		if err := CallContext(ctx, client, "Authenticate", token, &id); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// How a blob is stored if it isn't replicated. Each block of the blob
+// becomes a block group: its data is striped a cell at a time across
+// DataCells internal blocks, and every stripe gets ParityCells cells of
+// Reed-Solomon parity in internal blocks of their own. Each internal block
+// lives on a different DataNode, and any DataCells of them are enough to
+// get the data back.
+type ErasurePolicy struct {
+	DataCells   int
+	ParityCells int
+	CellSize    int64
+}
+
+// Policies are named like RS-6-3, for 6 data and 3 parity cells. The empty
+// name means plain replication, and gives nil.
+func ParsePolicy(name string) (*ErasurePolicy, error) {
+	if name == "" {
+		return nil, nil
+	}
+	var k, m int
+	if n, err := fmt.Sscanf(name, "RS-%d-%d", &k, &m); err != nil || n != 2 || name != fmt.Sprintf("RS-%d-%d", k, m) {
+		return nil, NewError(InvalidArgument, "Unknown storage policy '"+name+"'")
+	}
+	if k < 1 || m < 1 || k+m > 256 {
+		return nil, NewError(InvalidArgument, "Storage policy '"+name+"' is out of range")
+	}
+	return &ErasurePolicy{k, m, ChunkSize}, nil
+}
+
+func (self ErasurePolicy) String() string {
+	return fmt.Sprintf("RS-%d-%d", self.DataCells, self.ParityCells)
+}
+
+// Number of internal blocks in a group
+func (self ErasurePolicy) Cells() int {
+	return self.DataCells + self.ParityCells
+}
+
+// Bytes of the blob's data in each stripe
+func (self ErasurePolicy) StripeSize() int64 {
+	return int64(self.DataCells) * self.CellSize
+}
+
+func (self ErasurePolicy) Stripes(groupSize int64) int64 {
+	return (groupSize + self.StripeSize() - 1) / self.StripeSize()
+}
+
+// How much of stripe s is in internal block i. Only the last stripe can be
+// short, and its parity is as long as its first data cell.
+func (self ErasurePolicy) StripeCellLength(groupSize int64, s int64, i int) int64 {
+	left := groupSize - s*self.StripeSize()
+	if i < self.DataCells {
+		left -= int64(i) * self.CellSize
+	}
+	switch {
+	case left < 0:
+		return 0
+	case left > self.CellSize:
+		return self.CellSize
+	default:
+		return left
+	}
+}
+
+// Size of internal block i. Internal blocks that come out empty aren't
+// stored anywhere.
+func (self ErasurePolicy) CellLength(groupSize int64, i int) int64 {
+	stripes := self.Stripes(groupSize)
+	if stripes == 0 {
+		return 0
+	}
+	return (stripes-1)*self.CellSize + self.StripeCellLength(groupSize, stripes-1, i)
+}
+
+// Internal blocks are named after their group
+func CellID(group BlockID, i int) BlockID {
+	return BlockID(string(group) + "#" + strconv.Itoa(i))
+}
+
+func SplitCellID(block BlockID) (BlockID, int, bool) {
+	at := strings.LastIndex(string(block), "#")
+	if at < 0 {
+		return "", 0, false
+	}
+	i, err := strconv.Atoi(string(block)[at+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return block[:at], i, true
+}
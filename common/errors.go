@@ -0,0 +1,147 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strings"
+)
+
+// What kind of thing went wrong on the other end of a call, so callers can
+// decide what to do about it without going by the message
+type ErrorCode string
+
+const (
+	// From peers that don't send codes, or errors nobody gave one
+	Unknown  ErrorCode = ""
+	NotFound ErrorCode = "NotFound"
+	// Try again, later or somewhere else
+	Retryable        ErrorCode = "Retryable"
+	PermissionDenied ErrorCode = "PermissionDenied"
+	ChecksumMismatch ErrorCode = "ChecksumMismatch"
+	LeaseExpired     ErrorCode = "LeaseExpired"
+	// The request makes no sense and won't next time either
+	InvalidArgument ErrorCode = "InvalidArgument"
+	// Something else has the blob or block, or it's in the wrong state
+	Conflict ErrorCode = "Conflict"
+	// The peer doesn't know the method, or can't do it in its setup
+	Unsupported ErrorCode = "Unsupported"
+	// No protocol version in common
+	Incompatible ErrorCode = "Incompatible"
+)
+
+var errorCodes = map[ErrorCode]bool{
+	NotFound: true, Retryable: true, PermissionDenied: true, ChecksumMismatch: true,
+	LeaseExpired: true, InvalidArgument: true, Conflict: true, Unsupported: true,
+	Incompatible: true,
+}
+
+// An error that goes over the wire. Servers send them in place of the plain
+// strings JSON-RPC has room for, as
+//
+//	Code: Message<tab>{"detail": "value"}
+//
+// so older peers still get something readable, and clients get them back
+// from CallContext and TransferConn.Call.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	// Anything else the caller might want, like which block
+	Details map[string]string
+}
+
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{code, message, nil}
+}
+
+func Errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return NewError(code, fmt.Sprintf(format, args...))
+}
+
+// Adds a detail, returning the same error
+func (self *Error) With(key, value string) *Error {
+	if self.Details == nil {
+		self.Details = map[string]string{}
+	}
+	self.Details[key] = value
+	return self
+}
+
+func (self *Error) Error() string {
+	return self.Message
+}
+
+func (self *Error) Encode() string {
+	s := self.Message
+	if self.Code != Unknown {
+		s = string(self.Code) + ": " + s
+	}
+	if len(self.Details) > 0 {
+		details, _ := json.Marshal(self.Details)
+		s += "\t" + string(details)
+	}
+	return s
+}
+
+func DecodeError(s string) *Error {
+	self := &Error{}
+	if i := strings.LastIndex(s, "\t"); i >= 0 && json.Unmarshal([]byte(s[i+1:]), &self.Details) == nil {
+		s = s[:i]
+	}
+	if i := strings.Index(s, ": "); i >= 0 && errorCodes[ErrorCode(s[:i])] {
+		self.Code = ErrorCode(s[:i])
+		s = s[i+2:]
+	}
+	self.Message = s
+	return self
+}
+
+// What to send for err. Errors without a code are sent as they are.
+func toError(err error) *Error {
+	switch err := err.(type) {
+	case *Error:
+		return err
+	case *VersionError:
+		return NewError(Incompatible, err.Error()).
+			With("local", err.Local.String()).
+			With("remote", err.Remote.String())
+	}
+	return NewError(Unknown, err.Error())
+}
+
+// The error the peer sent, if err is one. Network errors and the like
+// aren't.
+func AsError(err error) (*Error, bool) {
+	switch err := err.(type) {
+	case *Error:
+		return err, true
+	case rpc.ServerError:
+		return DecodeError(string(err)), true
+	}
+	return nil, false
+}
+
+// Unknown unless err came from a peer and had a code
+func ErrorCodeOf(err error) ErrorCode {
+	if e, ok := AsError(err); ok {
+		return e.Code
+	}
+	return Unknown
+}
+
+// Whether trying the call again, maybe on another node, could work: the
+// peer said so, the data got mangled on the way, or the peer couldn't be
+// reached or didn't answer. Anything else the peer sent back will just
+// happen again, and callers that were cancelled or ran out of time have
+// given up.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if e, remote := AsError(err); remote {
+		return e.Code == Retryable || e.Code == ChecksumMismatch
+	}
+	return true
+}
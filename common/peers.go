@@ -0,0 +1,90 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Things go wrong in one of two ways. When this process can't go on, like
+// its disk or database failing underneath it, it dies. When somebody it's
+// talking to breaks, by hanging up, sending nonsense, or going quiet, only
+// the connection with them goes: PeerFailed logs it and counts it against
+// them, so a misbehaving peer shows up without taking the node down.
+type PeerFailure struct {
+	Peer      string
+	Failures  int64
+	LastError string
+	Last      time.Time
+}
+
+var (
+	peerFailuresLock sync.Mutex
+	peerFailures     = map[string]*PeerFailure{}
+)
+
+// Counted by host, since the port's different every time a peer connects
+func PeerFailed(addr net.Addr, err error) {
+	log.Println("Peer", addr, "broke:", err)
+	peer := addr.String()
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	peerFailuresLock.Lock()
+	defer peerFailuresLock.Unlock()
+	failure := peerFailures[peer]
+	if failure == nil {
+		failure = &PeerFailure{Peer: peer}
+		peerFailures[peer] = failure
+	}
+	failure.Failures++
+	failure.LastError = err.Error()
+	failure.Last = time.Now()
+}
+
+// Peers whose connections have been dropped, worst first
+func PeerFailures() []PeerFailure {
+	peerFailuresLock.Lock()
+	defer peerFailuresLock.Unlock()
+	// Never nil, since JSON-RPC can't tell a null result from a missing one
+	failures := []PeerFailure{}
+	for _, failure := range peerFailures {
+		failures = append(failures, *failure)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].Failures != failures[j].Failures {
+			return failures[i].Failures > failures[j].Failures
+		}
+		return failures[i].Peer < failures[j].Peer
+	})
+	return failures
+}
+
+// Hands each connection to handle until sock is closed. Accept errors, like
+// running out of file descriptors, are waited out rather than taking the
+// server down.
+func AcceptLoop(sock net.Listener, handle func(net.Conn)) {
+	var wait time.Duration
+	for {
+		conn, err := sock.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			log.Println("Stopped accepting on", sock.Addr())
+			return
+		}
+		if err != nil {
+			if wait *= 2; wait == 0 {
+				wait = 5 * time.Millisecond
+			} else if wait > time.Second {
+				wait = time.Second
+			}
+			log.Println("Accept error:", err, "- trying again in", wait)
+			time.Sleep(wait)
+			continue
+		}
+		wait = 0
+		go handle(conn)
+	}
+}
@@ -0,0 +1,193 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// How one DataNode in a write pipeline fared. Error is empty on success.
+type ReplicaStatus struct {
+	Addr  string
+	Error string
+}
+
+// One DataNode's part in a write pipeline: take packets from upstream,
+// write them locally, and pass them on downstream as they arrive. A packet
+// is only acknowledged once it's been written here and acknowledged from
+// downstream, so the acks that reach the client speak for every replica.
+//
+// Losing the downstream node doesn't stop the write here; it's reported in
+// the acks and in the statuses from Confirm, and the client finds it a
+// replacement.
+type Relay struct {
+	upstream       *TransferConn
+	downstream     *TransferConn
+	downstreamAddr string
+	self           string
+	debug          bool
+	// Nodes we couldn't start a pipeline with
+	failed []ReplicaStatus
+
+	lock          sync.Mutex
+	downstreamErr error
+}
+
+// Finds the first of forward.Nodes that will take the block and asks it to
+// pipeline to the rest. self is the address this DataNode is known by. The
+// downstream connection is closed when ctx is done.
+func OpenRelay(ctx context.Context, upstream *TransferConn, forward ForwardBlock, self string, debug bool) *Relay {
+	return openRelay(ctx, upstream, forward.BlockID, forward.Nodes, self, debug,
+		func(conn *TransferConn, rest []string) error {
+			return conn.Call("Forward", &ForwardBlock{forward.BlockID, rest, forward.Size, forward.Token}, nil)
+		})
+}
+
+// Same as OpenRelay, for adding to the end of a block every node already has
+func OpenAppendRelay(ctx context.Context, upstream *TransferConn, msg AppendBlock, self string, debug bool) *Relay {
+	return openRelay(ctx, upstream, msg.BlockID, msg.Nodes, self, debug,
+		func(conn *TransferConn, rest []string) error {
+			return conn.Call("Append", &AppendBlock{msg.BlockID, rest, msg.Offset, msg.Size, msg.Token}, nil)
+		})
+}
+
+func openRelay(ctx context.Context, upstream *TransferConn, block BlockID, nodes []string, self string, debug bool,
+	start func(conn *TransferConn, rest []string) error) *Relay {
+	relay := &Relay{upstream: upstream, self: self, debug: debug}
+	for i, addr := range nodes {
+		conn, err := DialTransferContext(ctx, addr, debug)
+		if err == nil {
+			err = start(conn, nodes[i+1:])
+			if err == nil {
+				relay.downstream = conn
+				relay.downstreamAddr = addr
+				break
+			}
+			conn.Close()
+		}
+		log.Println("Couldn't pipeline", block, "to", addr, "->", err)
+		relay.failed = append(relay.failed, ReplicaStatus{addr, err.Error()})
+	}
+	return relay
+}
+
+func (self *Relay) Close() error {
+	if self.downstream != nil {
+		return self.downstream.Close()
+	}
+	return nil
+}
+
+func (self *Relay) downstreamFailed(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.downstreamErr == nil {
+		log.Println("Pipeline to", self.downstreamAddr, "broke ->", err)
+		self.downstreamErr = err
+	}
+}
+
+func (self *Relay) downstreamAlive() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.downstream != nil && self.downstreamErr == nil
+}
+
+// Statuses of everything past this node
+func (self *Relay) downstreamStatus(replicas []ReplicaStatus) []ReplicaStatus {
+	statuses := append([]ReplicaStatus{}, self.failed...)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.downstreamErr != nil {
+		return append(statuses, ReplicaStatus{self.downstreamAddr, self.downstreamErr.Error()})
+	}
+	return append(statuses, replicas...)
+}
+
+// Receives exactly size bytes into w.
+func (self *Relay) Receive(size int64, w io.Writer) error {
+	written := make(chan uint64, 16)
+	acked := make(chan bool)
+	go self.ack(written, acked)
+	defer func() {
+		close(written)
+		<-acked
+	}()
+
+	data := self.upstream.NewDataReader(false)
+	var received int64
+	for {
+		payload, seq, err := data.ReadPacket()
+		if err == io.EOF {
+			if received != size {
+				return io.ErrUnexpectedEOF
+			}
+			if self.downstreamAlive() {
+				if err := self.downstream.writePacket(packetEnd, seq, nil); err != nil {
+					self.downstreamFailed(err)
+				}
+			}
+			written <- seq
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		received += int64(len(payload))
+		if received > size {
+			return errors.New("More data than expected")
+		}
+		if _, err := w.Write(payload); err != nil {
+			self.upstream.SendAck(Ack{Seq: seq, Error: "Writing block"})
+			return err
+		}
+		if self.downstreamAlive() {
+			if err := self.downstream.writePacket(packetData, seq, payload); err != nil {
+				self.downstreamFailed(err)
+			}
+		}
+		written <- seq
+	}
+}
+
+func (self *Relay) ack(written chan uint64, acked chan bool) {
+	defer close(acked)
+	for seq := range written {
+		var replicas []ReplicaStatus
+		if self.downstreamAlive() {
+			ack, err := self.downstream.ReadAck()
+			switch {
+			case err != nil:
+				self.downstreamFailed(err)
+			case ack.Error != "":
+				self.downstreamFailed(DecodeError(ack.Error))
+			case ack.Seq != seq:
+				self.downstreamFailed(fmt.Errorf("Expected ack for packet %d, got %d", seq, ack.Seq))
+			default:
+				replicas = ack.Replicas
+			}
+		}
+		replicas = append([]ReplicaStatus{{self.self, ""}}, self.downstreamStatus(replicas)...)
+		if err := self.upstream.SendAck(Ack{Seq: seq, Replicas: replicas}); err != nil {
+			// Upstream will notice on its own
+			if self.debug {
+				log.Println("Sending ack:", err)
+			}
+		}
+	}
+}
+
+// Passes the client's checksum down the pipeline once this node has
+// checked it, and returns how every node past this one did.
+func (self *Relay) Confirm(checksum string) []ReplicaStatus {
+	var replicas []ReplicaStatus
+	if self.downstreamAlive() {
+		if err := self.downstream.Call("Confirm", checksum, &replicas); err != nil {
+			self.downstreamFailed(err)
+		}
+	}
+	return self.downstreamStatus(replicas)
+}
@@ -0,0 +1,239 @@
+package common
+
+import (
+	"context"
+	"io"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keeps connections open between calls instead of dialing for each one.
+// Shared pools hand everyone the same connection to an address, for
+// protocols like JSON-RPC that can have many calls going on one; otherwise
+// each caller has a connection to itself until it puts it back. Connections
+// idle for IdleTimeout are closed, and ones idle for CheckAfter are checked
+// before they're used again.
+type Pool struct {
+	Dial func(ctx context.Context, addr string) (io.Closer, error)
+	// Nil if the connection still works
+	Check       func(conn io.Closer) error
+	Shared      bool
+	MaxIdle     int
+	IdleTimeout time.Duration
+	CheckAfter  time.Duration
+
+	mutex   sync.Mutex
+	conns   map[string][]*pooledConn
+	reaping bool
+}
+
+type pooledConn struct {
+	conn     io.Closer
+	lastUsed time.Time
+	// Callers using a shared connection
+	users int
+}
+
+// Only uses ctx if it has to connect
+func (self *Pool) Get(ctx context.Context, addr string) (io.Closer, error) {
+	self.mutex.Lock()
+	if self.conns == nil {
+		self.conns = map[string][]*pooledConn{}
+	}
+	if !self.reaping && self.IdleTimeout > 0 {
+		self.reaping = true
+		go self.reap()
+	}
+	for len(self.conns[addr]) > 0 {
+		conns := self.conns[addr]
+		pc := conns[len(conns)-1]
+		if !self.Shared {
+			self.conns[addr] = conns[:len(conns)-1]
+		}
+		stale := time.Since(pc.lastUsed) >= self.CheckAfter
+		pc.lastUsed = time.Now()
+		pc.users++
+		self.mutex.Unlock()
+		if !stale || self.Check == nil || self.Check(pc.conn) == nil {
+			return pc.conn, nil
+		}
+		self.Discard(addr, pc.conn)
+		self.mutex.Lock()
+	}
+	self.mutex.Unlock()
+
+	conn, err := self.Dial(ctx, addr)
+	if err != nil || !self.Shared {
+		return conn, err
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	// Whoever dialed first wins
+	if conns := self.conns[addr]; len(conns) > 0 {
+		conn.Close()
+		conns[0].users++
+		return conns[0].conn, nil
+	}
+	self.conns[addr] = []*pooledConn{{conn, time.Now(), 1}}
+	return conn, nil
+}
+
+// Hands back a connection that's still good
+func (self *Pool) Put(addr string, conn io.Closer) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.Shared {
+		for _, pc := range self.conns[addr] {
+			if pc.conn == conn {
+				pc.users--
+				pc.lastUsed = time.Now()
+				return
+			}
+		}
+		// Discarded while it was being used
+		return
+	}
+	if len(self.conns[addr]) >= self.MaxIdle {
+		conn.Close()
+		return
+	}
+	self.conns[addr] = append(self.conns[addr], &pooledConn{conn, time.Now(), 0})
+}
+
+// Closes a connection that broke, so nobody else gets it
+func (self *Pool) Discard(addr string, conn io.Closer) {
+	self.mutex.Lock()
+	conns := self.conns[addr]
+	for i, pc := range conns {
+		if pc.conn == conn {
+			self.conns[addr] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	self.mutex.Unlock()
+	conn.Close()
+}
+
+// Closes every connection in the pool, including ones in use
+func (self *Pool) Close() {
+	self.mutex.Lock()
+	conns := self.conns
+	self.conns = nil
+	self.mutex.Unlock()
+	for _, list := range conns {
+		for _, pc := range list {
+			pc.conn.Close()
+		}
+	}
+}
+
+func (self *Pool) reap() {
+	for {
+		time.Sleep(self.IdleTimeout / 2)
+		self.mutex.Lock()
+		for addr, conns := range self.conns {
+			var live []*pooledConn
+			for _, pc := range conns {
+				if pc.users == 0 && time.Since(pc.lastUsed) >= self.IdleTimeout {
+					pc.conn.Close()
+				} else {
+					live = append(live, pc)
+				}
+			}
+			if len(live) == 0 {
+				delete(self.conns, addr)
+			} else {
+				self.conns[addr] = live
+			}
+		}
+		self.mutex.Unlock()
+	}
+}
+
+// One connection to each leader or KMS, shared by every call the process
+// makes to it
+func newRPCPool(dial func(ctx context.Context, addr string) (*rpc.Client, error)) *Pool {
+	return &Pool{
+		Dial: func(ctx context.Context, addr string) (io.Closer, error) {
+			return dial(ctx, addr)
+		},
+		Check: func(conn io.Closer) error {
+			var ok string
+			return CallContext(context.Background(), conn.(*rpc.Client), "Ping", nil, &ok)
+		},
+		Shared:      true,
+		IdleTimeout: time.Minute,
+		CheckAfter:  10 * time.Second,
+	}
+}
+
+var (
+	// Connections are authenticated as whoever dialed them, so each token
+	// has its own, under "address token"
+	leaderPool = newRPCPool(func(ctx context.Context, key string) (*rpc.Client, error) {
+		addr, token, _ := strings.Cut(key, " ")
+		return DialLeaderContext(WithToken(ctx, token), addr, false)
+	})
+	peerPool = newRPCPool(func(ctx context.Context, addr string) (*rpc.Client, error) {
+		return DialRPCContext(ctx, addr, false)
+	})
+)
+
+// Calls method on the leader's client port, as whoever the context's token
+// or SetToken says. Debug gets a connection of its own that logs
+// everything.
+func CallLeader(addr string, debug bool, method string, args interface{}, reply interface{}) error {
+	return CallLeaderContext(context.Background(), addr, debug, method, args, reply)
+}
+
+func CallLeaderContext(ctx context.Context, addr string, debug bool, method string, args interface{}, reply interface{}) error {
+	if debug {
+		client, err := DialLeaderContext(ctx, addr, true)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		return CallContext(ctx, client, method, args, reply)
+	}
+	return callPooled(ctx, leaderPool, addr+" "+TokenOf(ctx), method, args, reply)
+}
+
+// Calls method on the leader's cluster port or a KMS
+func CallPeer(addr string, debug bool, method string, args interface{}, reply interface{}) error {
+	return CallPeerContext(context.Background(), addr, debug, method, args, reply)
+}
+
+func CallPeerContext(ctx context.Context, addr string, debug bool, method string, args interface{}, reply interface{}) error {
+	if debug {
+		client, err := DialRPCContext(ctx, addr, true)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		return CallContext(ctx, client, method, args, reply)
+	}
+	return callPooled(ctx, peerPool, addr, method, args, reply)
+}
+
+// Connections the other end closed while they sat in the pool fail before
+// the call is sent, so those are tried once more on a new one. Ones with
+// calls that timed out are dropped, in case the reply turns up later.
+func callPooled(ctx context.Context, pool *Pool, addr string, method string, args interface{}, reply interface{}) error {
+	for attempt := 0; ; attempt++ {
+		conn, err := pool.Get(ctx, addr)
+		if err != nil {
+			return err
+		}
+		err = CallContext(ctx, conn.(*rpc.Client), method, args, reply)
+		if _, remote := err.(*Error); err == nil || remote {
+			pool.Put(addr, conn)
+			return err
+		}
+		pool.Discard(addr, conn)
+		if err != rpc.ErrShutdown || attempt > 0 {
+			return err
+		}
+	}
+}
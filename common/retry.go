@@ -0,0 +1,139 @@
+package common
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How hard to try something that can fail for reasons that might go away.
+// The wait between attempts doubles from Backoff up to MaxBackoff, and
+// Jitter of it is random, so nodes that failed together don't all come back
+// at once.
+type RetryPolicy struct {
+	// Zero keeps trying until ctx is done
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	// Fraction of each wait, 0 to 1
+	Jitter float64
+	// Which errors are worth another try. Defaults to IsRetryable.
+	Retryable func(error) bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff:     100 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+	Jitter:      0.5,
+}
+
+// For retrying whatever went wrong
+func Always(error) bool {
+	return true
+}
+
+// How long to wait after the attempt'th try fails, counting from 1
+func (self RetryPolicy) Wait(attempt int) time.Duration {
+	wait := self.Backoff
+	for i := 1; i < attempt && wait < self.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if self.MaxBackoff > 0 && wait > self.MaxBackoff {
+		wait = self.MaxBackoff
+	}
+	return wait - time.Duration(self.Jitter*rand.Float64()*float64(wait))
+}
+
+// Calls f until it works, fails in a way that isn't worth retrying, runs
+// out of attempts, or ctx is done, and returns the last error. Attempts are
+// counted against target in RetryStats, unless it's empty because f talks
+// to more than one peer and counts them itself.
+func (self RetryPolicy) Do(ctx context.Context, target string, f func() error) error {
+	retryable := self.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if target != "" {
+			RecordAttempt(target, err)
+		}
+		if err == nil || !retryable(err) || attempt == self.MaxAttempts {
+			if err != nil && target != "" {
+				recordGaveUp(target)
+			}
+			return err
+		}
+		select {
+		case <-time.After(self.Wait(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// How things went with one peer, from this process's side
+type RetryStat struct {
+	Target   string
+	Attempts int64
+	Failures int64
+	// Times everything the policy allowed was tried and it still failed
+	GaveUp      int64
+	LastError   string
+	LastFailure time.Time
+}
+
+var (
+	retryStatsLock sync.Mutex
+	retryStats     = map[string]*RetryStat{}
+)
+
+func retryStat(target string) *RetryStat {
+	stat := retryStats[target]
+	if stat == nil {
+		stat = &RetryStat{Target: target}
+		retryStats[target] = stat
+	}
+	return stat
+}
+
+// For code that tries more than one peer in an attempt
+func RecordAttempt(target string, err error) {
+	retryStatsLock.Lock()
+	defer retryStatsLock.Unlock()
+	stat := retryStat(target)
+	stat.Attempts++
+	if err != nil {
+		stat.Failures++
+		stat.LastError = err.Error()
+		stat.LastFailure = time.Now()
+	}
+}
+
+func recordGaveUp(target string) {
+	retryStatsLock.Lock()
+	defer retryStatsLock.Unlock()
+	retryStat(target).GaveUp++
+}
+
+// Peers that have failed anything, worst first
+func RetryStats() []RetryStat {
+	retryStatsLock.Lock()
+	defer retryStatsLock.Unlock()
+	var stats []RetryStat
+	for _, stat := range retryStats {
+		if stat.Failures > 0 {
+			stats = append(stats, *stat)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Failures != stats[j].Failures {
+			return stats[i].Failures > stats[j].Failures
+		}
+		return stats[i].Target < stats[j].Target
+	})
+	return stats
+}
@@ -1,22 +1,43 @@
 package common
 
 import (
+	"encoding/json"
 	"io"
 	"log"
+	"net"
+	"sync"
 
 	"net/rpc"
 	"net/rpc/jsonrpc"
 )
 
+// Answers calls on a connection. Clients can make any number of calls on
+// one, and ReadCall lets them be answered in any order.
 type RPCServer struct {
 	codec             rpc.ServerCodec
+	writeLock         *sync.Mutex
 	lastServiceMethod string
 	lastSeq           uint64
+	// Set if the body has been read already
+	lastBody *json.RawMessage
+	// Protocol version agreed with the client
+	Version uint8
 }
 
 // TODO: Needs to support Debug
 func NewRPCServer(sock io.ReadWriteCloser) *RPCServer {
-	return &RPCServer{jsonrpc.NewServerCodec(sock), "", 0}
+	return &RPCServer{jsonrpc.NewServerCodec(sock), new(sync.Mutex), "", 0, nil, ProtocolVersion}
+}
+
+// Does the handshake with a client that just connected
+func AcceptRPC(conn net.Conn) (*RPCServer, error) {
+	version, err := ServerHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	server := NewRPCServer(conn)
+	server.Version = version
+	return server, nil
 }
 
 func (self *RPCServer) ReadHeader() (string, error) {
@@ -26,25 +47,55 @@ func (self *RPCServer) ReadHeader() (string, error) {
 	}
 	self.lastServiceMethod = r.ServiceMethod
 	self.lastSeq = r.Seq
+	self.lastBody = nil
 	return r.ServiceMethod, nil
 }
 
+// Reads a whole call, returning something to answer just that call with.
+// It can be answered from another goroutine while later calls are read.
+func (self *RPCServer) ReadCall() (string, *RPCServer, error) {
+	method, err := self.ReadHeader()
+	if err != nil {
+		return "", nil, err
+	}
+	var body json.RawMessage
+	if err := self.codec.ReadRequestBody(&body); err != nil {
+		return "", nil, err
+	}
+	call := *self
+	call.lastBody = &body
+	return method, &call, nil
+}
+
+// Calls answered at once on one connection. Past that, the connection isn't
+// read again until one of them is done, so a client sending calls faster
+// than they're answered is slowed down rather than piling up goroutines.
+const MaxConcurrentCalls = 16
+
 func (self *RPCServer) ReadBody(obj interface{}) error {
+	if self.lastBody != nil {
+		// A null body comes out empty
+		if obj == nil || len(*self.lastBody) == 0 {
+			return nil
+		}
+		return json.Unmarshal(*self.lastBody, obj)
+	}
 	return self.codec.ReadRequestBody(obj)
 }
 
-func (self *RPCServer) Error(s string) error {
+// Sends err to the client, with its code if it has one
+func (self *RPCServer) Error(err error) error {
 	var r rpc.Response
 	r.ServiceMethod = self.lastServiceMethod
 	r.Seq = self.lastSeq
-	r.Error = s
-	return self.codec.WriteResponse(&r, nil)
+	r.Error = toError(err).Encode()
+	return self.writeResponse(&r, nil)
 }
 
 func (self *RPCServer) Unacceptable() error {
 	log.Println("Unacceptable")
 	self.ReadBody(nil)
-	return self.Error("Method not accepted")
+	return self.Error(NewError(Unsupported, "Method not accepted"))
 }
 
 func (self *RPCServer) SendOkay() error {
@@ -52,7 +103,7 @@ func (self *RPCServer) SendOkay() error {
 	r.ServiceMethod = self.lastServiceMethod
 	r.Seq = self.lastSeq
 	r.Error = ""
-	return self.codec.WriteResponse(&r, "OK")
+	return self.writeResponse(&r, "OK")
 }
 
 func (self *RPCServer) Send(obj interface{}) error {
@@ -60,5 +111,11 @@ func (self *RPCServer) Send(obj interface{}) error {
 	r.ServiceMethod = self.lastServiceMethod
 	r.Seq = self.lastSeq
 	r.Error = ""
-	return self.codec.WriteResponse(&r, obj)
+	return self.writeResponse(&r, obj)
+}
+
+func (self *RPCServer) writeResponse(r *rpc.Response, obj interface{}) error {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	return self.codec.WriteResponse(r, obj)
 }
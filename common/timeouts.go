@@ -0,0 +1,141 @@
+package common
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long to wait on the network before giving up. Like the TLS settings
+// they're the same for everything the process does. Zero waits forever.
+type Timeouts struct {
+	// Connecting, including the TLS and protocol handshakes
+	Dial time.Duration
+	// For each reply, or each piece of one, once a call's been made
+	Read time.Duration
+	// For the other end to take each thing that's sent
+	Write time.Duration
+	// Servers hang up on clients that have made no calls for this long
+	Idle time.Duration
+}
+
+var DefaultTimeouts = Timeouts{
+	Dial:  10 * time.Second,
+	Read:  time.Minute,
+	Write: time.Minute,
+	Idle:  5 * time.Minute,
+}
+
+var (
+	timeoutsLock sync.Mutex
+	timeouts     = DefaultTimeouts
+)
+
+func SetTimeouts(t Timeouts) {
+	timeoutsLock.Lock()
+	defer timeoutsLock.Unlock()
+	timeouts = t
+}
+
+func CurrentTimeouts() Timeouts {
+	timeoutsLock.Lock()
+	defer timeoutsLock.Unlock()
+	return timeouts
+}
+
+// Sets a deadline before every read and write, so a peer that stops
+// answering fails whatever was waiting on it instead of hanging it. It goes
+// under TLS, which passes deadlines down anyway.
+type deadlineConn struct {
+	net.Conn
+	read  time.Duration
+	write time.Duration
+}
+
+func (self *deadlineConn) Read(p []byte) (int, error) {
+	if self.read > 0 {
+		self.Conn.SetReadDeadline(time.Now().Add(self.read))
+	}
+	return self.Conn.Read(p)
+}
+
+func (self *deadlineConn) Write(p []byte) (int, error) {
+	if self.write > 0 {
+		self.Conn.SetWriteDeadline(time.Now().Add(self.write))
+	}
+	return self.Conn.Write(p)
+}
+
+// Connections accepted from it time out after the idle timeout with nothing
+// to read
+type deadlineListener struct {
+	net.Listener
+}
+
+func (self deadlineListener) Accept() (net.Conn, error) {
+	conn, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	t := CurrentTimeouts()
+	return &deadlineConn{conn, t.Idle, t.Write}, nil
+}
+
+// Runs a protocol handshake on a new connection, giving up after the dial
+// timeout or when ctx is done
+func handshake(ctx context.Context, conn net.Conn, f func() error) error {
+	if dial := CurrentTimeouts().Dial; dial > 0 {
+		conn.SetDeadline(time.Now().Add(dial))
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	err := f()
+	if !stop() && err != nil {
+		err = ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	return err
+}
+
+// Whether err is the network giving up waiting
+func IsTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Makes a call that gives up when ctx is done, or when the reply takes
+// longer than the read timeout. Connections with calls given up on should
+// be closed, since the reply might still turn up.
+func CallContext(ctx context.Context, client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	parent := ctx
+	if read := CurrentTimeouts().Read; read > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, read)
+		defer cancel()
+	}
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if err, ok := call.Error.(rpc.ServerError); ok {
+			return DecodeError(string(err))
+		}
+		return call.Error
+	case <-ctx.Done():
+		// Only the caller giving up is final, the peer being slow is worth
+		// another go
+		if err := parent.Err(); err != nil {
+			return err
+		}
+		return os.ErrDeadlineExceeded
+	}
+}
@@ -0,0 +1,200 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Set once at startup by LoadTLS, nil while connections are plain TCP
+var clientTLS, serverTLS *tls.Config
+
+// Turns on TLS for every connection made or accepted from now on. Peers are
+// checked against the CA in caFile. Servers need a certificate; clients
+// only need one to connect somewhere that insists on it, like the leader's
+// cluster port. All empty turns TLS back off.
+func LoadTLS(certFile, keyFile, caFile string) error {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		clientTLS, serverTLS = nil, nil
+		return nil
+	}
+	if caFile == "" {
+		return errors.New("TLS needs a CA to check peers against")
+	}
+	pool := x509.NewCertPool()
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(ca) {
+		return errors.New("No certificates in " + caFile)
+	}
+	client := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	var server *tls.Config
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		client.Certificates = []tls.Certificate{cert}
+		server = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	clientTLS, serverTLS = client, server
+	return nil
+}
+
+// Connects to a leader, DataNode or KMS, over TLS if it's on
+func Dial(addr string) (net.Conn, error) {
+	return DialContext(context.Background(), addr)
+}
+
+func DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	return dialContext(ctx, addr, CurrentTimeouts().Read)
+}
+
+// Reads time out after read, which is zero for connections that wait for
+// replies in the background whether or not any calls are being made
+func dialContext(ctx context.Context, addr string, read time.Duration) (net.Conn, error) {
+	parent := ctx
+	t := CurrentTimeouts()
+	if t.Dial > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Dial)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	raw, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		// Callers that gave up should hear that, not how the dial broke
+		if parent.Err() != nil {
+			return nil, parent.Err()
+		}
+		return nil, err
+	}
+	conn := net.Conn(&deadlineConn{raw, read, t.Write})
+	if clientTLS == nil {
+		return conn, nil
+	}
+	conf := clientTLS.Clone()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		conf.ServerName = host
+	}
+	tlsConn := tls.Client(conn, conf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		if parent.Err() != nil {
+			return nil, parent.Err()
+		}
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Sets the server's timeouts on connections from a listener, and wraps it in
+// TLS if that's on. Mutual listeners turn away peers without a certificate
+// from the CA.
+func SecureListener(l net.Listener, mutual bool) (net.Listener, error) {
+	l = deadlineListener{l}
+	if clientTLS == nil {
+		return l, nil
+	}
+	if serverTLS == nil {
+		return nil, errors.New("Servers need a TLS certificate and key")
+	}
+	conf := serverTLS.Clone()
+	if mutual {
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tls.NewListener(l, conf), nil
+}
+
+// Makes dir/name.pem and dir/name-key.pem, signed by the CA in dir/ca.pem,
+// which is made too if it isn't there. The certificate is good for hosts,
+// as both a server and a client.
+func GenerateCert(dir, name string, hosts []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	caCertFile, caKeyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	if _, err := os.Stat(caCertFile); os.IsNotExist(err) {
+		template := certTemplate("golang-distributed-filesystem CA")
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		template.BasicConstraintsValid = true
+		if err := writeCert(caCertFile, caKeyFile, template, nil, nil); err != nil {
+			return err
+		}
+	}
+	ca, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+	template := certTemplate(name)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return writeCert(filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem"), template, caCert, ca.PrivateKey)
+}
+
+func certTemplate(name string) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+}
+
+// Self-signed if parent is nil
+func writeCert(certFile, keyFile string, template, parent *x509.Certificate, parentKey interface{}) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
@@ -0,0 +1,713 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Block data used to be written raw onto the socket after a JSON-RPC reply,
+// which only worked because every call got a fresh connection, and a
+// truncated transfer looked the same as a finished one. Everything on a
+// DataNode's port is now a packet:
+//
+//   type     uint8
+//   seq      uint64
+//   length   uint32
+//   checksum uint32 (CRC-32 of the payload)
+//   payload  [length]byte
+//
+// Requests and responses carry JSON, data packets are numbered from zero and
+// followed by an end packet, and the receiver acknowledges each data packet
+// once it has written it.
+
+const (
+	TransferVersion    = 1
+	MinTransferVersion = 1
+	// Largest data packet payload
+	PacketSize = ChunkSize
+	// Largest request or response
+	maxMessageSize = 1024 * 1024
+)
+
+var transferMagic = []byte("DFSX")
+
+const (
+	packetRequest uint8 = iota + 1
+	packetResponse
+	packetData
+	packetEnd
+	packetError
+	packetAck
+)
+
+const packetHeaderSize = 1 + 8 + 4 + 4
+
+var ErrUnsupportedVersion = errors.New("Unsupported transfer protocol version")
+
+type packet struct {
+	kind    uint8
+	seq     uint64
+	payload []byte
+}
+
+type transferRequest struct {
+	Method string
+	Body   *json.RawMessage
+}
+
+type transferResponse struct {
+	Error string
+	Body  *json.RawMessage
+}
+
+type Ack struct {
+	Seq uint64
+	// Set if the node sending the ack failed
+	Error string
+	// How each node from the sender down the pipeline did
+	Replicas []ReplicaStatus
+}
+
+type TransferConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	Version uint8
+	debug   bool
+
+	writeLock  sync.Mutex
+	lastMethod string
+	lastBody   *json.RawMessage
+	// Stops ctx from closing the connection
+	stop func() bool
+}
+
+// Dials a DataNode and agrees on a protocol version with it.
+func DialTransfer(addr string, debug bool) (*TransferConn, error) {
+	return DialTransferContext(context.Background(), addr, debug)
+}
+
+// The connection is closed if ctx is done before it is, which fails
+// whatever call is going on
+func DialTransferContext(ctx context.Context, addr string, debug bool) (*TransferConn, error) {
+	self, err := dialTransfer(ctx, addr, debug)
+	if err != nil {
+		return nil, err
+	}
+	self.stop = context.AfterFunc(ctx, func() {
+		self.conn.Close()
+	})
+	return self, nil
+}
+
+// Only uses ctx while connecting
+func dialTransfer(ctx context.Context, addr string, debug bool) (*TransferConn, error) {
+	conn, err := DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	self := newTransferConn(conn, debug)
+	err = handshake(ctx, conn, func() error {
+		if _, err := self.w.Write(append(transferMagic, TransferVersion)); err != nil {
+			return err
+		}
+		if err := self.w.Flush(); err != nil {
+			return err
+		}
+		version, err := self.readHandshake()
+		if err != nil {
+			return err
+		}
+		if version < MinTransferVersion || version > TransferVersion {
+			return ErrUnsupportedVersion
+		}
+		self.Version = version
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return self, nil
+}
+
+// Server side of DialTransfer. Picks the newest version both ends speak, or
+// tells the client there isn't one and gives up.
+func AcceptTransfer(conn net.Conn, debug bool) (*TransferConn, error) {
+	self := newTransferConn(conn, debug)
+	version, err := self.readHandshake()
+	if err != nil {
+		return nil, err
+	}
+	if version > TransferVersion {
+		version = TransferVersion
+	}
+	if version < MinTransferVersion {
+		version = 0
+	}
+	if _, err := self.w.Write(append(transferMagic, version)); err != nil {
+		return nil, err
+	}
+	if err := self.w.Flush(); err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return nil, ErrUnsupportedVersion
+	}
+	self.Version = version
+	return self, nil
+}
+
+func newTransferConn(conn net.Conn, debug bool) *TransferConn {
+	return &TransferConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), debug: debug}
+}
+
+func (self *TransferConn) readHandshake() (uint8, error) {
+	b := make([]byte, len(transferMagic)+1)
+	if _, err := io.ReadFull(self.r, b); err != nil {
+		return 0, err
+	}
+	if string(b[:len(transferMagic)]) != string(transferMagic) {
+		return 0, errors.New("Not a transfer protocol connection")
+	}
+	return b[len(transferMagic)], nil
+}
+
+func (self *TransferConn) RemoteAddr() net.Addr {
+	return self.conn.RemoteAddr()
+}
+
+func (self *TransferConn) Close() error {
+	if self.stop != nil {
+		self.stop()
+	}
+	return self.conn.Close()
+}
+
+func (self *TransferConn) writePacket(kind uint8, seq uint64, payload []byte) error {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+
+	header := make([]byte, packetHeaderSize)
+	header[0] = kind
+	binary.BigEndian.PutUint64(header[1:], seq)
+	binary.BigEndian.PutUint32(header[9:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[13:], crc32.ChecksumIEEE(payload))
+	if _, err := self.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := self.w.Write(payload); err != nil {
+		return err
+	}
+	// Data is flushed in bulk, everything else needs to go out now
+	if kind != packetData {
+		return self.w.Flush()
+	}
+	return nil
+}
+
+func (self *TransferConn) readPacket() (*packet, error) {
+	header := make([]byte, packetHeaderSize)
+	if _, err := io.ReadFull(self.r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[9:])
+	if length > maxMessageSize || header[0] == packetData && length > PacketSize {
+		return nil, fmt.Errorf("Packet of %d bytes is too big", length)
+	}
+	p := &packet{header[0], binary.BigEndian.Uint64(header[1:]), make([]byte, length)}
+	if _, err := io.ReadFull(self.r, p.payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(p.payload) != binary.BigEndian.Uint32(header[13:]) {
+		return nil, errors.New("Packet checksum doesn't match")
+	}
+	return p, nil
+}
+
+func (self *TransferConn) readPacketOf(kind uint8) (*packet, error) {
+	p, err := self.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if p.kind == packetError {
+		return nil, DecodeError(string(p.payload))
+	}
+	if p.kind != kind {
+		return nil, fmt.Errorf("Expected packet type %d, got %d", kind, p.kind)
+	}
+	return p, nil
+}
+
+func (self *TransferConn) writeJSON(kind uint8, obj interface{}) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return self.writePacket(kind, 0, b)
+}
+
+func (self *TransferConn) logMessage(direction string, s string, obj interface{}) {
+	if self.debug {
+		log.Println(self.conn.RemoteAddr(), direction, s, fmt.Sprintf("%+v", obj))
+	}
+}
+
+// Client side
+
+func (self *TransferConn) Call(method string, args interface{}, reply interface{}) error {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	body := json.RawMessage(b)
+	self.logMessage("<-", method, args)
+	if err := self.writeJSON(packetRequest, &transferRequest{method, &body}); err != nil {
+		return err
+	}
+
+	p, err := self.readPacketOf(packetResponse)
+	if err != nil {
+		return err
+	}
+	var resp transferResponse
+	if err := json.Unmarshal(p.payload, &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		self.logMessage("->", resp.Error, nil)
+		return DecodeError(resp.Error)
+	}
+	if reply != nil && resp.Body != nil {
+		if err := json.Unmarshal(*resp.Body, reply); err != nil {
+			return err
+		}
+	}
+	self.logMessage("->", "", reply)
+	return nil
+}
+
+// Server side, mirroring RPCServer
+
+func (self *TransferConn) ReadHeader() (string, error) {
+	p, err := self.readPacketOf(packetRequest)
+	if err != nil {
+		return "", err
+	}
+	var req transferRequest
+	if err := json.Unmarshal(p.payload, &req); err != nil {
+		return "", err
+	}
+	self.lastMethod = req.Method
+	self.lastBody = req.Body
+	return req.Method, nil
+}
+
+func (self *TransferConn) ReadBody(obj interface{}) error {
+	if obj == nil || self.lastBody == nil {
+		return nil
+	}
+	err := json.Unmarshal(*self.lastBody, obj)
+	if err == nil {
+		self.logMessage("->", self.lastMethod, obj)
+	}
+	return err
+}
+
+func (self *TransferConn) Error(err error) error {
+	s := toError(err).Encode()
+	self.logMessage("<-", s, nil)
+	return self.writeJSON(packetResponse, &transferResponse{s, nil})
+}
+
+func (self *TransferConn) Unacceptable() error {
+	log.Println("Unacceptable")
+	return self.Error(NewError(Unsupported, "Method not accepted"))
+}
+
+func (self *TransferConn) SendOkay() error {
+	return self.Send("OK")
+}
+
+func (self *TransferConn) Send(obj interface{}) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	body := json.RawMessage(b)
+	self.logMessage("<-", "", obj)
+	return self.writeJSON(packetResponse, &transferResponse{"", &body})
+}
+
+// Data
+
+type dataWriter struct {
+	conn *TransferConn
+	seq  uint64
+	buf  []byte
+}
+
+// Splits everything written to it into full data packets. Close sends
+// whatever is left over and then the end packet.
+func (self *TransferConn) NewDataWriter() io.WriteCloser {
+	return &dataWriter{self, 0, make([]byte, 0, PacketSize)}
+}
+
+func (self *dataWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(self.buf[len(self.buf):cap(self.buf)], p)
+		self.buf = self.buf[:len(self.buf)+n]
+		written += n
+		p = p[n:]
+		if len(self.buf) == cap(self.buf) {
+			if err := self.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (self *dataWriter) flush() error {
+	if len(self.buf) == 0 {
+		return nil
+	}
+	if err := self.conn.writePacket(packetData, self.seq, self.buf); err != nil {
+		return err
+	}
+	self.seq++
+	self.buf = self.buf[:0]
+	return nil
+}
+
+func (self *dataWriter) Close() error {
+	if err := self.flush(); err != nil {
+		return err
+	}
+	return self.conn.writePacket(packetEnd, self.seq, nil)
+}
+
+// Tells the reader the data it was waiting on isn't coming
+func (self *TransferConn) SendDataError(err error) error {
+	return self.writePacket(packetError, 0, []byte(toError(err).Encode()))
+}
+
+type DataReader struct {
+	conn    *TransferConn
+	seq     uint64
+	pending []byte
+	done    bool
+	ack     bool
+}
+
+// Reads data packets up to the end packet, making sure none went missing
+// along the way. If ack is set, each packet is acknowledged as soon as the
+// caller comes back for more, i.e. once it has dealt with the last one.
+func (self *TransferConn) NewDataReader(ack bool) *DataReader {
+	return &DataReader{conn: self, ack: ack}
+}
+
+func (self *DataReader) Read(p []byte) (int, error) {
+	for len(self.pending) == 0 {
+		if self.done {
+			return 0, io.EOF
+		}
+		if self.ack && self.seq > 0 {
+			if err := self.conn.SendAck(Ack{Seq: self.seq - 1}); err != nil {
+				return 0, err
+			}
+		}
+		packet, err := self.conn.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		if packet.seq != self.seq {
+			return 0, fmt.Errorf("Expected packet %d, got %d", self.seq, packet.seq)
+		}
+		switch packet.kind {
+		case packetData:
+			self.pending = packet.payload
+			self.seq++
+		case packetEnd:
+			self.done = true
+		case packetError:
+			return 0, DecodeError(string(packet.payload))
+		default:
+			return 0, fmt.Errorf("Unexpected packet type %d", packet.kind)
+		}
+	}
+	n := copy(p, self.pending)
+	self.pending = self.pending[n:]
+	return n, nil
+}
+
+// Returns the next data packet whole, or io.EOF and the end packet's
+// sequence number once there are no more.
+func (self *DataReader) ReadPacket() ([]byte, uint64, error) {
+	if len(self.pending) > 0 {
+		return nil, self.seq, errors.New("Packet already partly read")
+	}
+	b := make([]byte, 1)
+	n, err := self.Read(b)
+	if err != nil {
+		return nil, self.seq, err
+	}
+	payload := append(b[:n], self.pending...)
+	self.pending = nil
+	return payload, self.seq - 1, nil
+}
+
+// Number of the packet being read
+func (self *DataReader) Seq() uint64 {
+	return self.seq
+}
+
+// Reads through the end packet, which must come next, and acknowledges it.
+func (self *DataReader) Finish() error {
+	b := make([]byte, 1)
+	n, err := self.Read(b)
+	switch {
+	case n > 0:
+		return errors.New("More data than expected")
+	case err != io.EOF:
+		return err
+	case self.ack:
+		return self.conn.SendAck(Ack{Seq: self.seq})
+	default:
+		return nil
+	}
+}
+
+func (self *TransferConn) SendAck(ack Ack) error {
+	b, err := json.Marshal(&ack)
+	if err != nil {
+		return err
+	}
+	return self.writePacket(packetAck, ack.Seq, b)
+}
+
+func (self *TransferConn) ReadAck() (Ack, error) {
+	var ack Ack
+	p, err := self.readPacketOf(packetAck)
+	if err != nil {
+		return ack, err
+	}
+	err = json.Unmarshal(p.payload, &ack)
+	return ack, err
+}
+
+// Streams size bytes from r to the DataNode on the other end, after a
+// Forward call, and waits until it has acknowledged every packet.
+func (self *TransferConn) SendBlock(r io.Reader, size int64) error {
+	packets := uint64((size + PacketSize - 1) / PacketSize)
+	acks := make(chan error, 1)
+	go func() {
+		// The last ack is for the end packet
+		for seq := uint64(0); seq <= packets; seq++ {
+			ack, err := self.ReadAck()
+			if err != nil {
+				acks <- err
+				return
+			}
+			if ack.Error != "" {
+				acks <- DecodeError(ack.Error)
+				return
+			}
+			if ack.Seq != seq {
+				acks <- fmt.Errorf("Expected ack for packet %d, got %d", seq, ack.Seq)
+				return
+			}
+		}
+		acks <- nil
+	}()
+
+	w := self.NewDataWriter()
+	if _, err := io.CopyN(w, r, size); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return <-acks
+}
+
+// Reads len(p) bytes of a block from the DataNode at addr, starting offset
+// bytes in. The token can be nil if DataNodes don't check them.
+func ReadBlockRange(ctx context.Context, addr string, block BlockID, offset int64, p []byte, token *BlockToken, debug bool) error {
+	return withTransferConn(ctx, addr, debug, func(conn *TransferConn) error {
+		_, err := readBlockRange(conn, block, offset, p, token)
+		return err
+	})
+}
+
+// How big the block is on the DataNode at addr, for blobs committed before
+// the leader kept track
+func ReadBlockSize(ctx context.Context, addr string, block BlockID, token *BlockToken, debug bool) (int64, error) {
+	var size int64
+	err := withTransferConn(ctx, addr, debug, func(conn *TransferConn) error {
+		blockRange, err := readBlockRange(conn, block, 0, nil, token)
+		size = blockRange.Size
+		if err == nil && size == 0 {
+			// Blocks are never empty, so it's a DataNode that doesn't say
+			err = errors.New("DataNode didn't say how big block '" + string(block) + "' is")
+		}
+		return err
+	})
+	return size, err
+}
+
+// Reads a block from some offset through to its end on one connection, so
+// readers going through it in order don't ask for each piece separately.
+// Close lets go of the connection.
+type BlockStream struct {
+	Block BlockID
+	// Next byte read
+	Offset int64
+	end    int64
+	addr   string
+	conn   *TransferConn
+	data   *DataReader
+	debug  bool
+	failed bool
+	// Stops ctx from closing the connection
+	stop func() bool
+}
+
+func OpenBlockStream(ctx context.Context, addr string, block BlockID, offset int64, token *BlockToken, debug bool) (*BlockStream, error) {
+	var conn io.Closer
+	var err error
+	if debug {
+		conn, err = DialTransferContext(ctx, addr, debug)
+	} else {
+		conn, err = transferPool.Get(ctx, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	self := &BlockStream{Block: block, Offset: offset, addr: addr, conn: conn.(*TransferConn), debug: debug}
+	self.stop = context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	var blockRange BlockRange
+	if err := self.conn.Call("Get", &GetBlock{block, offset, -1, token}, &blockRange); err != nil {
+		self.failed = true
+		self.Close()
+		return nil, err
+	}
+	self.end = offset + blockRange.Length
+	self.data = self.conn.NewDataReader(false)
+	return self, nil
+}
+
+// Whether the next length bytes of the block at offset are what the stream
+// will read next
+func (self *BlockStream) Covers(block BlockID, offset int64, length int) bool {
+	return !self.failed && self.Block == block && self.Offset == offset && offset+int64(length) <= self.end
+}
+
+func (self *BlockStream) ReadFull(p []byte) error {
+	if self.Offset+int64(len(p)) > self.end {
+		self.failed = true
+		return fmt.Errorf("Asked for %d bytes, DataNode has %d", len(p), self.end-self.Offset)
+	}
+	n, err := io.ReadFull(self.data, p)
+	self.Offset += int64(n)
+	if err != nil {
+		self.failed = true
+	}
+	return err
+}
+
+// Whether everything has been read
+func (self *BlockStream) Done() bool {
+	return self.Offset == self.end
+}
+
+// Puts the connection back if the whole block was read, otherwise hangs up,
+// since the DataNode would still be sending the rest.
+func (self *BlockStream) Close() error {
+	if !self.stop() || self.failed || !self.Done() || self.data.Finish() != nil {
+		if self.debug {
+			return self.conn.Close()
+		}
+		transferPool.Discard(self.addr, self.conn)
+		return nil
+	}
+	if self.debug {
+		return self.conn.Close()
+	}
+	transferPool.Put(self.addr, self.conn)
+	return nil
+}
+
+// Calls f with a connection to the DataNode at addr, from the pool unless
+// debugging
+func withTransferConn(ctx context.Context, addr string, debug bool, f func(*TransferConn) error) error {
+	if debug {
+		conn, err := DialTransferContext(ctx, addr, debug)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return f(conn)
+	}
+	conn, err := transferPool.Get(ctx, addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	err = f(conn.(*TransferConn))
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		transferPool.Discard(addr, conn)
+		return err
+	}
+	transferPool.Put(addr, conn)
+	return nil
+}
+
+// DataNodes answer one call at a time on a connection, so each reader has
+// its own
+var transferPool = &Pool{
+	Dial: func(ctx context.Context, addr string) (io.Closer, error) {
+		return dialTransfer(ctx, addr, false)
+	},
+	Check: func(conn io.Closer) error {
+		var ok string
+		return conn.(*TransferConn).Call("Ping", nil, &ok)
+	},
+	MaxIdle:     4,
+	IdleTimeout: 30 * time.Second,
+	CheckAfter:  5 * time.Second,
+}
+
+func readBlockRange(conn *TransferConn, block BlockID, offset int64, p []byte, token *BlockToken) (BlockRange, error) {
+	var blockRange BlockRange
+	err := conn.Call("Get", &GetBlock{block, offset, int64(len(p)), token}, &blockRange)
+	if err != nil {
+		return blockRange, err
+	}
+	if blockRange.Length != int64(len(p)) {
+		return blockRange, fmt.Errorf("Asked for %d bytes, DataNode has %d", len(p), blockRange.Length)
+	}
+	data := conn.NewDataReader(false)
+	if _, err = io.ReadFull(data, p); err != nil {
+		return blockRange, err
+	}
+	return blockRange, data.Finish()
+}
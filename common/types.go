@@ -1,6 +1,10 @@
 // Network protocol and other communications issues.
 package common
 
+import (
+	"time"
+)
+
 type BlockID string
 type NodeID string
 
@@ -8,13 +12,188 @@ type ForwardBlock struct {
 	BlockID BlockID
 	Nodes   []string
 	Size    int64
+	// Lets the client write the block, if the leader hands out tokens
+	Token *BlockToken
 }
 
-type RegistrationMsg struct {
-	Addr   string
+// Lets whoever has it read (4) or write (2) a block, or the internal blocks
+// of a block group, until Expires. Signed by the leader with the block key
+// KeyID, which DataNodes get with their heartbeats.
+type BlockToken struct {
+	BlockID BlockID
+	Mode    uint32
+	Expires int64
+	KeyID   int64
+	MAC     []byte
+}
+
+type BlockKey struct {
+	ID      int64
+	Secret  []byte
+	Expires int64
+}
+
+// Body of CreateBlob. An empty Policy means the blob is replicated,
+// otherwise it names an ErasurePolicy. Codec names how its blocks are
+// compressed, if at all, and Encrypted gives it a data key to encrypt them
+// with. Blobs in a Zone are always encrypted, with their key wrapped by the
+// zone's. When the leader authenticates clients, the blob belongs to the
+// client and its primary group, with Mode (0640 if zero) and ACL.
+type CreateBlob struct {
+	Policy    string
+	Codec     string
+	Encrypted bool
+	Zone      string
+	Mode      uint32
+	ACL       []ACLEntry
+}
+
+// Who a client authenticated as. The first group is its primary one.
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+// POSIX-style, with rwx bits for the owner, group and everyone else in
+// Mode. Only read (4) and write (2) mean anything: reading, listing and
+// getting the data key need read, appending and deleting need write.
+type Permissions struct {
+	Owner string
+	Group string
+	Mode  uint32
+	ACL   []ACLEntry
+}
+
+// Extra rwx bits for a named User or Group
+type ACLEntry struct {
+	User  string
+	Group string
+	Mode  uint32
+}
+
+// Body of SetPermissions. Only the owner can change a blob's permissions,
+// and only the superuser its owner. An empty Owner or Group stays as it
+// was.
+type BlobPermissions struct {
+	BlobID      string
+	Permissions Permissions
+}
+
+// Blobs created in the zone have their data keys wrapped by KeyName in the
+// KMS
+type EncryptionZone struct {
+	Name    string
+	KeyName string
+}
+
+// How many blobs have data keys wrapped by a version of a key. The leader's
+// own master key has an empty KeyName.
+type KeyUse struct {
+	KeyName string
+	Version int
+	Blobs   int
+}
+
+// Gives up on a block that no DataNode would take, and asks for a new one
+// that won't be sent to any of Exclude
+type AppendExcluding struct {
+	Abandon BlockID
+	Exclude []string
+}
+
+// The content of a block the client is about to send, so the leader can
+// point it at an identical one instead. BlockID is the block it was given
+// for it.
+type DedupBlock struct {
+	BlockID BlockID
+	Hash    string
+	Size    int64
+}
+
+// Adds Size bytes to the end of a block that's Offset bytes long, on every
+// one of Nodes
+type AppendBlock struct {
+	BlockID BlockID
+	Nodes   []string
+	Offset  int64
+	Size    int64
+	Token   *BlockToken
+}
+
+// A committed blob reopened for appending. Last is where its last block is,
+// if that has room to be extended in place, and Token lets the client write
+// to it.
+type OpenedBlob struct {
+	Blocks    []BlockInfo
+	Last      []string
+	BlockSize int64
+	Codec     string
+	Encrypted bool
+	Token     *BlockToken
+}
+
+// Picks an interrupted upload back up. Blocks are the ones the client was
+// given for it before.
+type ResumeBlob struct {
+	BlobID string
 	Blocks []BlockID
 }
 
+// Asks the leader for Count more DataNodes to put a block on, after the
+// ones in Failed didn't take it. None of the nodes returned will be in
+// Failed or Exclude.
+type ReplaceNodes struct {
+	BlockID BlockID
+	Failed  []string
+	Exclude []string
+	Count   int
+}
+
+// Size of the pieces a block is checksummed in, so a ranged read only has
+// to verify the chunks it covers
+const ChunkSize = 64 * 1024
+
+type BlockInfo struct {
+	BlockID BlockID
+	// -1 if the blob was committed before sizes were recorded
+	Size int64
+	// What's actually on the DataNodes, less than Size if the blob is
+	// compressed
+	Stored int64
+}
+
+// Length of -1 reads to the end of the block
+type GetBlock struct {
+	BlockID BlockID
+	Offset  int64
+	Length  int64
+	Token   *BlockToken
+}
+
+// Where a block is, and a token to read it with if the leader hands them out
+type LocatedBlock struct {
+	Nodes []string
+	Token *BlockToken
+}
+
+// Sent in response to GetBlock, exactly Length bytes of data follow it
+type BlockRange struct {
+	Offset int64
+	Length int64
+	// The whole block, which older DataNodes leave out
+	Size int64
+}
+
+// Addr is where the DataNode listens. JoinToken has to match the leader's,
+// unless the DataNode has a certificate. Version is what it was built with,
+// so the leader can turn away ones it can't talk to.
+type RegistrationMsg struct {
+	Addr      string
+	Blocks    []BlockID
+	JoinToken string
+	Version   VersionInfo
+}
+
 type HeartbeatMsg struct {
 	NodeID     NodeID
 	SpaceUsed  int
@@ -22,8 +201,43 @@ type HeartbeatMsg struct {
 	DeadBlocks []BlockID
 }
 
+// Has a DataNode rebuild an internal block of a group that's gone missing.
+// Sources has the address of a DataNode with each of the group's other
+// internal blocks, or "" for ones that aren't available.
+type ReconstructCell struct {
+	Cell      BlockID
+	Policy    string
+	GroupSize int64
+	Sources   []string
+}
+
+// Has a DataNode with a replica of a block erasure code it into a new
+// block group, sending internal block i to Nodes[i]
+type EncodeBlock struct {
+	BlockID BlockID
+	Size    int64
+	Group   BlockID
+	Policy  string
+	Nodes   []string
+}
+
 type HeartbeatResponse struct {
 	NeedToRegister   bool
 	InvalidateBlocks []BlockID
 	ToReplicate      []ForwardBlock
+	ToReconstruct    []ReconstructCell
+	ToEncode         []EncodeBlock
+	// Keys to check block tokens with, none if the leader doesn't use them
+	BlockKeys []BlockKey
+}
+
+type ScanProgress struct {
+	PeriodStart   time.Time
+	LastFinished  time.Time
+	LastBlock     BlockID
+	BlocksScanned int
+	BlocksTotal   int
+	BytesScanned  int64
+	Pending       int
+	Corrupt       int
 }
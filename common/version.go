@@ -0,0 +1,183 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+)
+
+// Every JSON-RPC connection, to the leader or a KMS, starts with a handshake
+// so peers from builds that can't understand each other find out before
+// they misread anything. The client sends
+//
+//	magic    "DFSV"
+//	min, max uint8, the protocol versions it speaks
+//
+// and the server answers with the magic, the newest version both speak (0
+// if there isn't one) and its own min and max. DataNode ports have their
+// own handshake, see transfer.go.
+//
+// Bump ProtocolVersion whenever a message in types.go changes shape, and
+// only raise MinProtocolVersion once nothing in a cluster being upgraded
+// could still need the old one. Which builds can talk:
+//
+//	protocol  transfer  leader/client/KMS   DataNode to DataNode
+//	1         1         1                   1
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+var rpcMagic = []byte("DFSV")
+
+// Set at build time with -ldflags "-X golang-distributed-filesystem/common.Build=..."
+var Build = "dev"
+
+type VersionRange struct {
+	Min uint8
+	Max uint8
+}
+
+func (self VersionRange) String() string {
+	if self.Min == self.Max {
+		return fmt.Sprint(self.Min)
+	}
+	return fmt.Sprint(self.Min, "-", self.Max)
+}
+
+// Newest version both speak, 0 if there isn't one
+func (self VersionRange) Agree(other VersionRange) uint8 {
+	version := self.Max
+	if other.Max < version {
+		version = other.Max
+	}
+	if version < self.Min || version < other.Min {
+		return 0
+	}
+	return version
+}
+
+// What a build speaks. DataNodes send it when they register.
+type VersionInfo struct {
+	Build    string
+	Protocol VersionRange
+	Transfer VersionRange
+}
+
+func LocalVersion() VersionInfo {
+	return VersionInfo{
+		Build,
+		VersionRange{MinProtocolVersion, ProtocolVersion},
+		VersionRange{MinTransferVersion, TransferVersion},
+	}
+}
+
+func (self VersionInfo) String() string {
+	return fmt.Sprint(self.Build, " (protocol ", self.Protocol, ", transfer ", self.Transfer, ")")
+}
+
+// Peers that don't have a version of a protocol in common
+type VersionError struct {
+	Protocol string
+	Local    VersionRange
+	Remote   VersionRange
+}
+
+func (self *VersionError) Error() string {
+	return fmt.Sprint("No ", self.Protocol, " protocol version in common: this build speaks ",
+		self.Local, ", the peer ", self.Remote)
+}
+
+// Nil if the two can talk over RPC and send each other blocks
+func (self VersionInfo) Compatible(other VersionInfo) error {
+	if self.Protocol.Agree(other.Protocol) == 0 {
+		return &VersionError{"RPC", self.Protocol, other.Protocol}
+	}
+	if self.Transfer.Agree(other.Transfer) == 0 {
+		return &VersionError{"transfer", self.Transfer, other.Transfer}
+	}
+	return nil
+}
+
+// Agrees on a protocol version with the server on the other end of conn
+func ClientHandshake(conn net.Conn) (uint8, error) {
+	local := LocalVersion().Protocol
+	if _, err := conn.Write(append(append([]byte{}, rpcMagic...), local.Min, local.Max)); err != nil {
+		return 0, err
+	}
+	b := make([]byte, len(rpcMagic)+3)
+	if _, err := io.ReadFull(conn, b); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, errors.New("Connection closed during the handshake, the peer may be too old to have one")
+	} else if err != nil {
+		return 0, err
+	}
+	if string(b[:len(rpcMagic)]) != string(rpcMagic) {
+		return 0, errors.New("Not a protocol handshake")
+	}
+	version := b[len(rpcMagic)]
+	if version == 0 {
+		return 0, &VersionError{"RPC", local, VersionRange{b[len(rpcMagic)+1], b[len(rpcMagic)+2]}}
+	}
+	return version, nil
+}
+
+// Server side of ClientHandshake. Clients from before there was a handshake
+// start straight in with a JSON-RPC request, and get told why they're
+// turned away in a JSON-RPC response.
+func ServerHandshake(conn net.Conn) (uint8, error) {
+	local := LocalVersion().Protocol
+	b := make([]byte, len(rpcMagic)+2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return 0, err
+	}
+	if string(b[:len(rpcMagic)]) != string(rpcMagic) {
+		err := &VersionError{"RPC", local, VersionRange{}}
+		if b[0] == '{' {
+			reply, _ := json.Marshal(map[string]interface{}{"id": 0, "result": nil, "error": err.Error()})
+			conn.Write(append(reply, '\n'))
+		}
+		return 0, err
+	}
+	remote := VersionRange{b[len(rpcMagic)], b[len(rpcMagic)+1]}
+	version := local.Agree(remote)
+	if _, err := conn.Write(append(append([]byte{}, rpcMagic...), version, local.Min, local.Max)); err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, &VersionError{"RPC", local, remote}
+	}
+	return version, nil
+}
+
+// Connects to a leader or KMS
+func DialRPC(addr string, debug bool) (*rpc.Client, error) {
+	return DialRPCContext(context.Background(), addr, debug)
+}
+
+// Calls on the connection don't time out by themselves, see CallContext
+func DialRPCContext(ctx context.Context, addr string, debug bool) (*rpc.Client, error) {
+	conn, err := dialContext(ctx, addr, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = handshake(ctx, conn, func() error {
+		_, err := ClientHandshake(conn)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	codec := jsonrpc.NewClientCodec(conn)
+	if debug {
+		codec = LoggingClientCodec(
+			conn.RemoteAddr().String(),
+			codec)
+	}
+	return rpc.NewClientWithCodec(codec), nil
+}
@@ -0,0 +1,182 @@
+// Encryption of block contents at rest. Every encrypted blob has its own
+// data key, which the leader keeps wrapped by its master key.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// AES-256
+const KeySize = 32
+
+// Blocks are sealed a chunk at a time, each with its own random nonce and
+// tag, so a ranged read only decrypts the chunks it covers. A sealed chunk
+// is exactly ChunkSize, so it's also exactly one of the DataNodes' checksum
+// chunks.
+const (
+	nonceSize  = 12
+	Overhead   = nonceSize + 16
+	PlainChunk = ChunkSize - Overhead
+)
+
+func NewKey() []byte {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalln(err)
+	}
+	return key
+}
+
+// Reads a hex-encoded master key, making a new one if there's no file
+func LoadMasterKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := NewKey()
+		log.Println("Writing new master key to", path)
+		return key, ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != KeySize {
+		return nil, errors.New("Master key in " + path + " isn't 256 bits")
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(gcm cipher.AEAD, dst, plain, additional []byte) []byte {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatalln(err)
+	}
+	dst = append(dst, nonce...)
+	return gcm.Seal(dst, nonce, plain, additional)
+}
+
+func open(gcm cipher.AEAD, dst, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, ErrCorrupt
+	}
+	out, err := gcm.Open(dst, sealed[:nonceSize], sealed[nonceSize:], additional)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return out, nil
+}
+
+var ErrCorrupt = errors.New("Encrypted data is corrupt or the key is wrong")
+
+// Encrypts a data key with the master key
+func Wrap(master, key []byte) ([]byte, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	return seal(gcm, nil, key, nil), nil
+}
+
+func Unwrap(master, wrapped []byte) ([]byte, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	return open(gcm, nil, wrapped, nil)
+}
+
+// Reads size bytes of data and encrypts them into the block at index in its
+// blob
+func EncryptBlock(key []byte, index int, data io.Reader, size int64) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, SealedSize(size))
+	chunk := make([]byte, PlainChunk)
+	for i := int64(0); i*PlainChunk < size; i++ {
+		n := int64(PlainChunk)
+		if left := size - i*PlainChunk; left < n {
+			n = left
+		}
+		if _, err := io.ReadFull(data, chunk[:n]); err != nil {
+			return nil, err
+		}
+		out = seal(gcm, out, chunk[:n], chunkPlace(index, i))
+	}
+	return out, nil
+}
+
+// The chunk's place in the blob is authenticated, so chunks can't be
+// swapped around, within a block or between blocks. It's the block's index
+// rather than its ID, which changes when a blob is erasure coded or a block
+// is sent again.
+func chunkPlace(index int, i int64) []byte {
+	return binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64(nil, uint64(index)), uint64(i))
+}
+
+func SealedSize(plain int64) int64 {
+	chunks := (plain + PlainChunk - 1) / PlainChunk
+	return plain + chunks*Overhead
+}
+
+func PlainSize(sealed int64) int64 {
+	chunks := (sealed + ChunkSize - 1) / ChunkSize
+	return sealed - chunks*Overhead
+}
+
+// The chunks holding length bytes at offset, and where they're stored in a
+// block that's sealed bytes long
+func Span(offset, length, sealed int64) (first int64, at int64, n int64) {
+	first = offset / PlainChunk
+	last := (offset + length - 1) / PlainChunk
+	at = first * ChunkSize
+	end := (last + 1) * ChunkSize
+	if end > sealed {
+		end = sealed
+	}
+	return first, at, end - at
+}
+
+// Decrypts whole chunks read from a Span of the block at index, starting with
+// chunk first
+func DecryptChunks(key []byte, index int, first int64, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	for i := first; len(sealed) > 0; i++ {
+		n := ChunkSize
+		if len(sealed) < n {
+			n = len(sealed)
+		}
+		if out, err = open(gcm, out, sealed[:n], chunkPlace(index, i)); err != nil {
+			return nil, err
+		}
+		sealed = sealed[n:]
+	}
+	return out, nil
+}
@@ -30,6 +30,15 @@ type BlockIntents struct {
 
 // TODO:
 
+// Blocks that were on disk when we looked
+func (self *BlockIntents) Found(blocks []BlockID) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, b := range blocks {
+		self.exists[b] = true
+	}
+}
+
 func (self *BlockIntents) LockReceive(block BlockID) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -54,6 +63,41 @@ func (self *BlockIntents) AbortReceive(block BlockID) {
 	delete(self.exists, block)
 }
 
+// Appending is like receiving, but the block already exists. Waits for
+// anyone reading it, and keeps it from being deleted until it's done.
+func (self *BlockIntents) LockAppend(block BlockID) error {
+	self.lock.Lock()
+	if !self.exists[block] || self.receiving[block] || self.willDelete[block] {
+		self.lock.Unlock()
+		return errors.New("Can't lock")
+	}
+	self.receiving[block] = true
+	if self.using[block] == nil {
+		self.using[block] = &sync.WaitGroup{}
+	}
+	m := self.using[block]
+	self.lock.Unlock()
+	m.Wait()
+
+	// Nobody else can start reading while we're receiving
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.willDelete[block] {
+		self.receiving[block] = false
+		return errors.New("Can't lock")
+	}
+	m.Add(1)
+	return nil
+}
+
+func (self *BlockIntents) UnlockAppend(block BlockID) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.receiving[block] = false
+	self.using[block].Done()
+}
+
 func (self *BlockIntents) LockRead(block BlockID) error {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -0,0 +1,313 @@
+package datanode
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Walks every block on disk once per period, checking it against its
+// stored checksum without using more than its share of disk bandwidth.
+// The cursor is saved after every block, so a restarted DataNode picks up
+// where it left off instead of starting the whole pass over.
+type BlockScanner struct {
+	dn             *DataNodeState
+	bytesPerSecond int64
+	period         time.Duration
+
+	lock     sync.Mutex
+	progress ScanProgress
+	priority []BlockID
+	wake     chan bool
+	// Shared by every block, so lots of small ones are held to the rate too
+	throttle throttle
+}
+
+type scannerCursor struct {
+	PeriodStart   time.Time
+	LastBlock     BlockID
+	BlocksScanned int
+	BytesScanned  int64
+	LastFinished  time.Time
+}
+
+func NewBlockScanner(dn *DataNodeState, bytesPerSecond int64, period time.Duration) *BlockScanner {
+	self := &BlockScanner{
+		dn:             dn,
+		bytesPerSecond: bytesPerSecond,
+		period:         period,
+		wake:           make(chan bool, 1),
+		throttle:       throttle{bytesPerSecond: bytesPerSecond, start: time.Now()}}
+
+	var cursor scannerCursor
+	b, err := ioutil.ReadFile(self.cursorFilename())
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		log.Println("Reading scanner cursor:", err)
+	default:
+		if err := json.Unmarshal(b, &cursor); err != nil {
+			log.Println("Reading scanner cursor:", err)
+			cursor = scannerCursor{}
+		}
+	}
+	if cursor.PeriodStart.IsZero() {
+		cursor.PeriodStart = time.Now()
+	}
+	self.progress.PeriodStart = cursor.PeriodStart
+	self.progress.LastBlock = cursor.LastBlock
+	self.progress.BlocksScanned = cursor.BlocksScanned
+	self.progress.BytesScanned = cursor.BytesScanned
+	self.progress.LastFinished = cursor.LastFinished
+	return self
+}
+
+func (self *BlockScanner) cursorFilename() string {
+	return path.Join(self.dn.Store.DataDir, "scanner.json")
+}
+
+func (self *BlockScanner) saveCursor() {
+	self.lock.Lock()
+	cursor := scannerCursor{
+		self.progress.PeriodStart,
+		self.progress.LastBlock,
+		self.progress.BlocksScanned,
+		self.progress.BytesScanned,
+		self.progress.LastFinished}
+	self.lock.Unlock()
+
+	b, err := json.Marshal(&cursor)
+	if err != nil {
+		log.Fatalln("Encoding scanner cursor:", err)
+	}
+	// Write-and-rename so a crash never leaves half a cursor behind
+	tmp := self.cursorFilename() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		log.Println("Saving scanner cursor:", err)
+		return
+	}
+	if err := os.Rename(tmp, self.cursorFilename()); err != nil {
+		log.Println("Saving scanner cursor:", err)
+	}
+}
+
+// Scan this block ahead of the regular pass, e.g. because it just arrived
+// or because reading it failed.
+func (self *BlockScanner) Prioritize(block BlockID) {
+	self.lock.Lock()
+	for _, b := range self.priority {
+		if b == block {
+			self.lock.Unlock()
+			return
+		}
+	}
+	self.priority = append(self.priority, block)
+	self.lock.Unlock()
+
+	select {
+	case self.wake <- true:
+	default:
+	}
+}
+
+func (self *BlockScanner) Progress() ScanProgress {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	progress := self.progress
+	progress.Pending = len(self.priority)
+	return progress
+}
+
+func (self *BlockScanner) nextPriority() (BlockID, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.priority) == 0 {
+		return "", false
+	}
+	block := self.priority[0]
+	self.priority = self.priority[1:]
+	return block, true
+}
+
+// Blocks are listed once a pass, so ones that turn up part way through
+// wait for the next one, unless they're prioritized
+func (self *BlockScanner) Run() {
+	log.Println("Scanning blocks at", self.bytesPerSecond, "bytes/s, every", self.period)
+	var blocks []BlockID
+	var i int
+	listed := false
+	for self.dn.ctx.Err() == nil {
+		if block, ok := self.nextPriority(); ok {
+			self.scan(block)
+			continue
+		}
+
+		if !listed {
+			var err error
+			blocks, err = self.dn.Store.ReadBlockList()
+			if err != nil {
+				log.Fatal("Reading directory '"+self.dn.Store.BlocksDirectory()+"': ", err)
+			}
+			sort.Sort(byBlockID(blocks))
+
+			self.lock.Lock()
+			self.progress.BlocksTotal = len(blocks)
+			last := self.progress.LastBlock
+			self.lock.Unlock()
+
+			// Blocks are scanned in order, so the first one past the cursor is next
+			i = sort.Search(len(blocks), func(i int) bool { return blocks[i] > last })
+			listed = true
+		}
+		if i < len(blocks) {
+			size := self.scan(blocks[i])
+			self.lock.Lock()
+			self.progress.LastBlock = blocks[i]
+			self.progress.BlocksScanned++
+			self.progress.BytesScanned += size
+			self.lock.Unlock()
+			self.saveCursor()
+			i++
+			continue
+		}
+
+		self.lock.Lock()
+		if self.progress.LastFinished.Before(self.progress.PeriodStart) {
+			self.progress.LastFinished = time.Now()
+			log.Println("Block scan finished:", self.progress.BlocksScanned, "blocks,", self.progress.BytesScanned, "bytes")
+		}
+		nextPeriod := self.progress.PeriodStart.Add(self.period)
+		self.lock.Unlock()
+		self.saveCursor()
+
+		if wait := nextPeriod.Sub(time.Now()); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-self.wake:
+				continue
+			case <-self.dn.ctx.Done():
+				return
+			}
+		}
+
+		self.lock.Lock()
+		self.progress.PeriodStart = time.Now()
+		self.progress.LastBlock = ""
+		self.progress.BlocksScanned = 0
+		self.progress.BytesScanned = 0
+		self.lock.Unlock()
+		self.saveCursor()
+		listed = false
+	}
+}
+
+// Returns the number of bytes read
+func (self *BlockScanner) scan(block BlockID) int64 {
+	if err := self.dn.Manager.LockRead(block); err != nil {
+		// Being uploaded or deleted
+		// May or may not actually exist now/in the future
+		// Does not imply it actually exists!
+		return 0
+	}
+	defer self.dn.Manager.UnlockRead(block)
+
+	storedChecksum, err := self.dn.Store.ReadChecksum(block)
+	if err != nil {
+		log.Println("Reading checksum for", block, "->", err)
+		self.corrupt(block)
+		return 0
+	}
+	localChecksum, size, err := self.checksum(block)
+	if err != nil {
+		log.Println("Scanning block", block, "->", err)
+		self.corrupt(block)
+		return size
+	}
+	if storedChecksum != localChecksum {
+		log.Println("Checksum doesn't match block:", block)
+		log.Println(storedChecksum, localChecksum)
+		self.corrupt(block)
+	}
+	return size
+}
+
+func (self *BlockScanner) corrupt(block BlockID) {
+	self.lock.Lock()
+	self.progress.Corrupt++
+	self.lock.Unlock()
+	// Can't delete while we hold the read lock
+	go self.dn.RemoveBlock(block)
+}
+
+func (self *BlockScanner) checksum(block BlockID) (string, int64, error) {
+	file, err := self.dn.Store.OpenBlock(block)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(hash, &throttledReader{file, &self.throttle})
+	if err != nil {
+		return "", n, err
+	}
+	return fmt.Sprint(hash.Sum32()), n, nil
+}
+
+// Keeps the average rate of everything read under bytesPerSecond. Time
+// spent idle only counts for a second's worth, so a scanner that's been
+// waiting for the next pass doesn't start it with a burst.
+type throttle struct {
+	bytesPerSecond int64
+	start          time.Time
+	read           int64
+}
+
+// Sleeps as needed after n more bytes are read
+func (self *throttle) wait(n int) {
+	self.read += int64(n)
+	expected := time.Duration(float64(self.read) / float64(self.bytesPerSecond) * float64(time.Second))
+	wait := expected - time.Since(self.start)
+	if wait > 0 {
+		time.Sleep(wait)
+	} else if wait < -time.Second {
+		self.start = time.Now().Add(-time.Second)
+		self.read = 0
+	}
+}
+
+type throttledReader struct {
+	r        io.Reader
+	throttle *throttle
+}
+
+func (self *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > self.throttle.bytesPerSecond {
+		p = p[:self.throttle.bytesPerSecond]
+	}
+	n, err := self.r.Read(p)
+	self.throttle.wait(n)
+	return n, err
+}
+
+type byBlockID []BlockID
+
+func (s byBlockID) Len() int {
+	return len(s)
+}
+func (s byBlockID) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s byBlockID) Less(i, j int) bool {
+	return s[i] < s[j]
+}
@@ -1,12 +1,15 @@
 package datanode
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 
 	. "golang-distributed-filesystem/common"
 )
@@ -38,32 +41,259 @@ func (self *BlockStore) LocalChecksum(block BlockID) (string, error) {
 	return fmt.Sprint(hash.Sum32()), nil
 }
 
-func (self *BlockStore) ReadBlock(block BlockID, w io.Writer) error {
-	file, err := os.Open(self.BlockFilename(block))
+func (self *BlockStore) OpenBlock(block BlockID) (*os.File, error) {
+	return os.Open(self.BlockFilename(block))
+}
+
+var ErrChunkChecksum = errors.New("Chunk checksum doesn't match")
+
+// Streams length bytes starting at offset, verifying only the chunks that
+// the range covers.
+func (self *BlockStore) ReadRange(block BlockID, offset, length int64, w io.Writer) error {
+	if length == 0 {
+		return nil
+	}
+	sums, err := self.chunkChecksums(block)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	_, err = io.Copy(w, file)
+	file, err := os.Open(self.BlockFilename(block))
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+
+	buf := make([]byte, ChunkSize)
+	end := offset + length
+	for chunk := offset / ChunkSize; chunk*ChunkSize < end; chunk++ {
+		if chunk >= int64(len(sums)) {
+			return io.ErrUnexpectedEOF
+		}
+		n, err := file.ReadAt(buf, chunk*ChunkSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if crc32.ChecksumIEEE(buf[:n]) != sums[chunk] {
+			return ErrChunkChecksum
+		}
+		from := offset - chunk*ChunkSize
+		if from < 0 {
+			from = 0
+		}
+		to := end - chunk*ChunkSize
+		if to > int64(n) {
+			to = int64(n)
+		}
+		if from >= to {
+			return io.ErrUnexpectedEOF
+		}
+		if _, err := w.Write(buf[from:to]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (self *BlockStore) WriteBlock(block BlockID, size int64, r io.Reader) (string, error) {
+	w, err := self.CreateBlock(block)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.CopyN(w, r, size); err != nil {
+		w.file.Close()
+		return "", err
+	}
+	return w.Close()
+}
+
+// Writes a block as it arrives, keeping track of its checksums
+type BlockWriter struct {
+	store *BlockStore
+	block BlockID
+	file  *os.File
+	// CRC-32 of the whole block, and of just what's been written here
+	sum      uint32
+	received uint32
+	chunks   *chunkHasher
+	// When appending, what to go back to if it doesn't work out
+	appending bool
+	start     int64
+	oldChunks []uint32
+}
+
+func (self *BlockStore) CreateBlock(block BlockID) (*BlockWriter, error) {
 	file, err := os.Create(self.BlockFilename(block))
 	if err != nil {
+		return nil, err
+	}
+	return &BlockWriter{store: self, block: block, file: file, chunks: &chunkHasher{}}, nil
+}
+
+// Carries on writing where the block ends. The checksums pick up from the
+// stored ones, after checking the partly filled last chunk that's about to
+// be added to.
+func (self *BlockStore) AppendToBlock(block BlockID) (*BlockWriter, error) {
+	size, err := self.BlockSize(block)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := self.chunkChecksums(block)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(sums)) != (size+ChunkSize-1)/ChunkSize {
+		return nil, ErrChunkChecksum
+	}
+	stored, err := self.ReadChecksum(block)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := strconv.ParseUint(stored, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	full := size / ChunkSize
+	chunks := &chunkHasher{sums: append([]uint32{}, sums[:full]...)}
+	if partial := size - full*ChunkSize; partial > 0 {
+		if err := self.ReadRange(block, full*ChunkSize, partial, ioutil.Discard); err != nil {
+			return nil, err
+		}
+		chunks.current = sums[full]
+		chunks.filled = int(partial)
+	}
+
+	file, err := os.OpenFile(self.BlockFilename(block), os.O_WRONLY|os.O_APPEND, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockWriter{
+		store:     self,
+		block:     block,
+		file:      file,
+		sum:       uint32(sum),
+		chunks:    chunks,
+		appending: true,
+		start:     size,
+		oldChunks: sums,
+	}, nil
+}
+
+func (self *BlockWriter) Write(p []byte) (int, error) {
+	n, err := self.file.Write(p)
+	self.sum = crc32.Update(self.sum, crc32.IEEETable, p[:n])
+	self.received = crc32.Update(self.received, crc32.IEEETable, p[:n])
+	self.chunks.Write(p[:n])
+	return n, err
+}
+
+// Returns the checksum of everything written, which is what the sender can
+// confirm
+func (self *BlockWriter) Close() (string, error) {
+	if err := self.file.Close(); err != nil {
 		return "", err
 	}
+	if err := self.store.writeChunkChecksums(self.block, self.chunks.Sums()); err != nil {
+		return "", err
+	}
+	return fmt.Sprint(self.received), nil
+}
+
+// Checksum of the whole block, to store once the write is confirmed
+func (self *BlockWriter) Checksum() string {
+	return fmt.Sprint(self.sum)
+}
+
+// Undoes the write. New blocks are removed, appended ones are put back the
+// way they were.
+func (self *BlockWriter) Abort() error {
+	self.file.Close()
+	if !self.appending {
+		return self.store.DeleteBlock(self.block)
+	}
+	if err := os.Truncate(self.store.BlockFilename(self.block), self.start); err != nil {
+		return err
+	}
+	return self.store.writeChunkChecksums(self.block, self.oldChunks)
+}
+
+// Keeps a CRC-32 of every ChunkSize bytes written to it
+type chunkHasher struct {
+	sums    []uint32
+	current uint32
+	filled  int
+}
+
+func (self *chunkHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := ChunkSize - self.filled
+		if take > len(p) {
+			take = len(p)
+		}
+		self.current = crc32.Update(self.current, crc32.IEEETable, p[:take])
+		self.filled += take
+		p = p[take:]
+		if self.filled == ChunkSize {
+			self.sums = append(self.sums, self.current)
+			self.current = 0
+			self.filled = 0
+		}
+	}
+	return n, nil
+}
+
+func (self *chunkHasher) Sums() []uint32 {
+	if self.filled > 0 {
+		return append(self.sums, self.current)
+	}
+	return self.sums
+}
+
+func (self *BlockStore) writeChunkChecksums(block BlockID, sums []uint32) error {
+	b := make([]byte, 4*len(sums))
+	for i, sum := range sums {
+		binary.BigEndian.PutUint32(b[4*i:], sum)
+	}
+	return ioutil.WriteFile(self.ChunkChecksumFilename(block), b, 0777)
+}
+
+func (self *BlockStore) chunkChecksums(block BlockID) ([]uint32, error) {
+	b, err := ioutil.ReadFile(self.ChunkChecksumFilename(block))
+	if os.IsNotExist(err) {
+		return self.rebuildChunkChecksums(block)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sums := make([]uint32, len(b)/4)
+	for i := range sums {
+		sums[i] = binary.BigEndian.Uint32(b[4*i:])
+	}
+	return sums, nil
+}
+
+// Blocks stored before chunk checksums existed only have a whole-block
+// checksum. Check that once, then keep the chunk checksums around.
+func (self *BlockStore) rebuildChunkChecksums(block BlockID) ([]uint32, error) {
+	stored, err := self.ReadChecksum(block)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(self.BlockFilename(block))
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 
 	hash := crc32.NewIEEE()
-	_, err = io.CopyN(file, io.TeeReader(r, hash), size)
-	if err != nil {
-		return "", err
+	chunks := &chunkHasher{}
+	if _, err := io.Copy(io.MultiWriter(hash, chunks), file); err != nil {
+		return nil, err
 	}
-	return fmt.Sprint(hash.Sum32()), nil
+	if fmt.Sprint(hash.Sum32()) != stored {
+		return nil, ErrChunkChecksum
+	}
+	return chunks.Sums(), self.writeChunkChecksums(block, chunks.Sums())
 }
 
 func (self *BlockStore) ReadBlockList() ([]BlockID, error) {
@@ -105,11 +335,18 @@ func (self *BlockStore) ChecksumFilename(block BlockID) string {
 	return path.Join(self.MetaDirectory(), string(block)+".crc32")
 }
 
+func (self *BlockStore) ChunkChecksumFilename(block BlockID) string {
+	return path.Join(self.MetaDirectory(), string(block)+".chunks")
+}
+
 func (self *BlockStore) DeleteBlock(block BlockID) error {
 	err := os.Remove(self.BlockFilename(block))
 	if err != nil {
 		return err
 	}
+	if err := os.Remove(self.ChunkChecksumFilename(block)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	err = os.Remove(self.ChecksumFilename(block))
 	return err
 }
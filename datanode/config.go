@@ -12,4 +12,13 @@ type Config struct {
 	Listener          net.Listener
 	HeartbeatInterval time.Duration
 	LeaderAddress     string
+	// Disk bandwidth the block scanner may use, and how often it should
+	// get through every block
+	ScanBytesPerSecond int64
+	ScanPeriod         time.Duration
+	// Shared with the leader, to join a cluster without TLS certificates
+	JoinToken string
+	// Refuse to read or write blocks until the leader has sent keys to
+	// check block tokens with, instead of serving anyone until then
+	RequireBlockTokens bool
 }
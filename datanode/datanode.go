@@ -1,19 +1,16 @@
 package datanode
 
 import (
+	"context"
 	"log"
 	"net"
-	"net/rpc"
-	"net/rpc/jsonrpc"
 	"os"
 	"sync"
 	"time"
 
-	. "golang-distributed-filesystem/common"
-)
+	"golang-distributed-filesystem/auth"
 
-var (
-	Debug bool
+	. "golang-distributed-filesystem/common"
 )
 
 type DataNodeState struct {
@@ -23,12 +20,23 @@ type DataNodeState struct {
 	NodeID            NodeID
 	Store             BlockStore
 	Manager           BlockIntents
+	Scanner           *BlockScanner
 	heartbeatInterval time.Duration
 	Addr              string
 	LeaderAddress     string
 
 	blocksToDelete chan BlockID
 	deadBlocks     []BlockID
+	// From the leader, for checking block tokens
+	blockKeys auth.BlockKeys
+	joinToken string
+	debug     bool
+
+	// Done once the DataNode is closed
+	ctx      context.Context
+	cancel   func()
+	listener net.Listener
+	loops    sync.WaitGroup
 }
 
 func Create(conf Config) (*DataNodeState, error) {
@@ -40,12 +48,14 @@ func Create(conf Config) (*DataNodeState, error) {
 	dn.Manager.willDelete = map[BlockID]bool{}
 	dn.Manager.exists = map[BlockID]bool{}
 
-	Debug = conf.Debug
-
+	dn.debug = conf.Debug
 	dn.Store.DataDir = conf.DataDir
 	dn.Addr = conf.Listener.Addr().String()
 	dn.heartbeatInterval = conf.HeartbeatInterval
 	dn.LeaderAddress = conf.LeaderAddress
+	dn.joinToken = conf.JoinToken
+	dn.blockKeys.Required = conf.RequireBlockTokens
+	dn.ctx, dn.cancel = context.WithCancel(context.Background())
 
 	log.Print("Block storage in directory '" + dn.Store.BlocksDirectory() + "'")
 	if err := os.MkdirAll(dn.Store.BlocksDirectory(), 0777); err != nil {
@@ -57,14 +67,59 @@ func Create(conf Config) (*DataNodeState, error) {
 		log.Fatal("Making directory:", err)
 	}
 
-	go dn.RPCServer(conf.Listener)
-	go dn.Heartbeat()
-	go dn.IntegrityChecker()
-	go dn.BlockForwarder()
+	scanBytesPerSecond := conf.ScanBytesPerSecond
+	if scanBytesPerSecond <= 0 {
+		scanBytesPerSecond = 1024 * 1024
+	}
+	scanPeriod := conf.ScanPeriod
+	if scanPeriod <= 0 {
+		scanPeriod = 3 * 7 * 24 * time.Hour
+	}
+	dn.Scanner = NewBlockScanner(&dn, scanBytesPerSecond, scanPeriod)
+	// Before the scanner starts, or it'd skip everything it can't lock
+	blocks, err := dn.Store.ReadBlockList()
+	if err != nil {
+		return nil, err
+	}
+	dn.Manager.Found(blocks)
+
+	// Clients don't need certificates to reach DataNodes
+	listener, err := SecureListener(conf.Listener, false)
+	if err != nil {
+		return nil, err
+	}
+	dn.listener = listener
+	go dn.RPCServer(listener)
+	for _, loop := range []func(){dn.Heartbeat, dn.Scanner.Run, dn.BlockForwarder} {
+		dn.loops.Add(1)
+		go func(loop func()) {
+			defer dn.loops.Done()
+			loop()
+		}(loop)
+	}
 
 	return &dn, nil
 }
 
+// Stops taking connections, heartbeating, scanning and forwarding blocks,
+// and waits until none of those are touching the data directory. Calls
+// already going on are left to finish.
+func (self *DataNodeState) Close() error {
+	self.cancel()
+	err := self.listener.Close()
+	self.loops.Wait()
+	return err
+}
+
+// How long tokens DataNodes make for each other last
+const peerTokenLifetime = 10 * time.Minute
+
+// For sending blocks to or getting them from other DataNodes, nil if the
+// leader doesn't use tokens
+func (self *DataNodeState) blockToken(block BlockID, mode uint32) *BlockToken {
+	return self.blockKeys.Sign(block, mode, peerTokenLifetime)
+}
+
 func (self *DataNodeState) HaveBlocks(blockIDs []BlockID) {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
@@ -103,90 +158,70 @@ func (self *DataNodeState) DrainDeadBlocks() []BlockID {
 	return deadBlocks
 }
 
+// A heartbeat that takes longer than the interval is given up on, rather
+// than holding up the next one
 func (self *DataNodeState) Heartbeat() {
-	for {
-		tick(self)
-		time.Sleep(self.heartbeatInterval)
+	for self.ctx.Err() == nil {
+		if len(self.NodeID) == 0 && !self.register() {
+			return
+		}
+		ctx, cancel := context.WithTimeout(self.ctx, self.heartbeatInterval)
+		tick(ctx, self)
+		cancel()
+		select {
+		case <-time.After(self.heartbeatInterval):
+		case <-self.ctx.Done():
+		}
 	}
 }
 
+// Blocks are forwarded one at a time, and each has the write timeout to
+// make progress before the next is tried
 func (self *DataNodeState) BlockForwarder() {
 	for {
-		f := <-self.forwardingBlocks
-		sendBlock(self, f.BlockID, f.Nodes)
-	}
-}
-
-func (self *DataNodeState) IntegrityChecker() {
-	for {
-		time.Sleep(5 * time.Second)
-		log.Println("Checking block integrity...")
-		files, err := self.Store.ReadBlockList()
-		if err != nil {
-			log.Fatal("Reading directory '"+self.Store.BlocksDirectory()+"': ", err)
-		}
-		for _, f := range files {
-			if err := self.Manager.LockRead(f); err != nil {
-				// Being uploaded or deleted
-				// May or may not actually exist now/in the future
-				// Does not imply it actually exists!
-				continue
-			}
-			storedChecksum, err := self.Store.ReadChecksum(f)
-			if err != nil {
-				go self.RemoveBlock(BlockID(f))
-			}
-			localChecksum, err := self.Store.LocalChecksum(f)
-			if err != nil {
-				go self.RemoveBlock(BlockID(f))
-			}
-
-			if storedChecksum != localChecksum {
-				log.Println("Checksum doesn't match block:", f)
-				log.Println(storedChecksum, localChecksum)
-				go self.RemoveBlock(BlockID(f))
-			}
-			self.Manager.UnlockRead(f)
+		select {
+		case f := <-self.forwardingBlocks:
+			sendBlock(self.ctx, self, f.BlockID, f.Nodes)
+		case <-self.ctx.Done():
+			return
 		}
 	}
 }
 
-func tick(dn *DataNodeState) {
-	conn, err := net.Dial("tcp", dn.LeaderAddress)
+// Keeps trying until the leader takes us, backing off to a few heartbeats
+// apart so a leader that's just restarted isn't hit by every DataNode at
+// once. The first heartbeat straight after gets the block keys before
+// anyone's sent here. False if the DataNode was closed first.
+func (self *DataNodeState) register() bool {
+	log.Println("Re-reading blocklist")
+	blocks, err := self.Store.ReadBlockList()
 	if err != nil {
-		log.Println("Couldn't connect to leader at", dn.LeaderAddress)
-		dn.NodeID = ""
-		return
+		log.Fatalln("Getting blocklist:", err)
 	}
-	codec := jsonrpc.NewClientCodec(conn)
-	if Debug {
-		codec = LoggingClientCodec(
-			conn.RemoteAddr().String(),
-			codec)
+	self.Manager.Found(blocks)
+	policy := RetryPolicy{
+		Backoff:    self.heartbeatInterval,
+		MaxBackoff: 4 * self.heartbeatInterval,
+		Jitter:     0.5,
+		// A refused node may be let in once the hosts files are refreshed
+		Retryable: Always,
 	}
-	client := rpc.NewClientWithCodec(codec)
-	defer client.Close()
-
-	log.Println("Heartbeat...")
-	if len(dn.NodeID) == 0 {
-		log.Println("Re-reading blocklist")
-		blocks, err := dn.Store.ReadBlockList()
-		if err != nil {
-			log.Fatalln("Getting blocklist:", err)
-		}
-		for _, b := range blocks {
-			// Seems hacky
-			dn.Manager.exists[b] = true
-		}
-		err = client.Call("Register", &RegistrationMsg{dn.Addr, blocks}, &dn.NodeID)
+	err = policy.Do(self.ctx, self.LeaderAddress, func() error {
+		err := CallPeer(self.LeaderAddress, self.debug, "Register", &RegistrationMsg{self.Addr, blocks, self.joinToken, LocalVersion()}, &self.NodeID)
 		if err != nil {
 			log.Println("Registration error:", err)
-			return
 		}
-		log.Println("Registered with ID:", dn.NodeID)
-		return
+		return err
+	})
+	if err != nil {
+		return false
 	}
+	log.Println("Registered with ID:", self.NodeID)
+	return true
+}
 
+func tick(ctx context.Context, dn *DataNodeState) {
+	log.Println("Heartbeat...")
 	// Could be cached so we don't have to hit the filesystem
 	blocks, err := dn.Store.ReadBlockList()
 	if err != nil {
@@ -197,11 +232,19 @@ func tick(dn *DataNodeState) {
 	deadBlocks := dn.DrainDeadBlocks()
 	var resp HeartbeatResponse
 
-	err = client.Call("Heartbeat",
-		HeartbeatMsg{dn.NodeID, spaceUsed, newBlocks, deadBlocks},
-		&resp)
+	// A blip shouldn't cost a whole re-registration
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: dn.heartbeatInterval / 10, Jitter: 0.5}
+	err = policy.Do(ctx, dn.LeaderAddress, func() error {
+		return CallPeerContext(ctx, dn.LeaderAddress, dn.debug, "Heartbeat",
+			HeartbeatMsg{dn.NodeID, spaceUsed, newBlocks, deadBlocks},
+			&resp)
+	})
 	if err != nil {
 		log.Println("Heartbeat error:", err)
+		if _, remote := AsError(err); !remote {
+			// Couldn't reach the leader, which may not remember us when we do
+			dn.NodeID = ""
+		}
 		dn.HaveBlocks(newBlocks)
 		dn.DontHaveBlocks(deadBlocks)
 		return
@@ -213,13 +256,24 @@ func tick(dn *DataNodeState) {
 		dn.DontHaveBlocks(deadBlocks)
 		return
 	}
+	dn.blockKeys.Set(resp.BlockKeys)
 	for _, blockID := range resp.InvalidateBlocks {
 		dn.RemoveBlock(blockID)
 	}
+	for _, task := range resp.ToReconstruct {
+		go dn.Reconstruct(task)
+	}
+	for _, task := range resp.ToEncode {
+		go dn.Encode(task)
+	}
 	go func() {
 		for _, fwd := range resp.ToReplicate {
 			log.Println("Will replicate '"+string(fwd.BlockID)+"' to", fwd.Nodes)
-			dn.forwardingBlocks <- fwd
+			select {
+			case dn.forwardingBlocks <- fwd:
+			case <-dn.ctx.Done():
+				return
+			}
 		}
 	}()
 }
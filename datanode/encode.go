@@ -0,0 +1,58 @@
+package datanode
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"golang-distributed-filesystem/auth"
+	"golang-distributed-filesystem/erasure"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Erasure codes a block stored here into a new block group, for a blob the
+// leader is converting. The leader sees how it went from the DataNodes
+// that get the internal blocks.
+func (self *DataNodeState) Encode(task EncodeBlock) {
+	policy, err := ParsePolicy(task.Policy)
+	if err != nil || policy == nil || len(task.Nodes) != policy.Cells() {
+		log.Println("Bad encoding of '"+string(task.BlockID)+"':", err)
+		return
+	}
+	if err := self.Manager.LockRead(task.BlockID); err != nil {
+		log.Println("Encoding", task.BlockID, "->", err)
+		return
+	}
+	defer self.Manager.UnlockRead(task.BlockID)
+	if size, err := self.Store.BlockSize(task.BlockID); err != nil || size != task.Size {
+		log.Println("Encoding", task.BlockID, "-> block is", size, "bytes, expected", task.Size, err)
+		return
+	}
+	log.Println("Encoding '"+string(task.BlockID)+"' as", policy)
+
+	targets := map[int]string{}
+	for i, addr := range task.Nodes {
+		if policy.CellLength(task.Size, i) > 0 {
+			targets[i] = addr
+		}
+	}
+	// Read with the chunk checksums checked, so a bad replica isn't
+	// encoded
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(self.Store.ReadRange(task.BlockID, 0, task.Size, w))
+	}()
+	results, err := erasure.SendGroup(context.Background(), *policy, task.Group, self.blockToken(task.Group, auth.Write), targets, r, task.Size, self.debug)
+	r.Close()
+	if err != nil {
+		log.Println("Encoding", task.BlockID, "->", err)
+		self.Scanner.Prioritize(task.BlockID)
+		return
+	}
+	for i, err := range results {
+		if err != nil {
+			log.Println("Sending", CellID(task.Group, i), "to", targets[i], "->", err)
+		}
+	}
+}
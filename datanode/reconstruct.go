@@ -0,0 +1,108 @@
+package datanode
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"golang-distributed-filesystem/auth"
+	"golang-distributed-filesystem/erasure"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Stripes of each internal block fetched at a time while rebuilding
+const reconstructStripes = 16
+
+// Works out an internal block of a block group from the rest of the group,
+// a few stripes at a time, and stores it here.
+func (self *DataNodeState) Reconstruct(task ReconstructCell) {
+	group, index, ok := SplitCellID(task.Cell)
+	policy, err := ParsePolicy(task.Policy)
+	if !ok || err != nil || policy == nil || len(task.Sources) != policy.Cells() {
+		log.Println("Bad reconstruction of '"+string(task.Cell)+"':", err)
+		return
+	}
+	log.Println("Reconstructing '" + string(task.Cell) + "'")
+
+	self.Manager.LockReceive(task.Cell)
+	w, err := self.Store.CreateBlock(task.Cell)
+	if err != nil {
+		log.Println("Writing block:", err)
+		self.Manager.AbortReceive(task.Cell)
+		return
+	}
+	fail := func(err error) {
+		log.Println("Reconstructing", task.Cell, "->", err)
+		w.Abort()
+		self.Manager.AbortReceive(task.Cell)
+	}
+
+	stripes := policy.Stripes(task.GroupSize)
+	for s0 := int64(0); s0 < stripes; s0 += reconstructStripes {
+		s1 := s0 + reconstructStripes
+		if s1 > stripes {
+			s1 = stripes
+		}
+		cells, err := fetchStripes(context.Background(), *policy, group, index, task, s0, s1, self.blockToken(group, auth.Read), self.debug)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if err := erasure.RebuildCells(*policy, task.GroupSize, s0, s1, cells); err != nil {
+			fail(err)
+			return
+		}
+		if _, err := w.Write(cells[index]); err != nil {
+			fail(err)
+			return
+		}
+	}
+	if _, err := w.Close(); err != nil {
+		fail(err)
+		return
+	}
+	if err := self.Store.WriteChecksum(task.Cell, w.Checksum()); err != nil {
+		fail(err)
+		return
+	}
+	log.Println("Reconstructed block '" + string(task.Cell) + "'")
+	self.Manager.CommitReceive(task.Cell)
+	self.Scanner.Prioritize(task.Cell)
+	self.HaveBlocks([]BlockID{task.Cell})
+}
+
+// Reads stripes s0 up to s1 of enough of the group's other internal blocks
+// to rebuild the one at index. The ones it didn't read are left nil.
+func fetchStripes(ctx context.Context, policy ErasurePolicy, group BlockID, index int, task ReconstructCell, s0, s1 int64, token *BlockToken, debug bool) ([][]byte, error) {
+	cells := make([][]byte, policy.Cells())
+	have := 0
+	for i := 0; i < policy.Cells() && have < policy.DataCells; i++ {
+		if i == index {
+			continue
+		}
+		var length int64
+		for s := s0; s < s1; s++ {
+			length += policy.StripeCellLength(task.GroupSize, s, i)
+		}
+		if length == 0 {
+			// Nothing stored, it's all padding
+			have++
+			continue
+		}
+		if task.Sources[i] == "" {
+			continue
+		}
+		buf := make([]byte, length)
+		if err := ReadBlockRange(ctx, task.Sources[i], CellID(group, i), s0*policy.CellSize, buf, token, debug); err != nil {
+			log.Println("Reading", CellID(group, i), "from", task.Sources[i], "->", err)
+			continue
+		}
+		cells[i] = buf
+		have++
+	}
+	if have < policy.DataCells {
+		return nil, errors.New("Not enough of the group to rebuild from")
+	}
+	return cells, nil
+}
@@ -1,184 +1,387 @@
 package datanode
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
-	"net/rpc"
-	"net/rpc/jsonrpc"
 	"strings"
+	"time"
+
+	"golang-distributed-filesystem/auth"
 
 	. "golang-distributed-filesystem/common"
 )
 
-func sendBlock(dn *DataNodeState, blockID BlockID, peers []string) {
+// Copying a block to another DataNode is tried a few times before it's left
+// for the leader to ask again
+var forwardPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     500 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+	Jitter:      0.5,
+}
+
+// Gives up when ctx is done
+func sendBlock(ctx context.Context, dn *DataNodeState, blockID BlockID, peers []string) {
 	if err := dn.Manager.LockRead(blockID); err != nil {
 		log.Println("Couldn't lock", blockID)
 		return
 	}
 	defer dn.Manager.UnlockRead(blockID)
 
-	var peerConn net.Conn
+	err := forwardPolicy.Do(ctx, "", func() error {
+		return forwardOnce(ctx, dn, blockID, peers)
+	})
+	if err != nil {
+		log.Println("Couldn't forward block", blockID, "->", err)
+	}
+}
+
+// Sends the block to the first of peers that's online, which pipelines it
+// to the rest. If our own copy can't be read, the scanner gets to it first.
+func forwardOnce(ctx context.Context, dn *DataNodeState, blockID BlockID, peers []string) error {
+	var peer *TransferConn
+	var addr string
 	var forwardTo []string
-	var err error
-	// Find an online peer
-	for i, addr := range peers {
-		peerConn, err = net.Dial("tcp", addr)
+	for i, a := range peers {
+		conn, err := DialTransferContext(ctx, a, dn.debug)
 		if err == nil {
-			forwardTo = append(peers[:i], peers[i+1:]...)
+			peer, addr = conn, a
+			forwardTo = append(append([]string{}, peers[:i]...), peers[i+1:]...)
 			break
 		}
+		RecordAttempt(a, err)
 	}
-	if peerConn == nil {
-		log.Println("Couldn't forward block",
-			blockID,
-			"to any DataNodes in:",
-			strings.Join(peers, " "))
-		return
-	}
-	peerCodec := jsonrpc.NewClientCodec(peerConn)
-	if Debug {
-		peerCodec = LoggingClientCodec(
-			peerConn.RemoteAddr().String(),
-			peerCodec)
+	if peer == nil {
+		return errors.New("Couldn't reach any DataNodes in: " + strings.Join(peers, " "))
 	}
-	peer := rpc.NewClientWithCodec(peerCodec)
 	defer peer.Close()
+	fail := func(err error) error {
+		RecordAttempt(addr, err)
+		return err
+	}
 
 	size, err := dn.Store.BlockSize(blockID)
 	if err != nil {
-		log.Fatal("Stat error: ", err)
+		dn.Scanner.Prioritize(blockID)
+		return err
 	}
 
 	err = peer.Call("Forward",
-		&ForwardBlock{blockID, forwardTo, size},
+		&ForwardBlock{blockID, forwardTo, size, dn.blockToken(blockID, auth.Write)},
 		nil)
 	if err != nil {
-		log.Fatal("Forward error: ", err)
+		return fail(err)
 	}
 
-	err = dn.Store.ReadBlock(blockID, peerConn)
+	file, err := dn.Store.OpenBlock(blockID)
 	if err != nil {
-		log.Fatal("Copying error: ", err)
+		dn.Scanner.Prioritize(blockID)
+		return err
+	}
+	defer file.Close()
+	err = peer.SendBlock(file, size)
+	if err != nil {
+		dn.Scanner.Prioritize(blockID)
+		return fail(err)
 	}
 
 	hash, err := dn.Store.ReadChecksum(blockID)
 	if err != nil {
-		log.Fatalln("Reading checksum:", err)
+		dn.Scanner.Prioritize(blockID)
+		return err
 	}
-	err = peer.Call("Confirm", hash, nil)
+	var statuses []ReplicaStatus
+	err = peer.Call("Confirm", hash, &statuses)
 	if err != nil {
-		log.Fatal("Confirm error: ", err)
+		return fail(err)
+	}
+	RecordAttempt(addr, nil)
+	for _, status := range statuses {
+		if status.Error != "" {
+			log.Println("Couldn't replicate", blockID, "to", status.Addr, "->", status.Error)
+		}
 	}
+	return nil
 }
 
 func RunRPC(c net.Conn, dn *DataNodeState) {
-	server := NewRPCServer(c)
 	defer c.Close()
-
-	var method string
-	method, err := server.ReadHeader()
+	server, err := AcceptTransfer(c, dn.debug)
 	if err != nil {
-		log.Println(err)
+		PeerFailed(c.RemoteAddr(), err)
 		return
 	}
+	// Whatever a call set up downstream goes when the connection does
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Set once the caller has shown a token from the leader
+	trusted := false
+
+	for {
+		method, err := server.ReadHeader()
+		if err != nil {
+			if IsTimeout(err) {
+				log.Println(c.RemoteAddr(), "was idle too long")
+			} else if err != io.EOF {
+				PeerFailed(c.RemoteAddr(), err)
+			}
+			return
+		}
+		if !runCall(ctx, c, server, method, dn, &trusted) {
+			return
+		}
+	}
+}
+
+// Answers one call, returning false if what's left on the connection can't
+// be trusted to be the start of the next one
+func runCall(ctx context.Context, c net.Conn, server *TransferConn, method string, dn *DataNodeState, trusted *bool) bool {
 	switch method {
 	case "Forward":
 		var blockMsg ForwardBlock
 		if err := server.ReadBody(&blockMsg); err != nil {
-			log.Println(err)
-			return
+			PeerFailed(c.RemoteAddr(), err)
+			return false
 		}
 		blockID := blockMsg.BlockID
 		size := blockMsg.Size
-		forwardTo := blockMsg.Nodes
 		if size <= 0 {
-			server.Error("Size must be >0")
-			return
+			server.Error(NewError(InvalidArgument, "Size must be >0"))
+			return false
+		}
+		if err := dn.blockKeys.Verify(blockMsg.Token, blockID, auth.Write); err != nil {
+			log.Println("Refused", c.RemoteAddr(), "block '"+string(blockID)+"' ->", err)
+			server.Error(err)
+			return false
 		}
+		*trusted = true
 		dn.Manager.LockReceive(blockID)
+		// Set up the rest of the pipeline before taking any data
+		relay := OpenRelay(ctx, server, blockMsg, dn.Addr, dn.debug)
+		defer relay.Close()
 		server.SendOkay()
 
-		localChecksum, err := dn.Store.WriteBlock(
-			blockID,
-			size,
-			c)
+		w, err := dn.Store.CreateBlock(blockID)
 		if err != nil {
 			log.Println("Writing block:", err)
-			server.Error("Writing block")
-			return
+			dn.Manager.AbortReceive(blockID)
+			server.SendAck(Ack{Error: NewError(Retryable, "Writing block").Encode()})
+			return false
+		}
+		checksum, err := finishReceive(server, w, relay.Receive(size, w))
+		if err == nil {
+			err = dn.Store.WriteChecksum(blockID, w.Checksum())
 		}
-		log.Println("Received block '"+string(blockID)+"' from", c.RemoteAddr())
-
-		method, err = server.ReadHeader()
 		if err != nil {
-			log.Println(err)
+			PeerFailed(c.RemoteAddr(), fmt.Errorf("Receiving %s: %v", blockID, err))
 			dn.Manager.AbortReceive(blockID)
 			dn.Store.DeleteBlock(blockID)
-			return
+			return false
 		}
-		if method != "Confirm" {
-			server.Unacceptable()
-			dn.Manager.AbortReceive(blockID)
-			dn.Store.DeleteBlock(blockID)
-			return
+		log.Println("Received block '"+string(blockID)+"' from", c.RemoteAddr())
+		dn.Manager.CommitReceive(blockID)
+		dn.Scanner.Prioritize(blockID)
+		// Combine into Block Manager?
+		dn.HaveBlocks([]BlockID{blockID})
+		statuses := append([]ReplicaStatus{{dn.Addr, ""}}, relay.Confirm(checksum)...)
+		server.Send(&statuses)
+
+	case "Append":
+		var msg AppendBlock
+		if err := server.ReadBody(&msg); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
 		}
-		var remoteChecksum string
-		if err := server.ReadBody(&remoteChecksum); err != nil {
-			dn.Manager.AbortReceive(blockID)
-			dn.Store.DeleteBlock(blockID)
-			return
+		blockID := msg.BlockID
+		if msg.Size <= 0 {
+			server.Error(NewError(InvalidArgument, "Size must be >0"))
+			return false
 		}
-		if remoteChecksum != localChecksum {
-			dn.Manager.AbortReceive(blockID)
-			dn.Store.DeleteBlock(blockID)
-			log.Println("Checksum doesn't match for", blockID)
-			server.Error("Checksum doesn't match")
-			return
+		if err := dn.blockKeys.Verify(msg.Token, blockID, auth.Write); err != nil {
+			log.Println("Refused", c.RemoteAddr(), "block '"+string(blockID)+"' ->", err)
+			server.Error(err)
+			return false
 		}
-		if err := dn.Store.WriteChecksum(blockID, remoteChecksum); err != nil {
-			dn.Manager.AbortReceive(blockID)
-			dn.Store.DeleteBlock(blockID)
-			log.Fatalln("Couldn't write checksum:", err)
-			server.Error("Couldn't write checksum")
-			return
+		*trusted = true
+		if err := dn.Manager.LockAppend(blockID); err != nil {
+			server.Error(NewError(Conflict, "Couldn't lock block for appending"))
+			return false
+		}
+		defer dn.Manager.UnlockAppend(blockID)
+		if size, err := dn.Store.BlockSize(blockID); err != nil || size != msg.Offset {
+			server.Error(Errorf(Conflict, "Block is %d bytes, not %d", size, msg.Offset).With("size", fmt.Sprint(size)))
+			return false
 		}
+		w, err := dn.Store.AppendToBlock(blockID)
+		if err != nil {
+			log.Println("Appending to", blockID, "->", err)
+			dn.Scanner.Prioritize(blockID)
+			server.Error(NewError(Retryable, "Couldn't append to block"))
+			return false
+		}
+		relay := OpenAppendRelay(ctx, server, msg, dn.Addr, dn.debug)
+		defer relay.Close()
 		server.SendOkay()
-		dn.Manager.CommitReceive(blockID)
-		// Combine into Block Manager?
-		dn.HaveBlocks([]BlockID{blockID})
-		// Pipeline!
-		if len(forwardTo) > 0 {
-			dn.forwardingBlocks <- ForwardBlock{blockID, forwardTo, -1}
+
+		checksum, err := finishReceive(server, w, relay.Receive(msg.Size, w))
+		if err == nil {
+			err = dn.Store.WriteChecksum(blockID, w.Checksum())
+		}
+		if err != nil {
+			PeerFailed(c.RemoteAddr(), fmt.Errorf("Appending to %s: %v", blockID, err))
+			if err := w.Abort(); err != nil {
+				log.Println("Couldn't undo append to", blockID, "->", err)
+			}
+			dn.Scanner.Prioritize(blockID)
+			return false
 		}
+		log.Println("Appended", msg.Size, "bytes to block '"+string(blockID)+"' from", c.RemoteAddr())
+		dn.Scanner.Prioritize(blockID)
+		statuses := append([]ReplicaStatus{{dn.Addr, ""}}, relay.Confirm(checksum)...)
+		server.Send(&statuses)
 
 	case "Get":
-		var blockID BlockID
-		if err := server.ReadBody(&blockID); err != nil {
-			log.Println(err)
-			return
+		var msg GetBlock
+		if err := server.ReadBody(&msg); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
 		}
+		blockID := msg.BlockID
+		if err := dn.blockKeys.Verify(msg.Token, blockID, auth.Read); err != nil {
+			log.Println("Refused", c.RemoteAddr(), "block '"+string(blockID)+"' ->", err)
+			server.Error(err)
+			return false
+		}
+		*trusted = true
 		if err := dn.Manager.LockRead(blockID); err != nil {
-			server.Error("Couldn't get read lock")
-			return
+			server.Error(NewError(Retryable, "Couldn't get read lock"))
+			return false
 		}
 		defer dn.Manager.UnlockRead(blockID)
-		server.SendOkay()
-		if err := dn.Store.ReadBlock(blockID, c); err != nil {
-			log.Fatalln("Copying error: ", err)
+		size, err := dn.Store.BlockSize(blockID)
+		if err != nil {
+			log.Println("Stat error:", err)
+			server.Error(NewError(Retryable, "Couldn't read block"))
+			return false
+		}
+		if msg.Offset < 0 || msg.Offset > size {
+			server.Error(NewError(InvalidArgument, "Offset out of range").With("size", fmt.Sprint(size)))
+			return false
+		}
+		length := msg.Length
+		if length < 0 || msg.Offset+length > size {
+			length = size - msg.Offset
+		}
+		server.Send(&BlockRange{msg.Offset, length, size})
+		data := server.NewDataWriter()
+		if err := dn.Store.ReadRange(blockID, msg.Offset, length, data); err != nil {
+			log.Println("Copying error:", err)
+			// Might be the disk rather than the client
+			dn.Scanner.Prioritize(blockID)
+			server.SendDataError(NewError(Retryable, "Couldn't read block"))
+			return false
+		}
+		if err := data.Close(); err != nil {
+			log.Println(err)
+		}
+
+	case "ScanProgress":
+		if !verifyStats(c, server, dn, trusted) {
+			return false
 		}
+		progress := dn.Scanner.Progress()
+		server.Send(&progress)
+
+	case "RetryStats":
+		if !verifyStats(c, server, dn, trusted) {
+			return false
+		}
+		stats := RetryStats()
+		server.Send(&stats)
+
+	case "PeerFailures":
+		if !verifyStats(c, server, dn, trusted) {
+			return false
+		}
+		failures := PeerFailures()
+		server.Send(&failures)
+
+	case "Ping":
+		if err := server.ReadBody(nil); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		// Pooled connections are checked with it, so it's enough to have
+		// shown a token for anything before
+		if !*trusted && dn.blockKeys.Checking() {
+			log.Println("Refused", c.RemoteAddr(), "a ping before any token")
+			server.Error(auth.ErrNoBlockToken)
+			return false
+		}
+		server.SendOkay()
 
 	default:
 		server.Unacceptable()
+		return false
+	}
+	return true
+}
+
+// Finishes writing what was received, then waits for the sender to confirm
+// it with a checksum. Returns that checksum once it's been checked.
+func finishReceive(server *TransferConn, w *BlockWriter, received error) (string, error) {
+	localChecksum, err := w.Close()
+	if received != nil {
+		return "", received
+	}
+	if err != nil {
+		return "", err
+	}
+	method, err := server.ReadHeader()
+	if err != nil {
+		return "", err
+	}
+	if method != "Confirm" {
+		server.Unacceptable()
+		return "", errors.New("Expected Confirm, got " + method)
+	}
+	var remoteChecksum string
+	if err := server.ReadBody(&remoteChecksum); err != nil {
+		return "", err
+	}
+	if remoteChecksum != localChecksum {
+		err := NewError(ChecksumMismatch, "Checksum doesn't match")
+		server.Error(err)
+		return "", err
 	}
+	return remoteChecksum, nil
 }
 
 func (self *DataNodeState) RPCServer(sock net.Listener) {
 	log.Print("Accepting connections on " + sock.Addr().String())
-	for {
-		conn, err := sock.Accept()
-		if err != nil {
-			log.Fatalln(err)
-		}
-		go RunRPC(conn, self)
+	AcceptLoop(sock, func(conn net.Conn) {
+		RunRPC(conn, self)
+	})
+}
+
+// Scan progress, retries and failures come with a token from the leader
+// for auth.StatsBlock, which only admins are given. Answers the caller if
+// it doesn't have one.
+func verifyStats(c net.Conn, server *TransferConn, dn *DataNodeState, trusted *bool) bool {
+	var token *BlockToken
+	if err := server.ReadBody(&token); err != nil {
+		PeerFailed(c.RemoteAddr(), err)
+		return false
+	}
+	if err := dn.blockKeys.Verify(token, auth.StatsBlock, auth.Read); err != nil {
+		log.Println("Refused", c.RemoteAddr(), "stats ->", err)
+		server.Error(err)
+		return false
 	}
+	*trusted = true
+	return true
 }
@@ -0,0 +1,68 @@
+package download
+
+import (
+	"errors"
+
+	"golang-distributed-filesystem/codec"
+)
+
+// Fetches and decodes just the frames of a compressed block that the read
+// covers
+func (self *Reader) readCompressed(i int, offset int64, p []byte) error {
+	block := self.blocks[i]
+	if self.decoded.get(block.BlockID, offset, p) {
+		return nil
+	}
+	idx, err := self.blockIndex(i)
+	if err != nil {
+		return err
+	}
+	first, last := idx.Frames(offset, int64(len(p)))
+	at, length := idx.Span(first, last)
+	stored := make([]byte, length)
+	if err := self.readPlain(i, at, stored); err != nil {
+		return err
+	}
+	data, err := idx.Decode(self.compression, first, last, stored)
+	if err != nil {
+		return errors.New("Decoding block '" + string(block.BlockID) + "': " + err.Error())
+	}
+	start := int64(first) * codec.FrameSize
+	self.decoded.put(block.BlockID, start, data)
+	copy(p, data[offset-start:])
+	return nil
+}
+
+// Where the block's frames are, from the index at the end of it
+func (self *Reader) blockIndex(i int) (*codec.BlockIndex, error) {
+	block := self.blocks[i]
+	self.mutex.Lock()
+	idx := self.indexes[block.BlockID]
+	self.mutex.Unlock()
+	if idx != nil {
+		return idx, nil
+	}
+	trailer := make([]byte, codec.TrailerSize)
+	end := self.plainSize(block)
+	if err := self.readPlain(i, end-codec.TrailerSize, trailer); err != nil {
+		return nil, err
+	}
+	frames, size, err := codec.ParseTrailer(trailer)
+	if err != nil {
+		return nil, err
+	}
+	if size != block.Size {
+		return nil, errors.New("Block '" + string(block.BlockID) + "' isn't the size the leader says")
+	}
+	index := make([]byte, codec.IndexSize(frames))
+	if err := self.readPlain(i, end-codec.TrailerSize-codec.IndexSize(frames), index); err != nil {
+		return nil, err
+	}
+	if idx, err = codec.ParseIndex(index, size); err != nil {
+		return nil, err
+	}
+	self.mutex.Lock()
+	self.indexes[block.BlockID] = idx
+	self.mutex.Unlock()
+	return idx, nil
+}
@@ -0,0 +1,542 @@
+// Client library and command-line tool to read blobs back out of the cluster.
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"golang-distributed-filesystem/codec"
+	"golang-distributed-filesystem/erasure"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Reads a blob as if it were one file, fetching only the byte ranges that
+// are asked for from whichever DataNodes have them.
+type Reader struct {
+	leaderAddress string
+	debug         bool
+	// Every read gives up when it's done
+	ctx    context.Context
+	blocks []BlockInfo
+	// Offset of each block within the blob
+	starts []int64
+	size   int64
+	offset int64
+	// Nil if the blob is replicated, otherwise its blocks are block groups
+	policy *ErasurePolicy
+	// Last stripe that had to be rebuilt, since reads tend to carry on
+	// through it. Guarded by mutex.
+	rebuilt struct {
+		group  BlockID
+		stripe int64
+		cells  [][]byte
+	}
+	// Nil if the blob isn't compressed
+	compression codec.Codec
+	// Guarded by mutex
+	indexes map[BlockID]*codec.BlockIndex
+	// Frames last decoded, since reads are usually smaller than one
+	decoded chunkCache
+	// Nil if the blob isn't encrypted
+	key       []byte
+	decrypted chunkCache
+
+	// Reads can happen at once, so what they remember for each other is
+	// guarded
+	mutex sync.Mutex
+	// Where blocks were last time the leader was asked
+	located map[BlockID]LocatedBlock
+	// Where the last read of a replicated block left off, and the stream it
+	// left open if it carried on from the one before
+	next struct {
+		block  BlockID
+		offset int64
+	}
+	stream *BlockStream
+}
+
+// Data from the start'th byte of a block
+type chunkCache struct {
+	mutex sync.Mutex
+	block BlockID
+	start int64
+	data  []byte
+}
+
+// Fills p from offset in the block, if the cache has all of it
+func (self *chunkCache) get(block BlockID, offset int64, p []byte) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.block != block || offset < self.start || offset+int64(len(p)) > self.start+int64(len(self.data)) {
+		return false
+	}
+	copy(p, self.data[offset-self.start:])
+	return true
+}
+
+func (self *chunkCache) put(block BlockID, start int64, data []byte) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.block, self.start, self.data = block, start, data
+}
+
+func Open(leaderAddress string, blobID string, debug bool) (*Reader, error) {
+	return OpenContext(context.Background(), leaderAddress, blobID, debug)
+}
+
+// Opens the blob for reading until ctx is done
+func OpenContext(ctx context.Context, leaderAddress string, blobID string, debug bool) (*Reader, error) {
+	var blocks []BlockInfo
+	if err := CallLeaderContext(ctx, leaderAddress, debug, "GetBlobInfo", blobID, &blocks); err != nil {
+		return nil, err
+	}
+
+	self := &Reader{leaderAddress: leaderAddress, debug: debug, ctx: ctx, blocks: blocks}
+	policy, err := blobSetting(ctx, leaderAddress, "GetBlobPolicy", blobID, debug)
+	if err != nil {
+		return nil, err
+	}
+	if self.policy, err = ParsePolicy(policy); err != nil {
+		return nil, err
+	}
+	name, err := blobSetting(ctx, leaderAddress, "GetBlobCodec", blobID, debug)
+	if err != nil {
+		return nil, err
+	}
+	if self.compression, err = codec.Get(name); err != nil {
+		return nil, err
+	}
+	self.indexes = map[BlockID]*codec.BlockIndex{}
+	if self.key, err = BlobKeyContext(ctx, leaderAddress, blobID, debug); err != nil {
+		return nil, err
+	}
+	self.located = map[BlockID]LocatedBlock{}
+	for i := range blocks {
+		if blocks[i].Size < 0 {
+			// Committed before sizes were, so it's neither compressed nor
+			// encrypted, and the DataNodes know
+			size, err := self.blockSize(blocks[i].BlockID)
+			if err != nil {
+				return nil, err
+			}
+			blocks[i].Size, blocks[i].Stored = size, size
+		}
+		self.starts = append(self.starts, self.size)
+		self.size += blocks[i].Size
+	}
+	return self, nil
+}
+
+// Asks the DataNodes holding the block how big it is
+func (self *Reader) blockSize(block BlockID) (int64, error) {
+	var size int64
+	err := ReadRetryPolicy.Do(self.ctx, "", func() error {
+		located, _, err := self.locate(block)
+		if err != nil {
+			return err
+		}
+		if len(located.Nodes) == 0 {
+			return errors.New("No DataNodes have block '" + string(block) + "'")
+		}
+		for _, addr := range located.Nodes {
+			size, err = ReadBlockSize(self.ctx, addr, block, located.Token, self.debug)
+			RecordAttempt(addr, err)
+			if err == nil {
+				return nil
+			}
+		}
+		return err
+	})
+	return size, err
+}
+
+// The blob's policy or codec
+func blobSetting(ctx context.Context, leaderAddress string, method string, blobID string, debug bool) (string, error) {
+	var setting string
+	err := CallLeaderContext(ctx, leaderAddress, debug, method, blobID, &setting)
+	return setting, err
+}
+
+// The blob's data key, nil if it isn't encrypted. Only clients the leader
+// trusts with keys are given one.
+func BlobKey(leaderAddress string, blobID string, debug bool) ([]byte, error) {
+	return BlobKeyContext(context.Background(), leaderAddress, blobID, debug)
+}
+
+func BlobKeyContext(ctx context.Context, leaderAddress string, blobID string, debug bool) ([]byte, error) {
+	var key []byte
+	if err := CallLeaderContext(ctx, leaderAddress, debug, "GetBlobKey", blobID, &key); err != nil || len(key) == 0 {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Reads just the one block
+func OpenBlock(leaderAddress string, block BlockInfo, debug bool) *Reader {
+	return OpenBlockContext(context.Background(), leaderAddress, block, debug)
+}
+
+func OpenBlockContext(ctx context.Context, leaderAddress string, block BlockInfo, debug bool) *Reader {
+	return &Reader{
+		leaderAddress: leaderAddress,
+		debug:         debug,
+		ctx:           ctx,
+		blocks:        []BlockInfo{block},
+		starts:        []int64{0},
+		size:          block.Size,
+		located:       map[BlockID]LocatedBlock{},
+	}
+}
+
+func (self *Reader) Size() int64 {
+	return self.size
+}
+
+func (self *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	n := 0
+	for n < len(p) && off+int64(n) < self.size {
+		pos := off + int64(n)
+		// Last block starting at or before pos
+		i := sort.Search(len(self.starts), func(i int) bool { return self.starts[i] > pos }) - 1
+		within := pos - self.starts[i]
+		want := int64(len(p) - n)
+		if left := self.blocks[i].Size - within; want > left {
+			want = left
+		}
+		var err error
+		if self.compression != nil {
+			err = self.readCompressed(i, within, p[n:n+int(want)])
+		} else {
+			err = self.readPlain(i, within, p[n:n+int(want)])
+		}
+		if err != nil {
+			return n, err
+		}
+		n += int(want)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Hangs up on the DataNode a read was streaming from, if any
+func (self *Reader) Close() error {
+	self.mutex.Lock()
+	stream := self.stream
+	self.stream = nil
+	self.mutex.Unlock()
+	if stream != nil {
+		return stream.Close()
+	}
+	return nil
+}
+
+func (self *Reader) Read(p []byte) (int, error) {
+	if self.offset >= self.size {
+		return 0, io.EOF
+	}
+	if left := self.size - self.offset; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := self.ReadAt(p, self.offset)
+	self.offset += int64(n)
+	return n, err
+}
+
+func (self *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += self.offset
+	case 2:
+		offset += self.size
+	default:
+		return self.offset, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return self.offset, errors.New("Negative position")
+	}
+	self.offset = offset
+	return offset, nil
+}
+
+// Reads what's on the DataNodes, from the replicas or the block group
+func (self *Reader) readStored(block BlockInfo, offset int64, p []byte) error {
+	if self.policy != nil {
+		return self.readGroup(block, offset, p)
+	}
+	return self.readBlock(block.BlockID, offset, p)
+}
+
+// Blocks move around while the cluster rebalances, so reads keep asking
+// the leader where they are until one of the DataNodes lets us read. Being
+// told no, or that there's no such thing, won't change by asking again.
+var ReadRetryPolicy = RetryPolicy{
+	MaxAttempts: 10,
+	Backoff:     100 * time.Millisecond,
+	MaxBackoff:  time.Second,
+	Jitter:      0.5,
+	Retryable: func(err error) bool {
+		switch ErrorCodeOf(err) {
+		case NotFound, PermissionDenied, InvalidArgument:
+			return false
+		}
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	},
+}
+
+func (self *Reader) readBlock(block BlockID, offset int64, p []byte) error {
+	if self.readStream(block, offset, p) {
+		return nil
+	}
+	return ReadRetryPolicy.Do(self.ctx, "", func() error {
+		return self.readOnce(block, offset, p)
+	})
+}
+
+// Reads that carry on from where the last one stopped stream the rest of
+// the block instead of asking for each piece. False if the read has to be
+// done some other way.
+func (self *Reader) readStream(block BlockID, offset int64, p []byte) bool {
+	self.mutex.Lock()
+	stream := self.stream
+	self.stream = nil
+	sequential := self.next.block == block && self.next.offset == offset
+	self.next.block, self.next.offset = block, offset+int64(len(p))
+	self.mutex.Unlock()
+
+	if stream != nil && !stream.Covers(block, offset, len(p)) {
+		stream.Close()
+		stream = nil
+	}
+	if stream == nil && sequential {
+		stream = self.openStream(block, offset)
+	}
+	if stream == nil {
+		return false
+	}
+	if err := stream.ReadFull(p); err != nil {
+		if self.debug {
+			log.Println("Streaming", block, "->", err)
+		}
+		stream.Close()
+		return false
+	}
+	if stream.Done() {
+		stream.Close()
+		return true
+	}
+	self.mutex.Lock()
+	if self.stream == nil {
+		self.stream, stream = stream, nil
+	}
+	self.mutex.Unlock()
+	if stream != nil {
+		stream.Close()
+	}
+	return true
+}
+
+// Nil if none of the DataNodes would stream it
+func (self *Reader) openStream(block BlockID, offset int64) *BlockStream {
+	located, _, err := self.locate(block)
+	if err != nil {
+		return nil
+	}
+	nodes := located.Nodes
+	for _, i := range rand.Perm(len(nodes)) {
+		stream, err := OpenBlockStream(self.ctx, nodes[i], block, offset, located.Token, self.debug)
+		RecordAttempt(nodes[i], err)
+		if err == nil {
+			return stream
+		}
+		if self.debug {
+			log.Println("Streaming", block, "from", nodes[i], "->", err)
+		}
+	}
+	return nil
+}
+
+// Tries each of the DataNodes the leader says have the block, asking it
+// again if they were the ones it said last time
+func (self *Reader) readOnce(block BlockID, offset int64, p []byte) error {
+	located, cached, err := self.locate(block)
+	if err != nil {
+		return err
+	}
+	if err = self.readFrom(located, block, offset, p); err != nil && cached {
+		// It might have moved, or its token run out
+		self.mutex.Lock()
+		delete(self.located, block)
+		self.mutex.Unlock()
+		return self.readOnce(block, offset, p)
+	}
+	return err
+}
+
+func (self *Reader) readFrom(located LocatedBlock, block BlockID, offset int64, p []byte) error {
+	var err error
+	nodes := located.Nodes
+	if len(nodes) == 0 {
+		return errors.New("No DataNodes have block '" + string(block) + "'")
+	}
+	for _, i := range rand.Perm(len(nodes)) {
+		err = ReadBlockRange(self.ctx, nodes[i], block, offset, p, located.Token, self.debug)
+		RecordAttempt(nodes[i], err)
+		if err == nil {
+			return nil
+		}
+		if self.debug {
+			log.Println("Reading", block, "from", nodes[i], "->", err)
+		}
+	}
+	return err
+}
+
+// Reads straight from the internal blocks holding the data where it can.
+// Stripes with data that can't be read are rebuilt from the rest of the
+// group.
+func (self *Reader) readGroup(group BlockInfo, offset int64, p []byte) error {
+	policy := *self.policy
+	n := 0
+	for n < len(p) {
+		pos := offset + int64(n)
+		stripe := pos / policy.StripeSize()
+		i := int(pos % policy.StripeSize() / policy.CellSize)
+		at := pos % policy.CellSize
+		want := policy.CellSize - at
+		if left := int64(len(p) - n); want > left {
+			want = left
+		}
+		part := p[n : n+int(want)]
+		if cells := self.rebuiltStripe(group.BlockID, stripe); cells != nil {
+			copy(part, cells[i][at:])
+		} else if err := self.readOnce(CellID(group.BlockID, i), stripe*policy.CellSize+at, part); err != nil {
+			log.Println("Reading", CellID(group.BlockID, i), "->", err, "- rebuilding stripe", stripe)
+			cells, err := self.rebuildStripe(group, stripe)
+			if err != nil {
+				return err
+			}
+			copy(part, cells[i][at:])
+		}
+		n += int(want)
+	}
+	return nil
+}
+
+func (self *Reader) rebuildStripe(group BlockInfo, stripe int64) ([][]byte, error) {
+	var cells [][]byte
+	err := ReadRetryPolicy.Do(self.ctx, "", func() error {
+		var err error
+		cells, err = self.decodeStripe(group, stripe)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	self.mutex.Lock()
+	self.rebuilt.group = group.BlockID
+	self.rebuilt.stripe = stripe
+	self.rebuilt.cells = cells
+	self.mutex.Unlock()
+	return cells, nil
+}
+
+// Nil unless it's the stripe last rebuilt
+func (self *Reader) rebuiltStripe(group BlockID, stripe int64) [][]byte {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.rebuilt.group == group && self.rebuilt.stripe == stripe {
+		return self.rebuilt.cells
+	}
+	return nil
+}
+
+func (self *Reader) decodeStripe(group BlockInfo, stripe int64) ([][]byte, error) {
+	policy := *self.policy
+	cells := make([][]byte, policy.Cells())
+	have := 0
+	for i := 0; i < policy.Cells() && have < policy.DataCells; i++ {
+		length := policy.StripeCellLength(group.Stored, stripe, i)
+		if length == 0 {
+			have++
+			continue
+		}
+		buf := make([]byte, length)
+		if err := self.readOnce(CellID(group.BlockID, i), stripe*policy.CellSize, buf); err != nil {
+			continue
+		}
+		cells[i] = buf
+		have++
+	}
+	if have < policy.DataCells {
+		return nil, fmt.Errorf("Not enough of block group '%s' left to read stripe %d", group.BlockID, stripe)
+	}
+	if err := erasure.RebuildCells(policy, group.Stored, stripe, stripe+1, cells); err != nil {
+		return nil, err
+	}
+	return cells, nil
+}
+
+// Asks the leader unless it already has, and the token it gave is still
+// good. Cached is whether it didn't.
+func (self *Reader) locate(block BlockID) (located LocatedBlock, cached bool, err error) {
+	self.mutex.Lock()
+	located, cached = self.located[block]
+	self.mutex.Unlock()
+	if cached && (located.Token == nil || located.Token.Expires > time.Now().Unix()) {
+		return located, true, nil
+	}
+	if err = CallLeaderContext(self.ctx, self.leaderAddress, self.debug, "GetBlock", block, &located); err != nil {
+		return located, false, err
+	}
+	if len(located.Nodes) > 0 {
+		self.mutex.Lock()
+		self.located[block] = located
+		self.mutex.Unlock()
+	}
+	return located, false, nil
+}
+
+// Every committed blob the client can read
+func List(leaderAddress string, debug bool) ([]string, error) {
+	return ListContext(context.Background(), leaderAddress, debug)
+}
+
+func ListContext(ctx context.Context, leaderAddress string, debug bool) ([]string, error) {
+	var blobs []string
+	err := CallLeaderContext(ctx, leaderAddress, debug, "ListBlobs", nil, &blobs)
+	return blobs, err
+}
+
+// Writes length bytes of the blob starting at offset to w. A length of -1
+// means the rest of the blob.
+func Download(w io.Writer, blobID string, offset, length int64, debug bool, leaderAddress string) error {
+	return DownloadContext(context.Background(), w, blobID, offset, length, debug, leaderAddress)
+}
+
+// Gives up when ctx is done
+func DownloadContext(ctx context.Context, w io.Writer, blobID string, offset, length int64, debug bool, leaderAddress string) error {
+	reader, err := OpenContext(ctx, leaderAddress, blobID, debug)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if length < 0 {
+		length = reader.Size() - offset
+	}
+	_, err = io.Copy(w, io.NewSectionReader(reader, offset, length))
+	return err
+}
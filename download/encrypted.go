@@ -0,0 +1,39 @@
+package download
+
+import (
+	"golang-distributed-filesystem/crypt"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Reads block i as it was before it was encrypted
+func (self *Reader) readPlain(i int, offset int64, p []byte) error {
+	block := self.blocks[i]
+	if self.key == nil {
+		return self.readStored(block, offset, p)
+	}
+	if self.decrypted.get(block.BlockID, offset, p) {
+		return nil
+	}
+	first, at, length := crypt.Span(offset, int64(len(p)), block.Stored)
+	sealed := make([]byte, length)
+	if err := self.readStored(block, at, sealed); err != nil {
+		return err
+	}
+	data, err := crypt.DecryptChunks(self.key, i, first, sealed)
+	if err != nil {
+		return err
+	}
+	start := first * crypt.PlainChunk
+	self.decrypted.put(block.BlockID, start, data)
+	copy(p, data[offset-start:])
+	return nil
+}
+
+// How long the block was before it was encrypted
+func (self *Reader) plainSize(block BlockInfo) int64 {
+	if self.key == nil {
+		return block.Stored
+	}
+	return crypt.PlainSize(block.Stored)
+}
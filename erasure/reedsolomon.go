@@ -0,0 +1,241 @@
+// Reed-Solomon erasure coding over GF(2^8), and striping block groups with it.
+package erasure
+
+import (
+	"errors"
+)
+
+// GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1, generated by 2
+var (
+	expTable [510]byte
+	logTable [256]int
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[logTable[a]+logTable[b]]
+		}
+	}
+}
+
+func inverse(a byte) byte {
+	return expTable[255-logTable[a]]
+}
+
+func power(a byte, n int) byte {
+	switch {
+	case n == 0:
+		return 1
+	case a == 0:
+		return 0
+	default:
+		return expTable[(logTable[a]*n)%255]
+	}
+}
+
+// out ^= c * in
+func mulAdd(out, in []byte, c byte) {
+	switch c {
+	case 0:
+	case 1:
+		for i, b := range in {
+			out[i] ^= b
+		}
+	default:
+		row := &mulTable[c]
+		for i, b := range in {
+			out[i] ^= row[b]
+		}
+	}
+}
+
+func identity(n int) [][]byte {
+	m := make([][]byte, n)
+	for i := range m {
+		m[i] = make([]byte, n)
+		m[i][i] = 1
+	}
+	return m
+}
+
+func multiply(a, b [][]byte) [][]byte {
+	out := make([][]byte, len(a))
+	for r := range a {
+		out[r] = make([]byte, len(b[0]))
+		for c := range b[0] {
+			var sum byte
+			for i := range b {
+				sum ^= mulTable[a[r][i]][b[i][c]]
+			}
+			out[r][c] = sum
+		}
+	}
+	return out
+}
+
+var errSingular = errors.New("Matrix is singular")
+
+// Gauss-Jordan elimination
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range m {
+		work[i] = append([]byte{}, m[i]...)
+	}
+	inv := identity(n)
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if work[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errSingular
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := inverse(work[col][col])
+		for c := 0; c < n; c++ {
+			work[col][c] = mulTable[scale][work[col][c]]
+			inv[col][c] = mulTable[scale][inv[col][c]]
+		}
+		for r := 0; r < n; r++ {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			f := work[r][col]
+			mulAdd(work[r], work[col], f)
+			mulAdd(inv[r], inv[col], f)
+		}
+	}
+	return inv, nil
+}
+
+// A systematic code: the first DataShards rows of the encoding matrix are
+// the identity, so data shards are stored as they are. It's built from a
+// Vandermonde matrix, so any DataShards rows of it can be inverted and any
+// DataShards shards are enough to get the rest back.
+type Code struct {
+	DataShards   int
+	ParityShards int
+	matrix       [][]byte
+}
+
+var ErrTooFewShards = errors.New("Too few shards to reconstruct from")
+var ErrShardSize = errors.New("Shards aren't all the same size")
+
+func New(dataShards, parityShards int) (*Code, error) {
+	if dataShards < 1 || parityShards < 1 || dataShards+parityShards > 256 {
+		return nil, errors.New("Shard counts out of range")
+	}
+	n := dataShards + parityShards
+	vandermonde := make([][]byte, n)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, dataShards)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = power(byte(r), c)
+		}
+	}
+	top, err := invert(vandermonde[:dataShards])
+	if err != nil {
+		return nil, err
+	}
+	return &Code{dataShards, parityShards, multiply(vandermonde, top)}, nil
+}
+
+// Fills in the parity shards from the data shards
+func (self *Code) Encode(shards [][]byte) error {
+	if len(shards) != self.DataShards+self.ParityShards {
+		return ErrTooFewShards
+	}
+	size := len(shards[0])
+	for _, shard := range shards {
+		if len(shard) != size {
+			return ErrShardSize
+		}
+	}
+	for p := 0; p < self.ParityShards; p++ {
+		out := shards[self.DataShards+p]
+		for i := range out {
+			out[i] = 0
+		}
+		for c := 0; c < self.DataShards; c++ {
+			mulAdd(out, shards[c], self.matrix[self.DataShards+p][c])
+		}
+	}
+	return nil
+}
+
+// Fills in the missing shards, which are the empty ones
+func (self *Code) Reconstruct(shards [][]byte) error {
+	n := self.DataShards + self.ParityShards
+	if len(shards) != n {
+		return ErrTooFewShards
+	}
+	size := -1
+	var present []int
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return ErrShardSize
+		}
+		size = len(shard)
+		present = append(present, i)
+	}
+	if len(present) < self.DataShards {
+		return ErrTooFewShards
+	}
+	if len(present) == n {
+		return nil
+	}
+	present = present[:self.DataShards]
+
+	// The rows for the shards we have map the data to them, so the inverse
+	// maps them back to the data
+	sub := make([][]byte, self.DataShards)
+	for r, i := range present {
+		sub[r] = self.matrix[i]
+	}
+	decode, err := invert(sub)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < self.DataShards; i++ {
+		if len(shards[i]) != 0 {
+			continue
+		}
+		out := make([]byte, size)
+		for r, j := range present {
+			mulAdd(out, shards[j], decode[i][r])
+		}
+		shards[i] = out
+	}
+	for p := self.DataShards; p < n; p++ {
+		if len(shards[p]) != 0 {
+			continue
+		}
+		out := make([]byte, size)
+		for c := 0; c < self.DataShards; c++ {
+			mulAdd(out, shards[c], self.matrix[p][c])
+		}
+		shards[p] = out
+	}
+	return nil
+}
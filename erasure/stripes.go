@@ -0,0 +1,108 @@
+package erasure
+
+import (
+	"fmt"
+	"io"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Splits size bytes of data into a block group's internal blocks, writing
+// internal block i to cells[i] as it goes. Internal blocks with a nil
+// writer are skipped, and parity is only worked out if it's wanted.
+func EncodeGroup(policy ErasurePolicy, data io.Reader, size int64, cells []io.Writer) error {
+	code, err := New(policy.DataCells, policy.ParityCells)
+	if err != nil {
+		return err
+	}
+	n := policy.Cells()
+	wantParity := false
+	for i := policy.DataCells; i < n; i++ {
+		wantParity = wantParity || cells[i] != nil
+	}
+	shards := make([][]byte, n)
+	for i := range shards {
+		shards[i] = make([]byte, policy.CellSize)
+	}
+
+	for s := int64(0); s < policy.Stripes(size); s++ {
+		for i := 0; i < policy.DataCells; i++ {
+			l := policy.StripeCellLength(size, s, i)
+			if _, err := io.ReadFull(data, shards[i][:l]); err != nil {
+				return err
+			}
+			for j := l; j < policy.CellSize; j++ {
+				shards[i][j] = 0
+			}
+		}
+		if wantParity {
+			if err := code.Encode(shards); err != nil {
+				return err
+			}
+		}
+		for i, w := range cells {
+			if l := policy.StripeCellLength(size, s, i); w != nil && l > 0 {
+				if _, err := w.Write(shards[i][:l]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// cells[i] holds what internal block i has of stripes s0 up to s1, or nil
+// if it's missing. Works out the missing ones from the rest. Internal
+// blocks with nothing in those stripes are never missing.
+func RebuildCells(policy ErasurePolicy, groupSize int64, s0, s1 int64, cells [][]byte) error {
+	code, err := New(policy.DataCells, policy.ParityCells)
+	if err != nil {
+		return err
+	}
+	n := policy.Cells()
+	var missing []int
+	for i := 0; i < n; i++ {
+		var want int64
+		for s := s0; s < s1; s++ {
+			want += policy.StripeCellLength(groupSize, s, i)
+		}
+		switch {
+		case want == 0:
+			cells[i] = []byte{}
+		case cells[i] == nil:
+			missing = append(missing, i)
+		case int64(len(cells[i])) != want:
+			return fmt.Errorf("Internal block %d has %d bytes of stripes %d-%d, expected %d", i, len(cells[i]), s0, s1, want)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	rebuilt := make([][]byte, n)
+	shards := make([][]byte, n)
+	for s := s0; s < s1; s++ {
+		// Only the last stripe of a group can be short, so every one before
+		// it starts a whole cell further in
+		from := (s - s0) * policy.CellSize
+		for i := 0; i < n; i++ {
+			if cells[i] == nil {
+				shards[i] = nil
+				continue
+			}
+			shard := make([]byte, policy.CellSize)
+			copy(shard, cells[i][from:from+policy.StripeCellLength(groupSize, s, i)])
+			shards[i] = shard
+		}
+		if err := code.Reconstruct(shards); err != nil {
+			return err
+		}
+		for _, i := range missing {
+			rebuilt[i] = append(rebuilt[i], shards[i][:policy.StripeCellLength(groupSize, s, i)]...)
+		}
+	}
+	for _, i := range missing {
+		cells[i] = rebuilt[i]
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package erasure
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Encodes size bytes of data as a block group and sends the internal
+// blocks in targets all at once, each to its own DataNode. The token is for
+// the group. Returns how each one went, or an error if the data couldn't be
+// read. Sending gives up when ctx is done.
+func SendGroup(ctx context.Context, policy ErasurePolicy, group BlockID, token *BlockToken, targets map[int]string, data io.Reader, size int64, debug bool) (map[int]error, error) {
+	results := map[int]error{}
+	var resultsLock sync.Mutex
+	setResult := func(i int, err error) {
+		resultsLock.Lock()
+		defer resultsLock.Unlock()
+		results[i] = err
+	}
+
+	writers := make([]io.Writer, policy.Cells())
+	var pipes []*io.PipeWriter
+	var wg sync.WaitGroup
+	for i, addr := range targets {
+		cell := CellID(group, i)
+		length := policy.CellLength(size, i)
+		conn, err := DialTransferContext(ctx, addr, debug)
+		if err != nil {
+			setResult(i, err)
+			continue
+		}
+		if err := conn.Call("Forward", &ForwardBlock{cell, nil, length, token}, nil); err != nil {
+			conn.Close()
+			setResult(i, err)
+			continue
+		}
+		r, w := io.Pipe()
+		pipes = append(pipes, w)
+		writers[i] = &failableWriter{w: w}
+		wg.Add(1)
+		go func(i int, conn *TransferConn) {
+			defer wg.Done()
+			defer conn.Close()
+			hash := crc32.NewIEEE()
+			err := conn.SendBlock(io.TeeReader(r, hash), length)
+			if err != nil {
+				// Whatever's left for this one gets thrown away
+				r.CloseWithError(err)
+				setResult(i, err)
+				return
+			}
+			var replicas []ReplicaStatus
+			err = conn.Call("Confirm", fmt.Sprint(hash.Sum32()), &replicas)
+			if err == nil && (len(replicas) == 0 || replicas[0].Error != "") {
+				err = fmt.Errorf("Confirming %s failed: %v", cell, replicas)
+			}
+			setResult(i, err)
+		}(i, conn)
+	}
+
+	err := EncodeGroup(policy, data, size, writers)
+	for _, w := range pipes {
+		// Stops the DataNodes taking a partial block
+		w.CloseWithError(err)
+	}
+	wg.Wait()
+	return results, err
+}
+
+// One internal block failing shouldn't hold up the others
+type failableWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (self *failableWriter) Write(p []byte) (int, error) {
+	if !self.failed {
+		if _, err := self.w.Write(p); err != nil {
+			self.failed = true
+		}
+	}
+	return len(p), nil
+}
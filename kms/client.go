@@ -0,0 +1,47 @@
+package kms
+
+import (
+	"context"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Talks to a KMS, over a connection shared with everything else in the
+// process that does. Calls give up when their context is done, as well as
+// after the read timeout.
+type Client struct {
+	Address string
+}
+
+func (self *Client) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	return CallPeerContext(ctx, self.Address, false, method, args, reply)
+}
+
+func (self *Client) Create(ctx context.Context, name string) error {
+	var ok string
+	return self.call(ctx, "CreateKey", name, &ok)
+}
+
+func (self *Client) Roll(ctx context.Context, name string) (int, error) {
+	var version int
+	err := self.call(ctx, "RollKey", name, &version)
+	return version, err
+}
+
+func (self *Client) Versions(ctx context.Context, name string) ([]int, error) {
+	var versions []int
+	err := self.call(ctx, "KeyVersions", name, &versions)
+	return versions, err
+}
+
+func (self *Client) Wrap(ctx context.Context, name string, key []byte) (int, []byte, error) {
+	var wrapped WrappedKey
+	err := self.call(ctx, "Wrap", &WrapRequest{name, key}, &wrapped)
+	return wrapped.Version, wrapped.Wrapped, err
+}
+
+func (self *Client) Unwrap(ctx context.Context, name string, version int, wrapped []byte) ([]byte, error) {
+	var key []byte
+	err := self.call(ctx, "Unwrap", &UnwrapRequest{name, version, wrapped}, &key)
+	return key, err
+}
@@ -0,0 +1,152 @@
+// A small key-management service standing in for a real one. It keeps named,
+// versioned master keys in a local file and wraps and unwraps data keys with
+// them, so the master keys themselves never leave it.
+package kms
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang-distributed-filesystem/crypt"
+
+	. "golang-distributed-filesystem/common"
+)
+
+type keyVersion struct {
+	Version  int
+	Material []byte
+	Created  time.Time
+}
+
+// Every version of every key, kept on disk
+type Keyring struct {
+	Keys map[string][]keyVersion
+
+	path string
+	lock sync.Mutex
+}
+
+func OpenKeyring(path string) (*Keyring, error) {
+	self := &Keyring{Keys: map[string][]keyVersion{}, path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return self, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, self); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// Needs the lock. Written aside and renamed, so a crash never loses keys.
+func (self *Keyring) save() error {
+	data, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(self.path), ".keyring")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), self.path)
+}
+
+var ErrNoKey = NewError(NotFound, "No such key")
+
+// Makes the key if it doesn't exist yet
+func (self *Keyring) Create(name string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.Keys[name]) > 0 {
+		return nil
+	}
+	return self.roll(name)
+}
+
+// Adds a new version of the key, which data keys are wrapped with from then
+// on. Older versions are kept to unwrap what they wrapped.
+func (self *Keyring) Roll(name string) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.Keys[name]) == 0 {
+		return 0, ErrNoKey
+	}
+	if err := self.roll(name); err != nil {
+		return 0, err
+	}
+	return self.latest(name).Version, nil
+}
+
+// Needs the lock
+func (self *Keyring) roll(name string) error {
+	version := 1
+	if len(self.Keys[name]) > 0 {
+		version = self.latest(name).Version + 1
+	}
+	self.Keys[name] = append(self.Keys[name], keyVersion{version, crypt.NewKey(), time.Now()})
+	log.Println("Created version", version, "of key '"+name+"'")
+	return self.save()
+}
+
+// Needs the lock
+func (self *Keyring) latest(name string) keyVersion {
+	versions := self.Keys[name]
+	return versions[len(versions)-1]
+}
+
+func (self *Keyring) Versions(name string) ([]int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.Keys[name]) == 0 {
+		return nil, ErrNoKey
+	}
+	var versions []int
+	for _, v := range self.Keys[name] {
+		versions = append(versions, v.Version)
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// Wraps a data key with the latest version of the key
+func (self *Keyring) Wrap(name string, key []byte) (int, []byte, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.Keys[name]) == 0 {
+		return 0, nil, ErrNoKey
+	}
+	latest := self.latest(name)
+	wrapped, err := crypt.Wrap(latest.Material, key)
+	return latest.Version, wrapped, err
+}
+
+func (self *Keyring) Unwrap(name string, version int, wrapped []byte) ([]byte, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, v := range self.Keys[name] {
+		if v.Version == version {
+			return crypt.Unwrap(v.Material, wrapped)
+		}
+	}
+	return nil, ErrNoKey
+}
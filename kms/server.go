@@ -0,0 +1,129 @@
+package kms
+
+import (
+	"log"
+	"net"
+
+	. "golang-distributed-filesystem/common"
+)
+
+type WrapRequest struct {
+	Name string
+	Key  []byte
+}
+
+type WrappedKey struct {
+	Version int
+	Wrapped []byte
+}
+
+type UnwrapRequest struct {
+	Name    string
+	Version int
+	Wrapped []byte
+}
+
+// Answers the leader. Anyone who can connect can unwrap keys, so it should
+// only listen where the leader can reach it, and with TLS on only peers
+// with a certificate from the CA can connect.
+func Serve(sock net.Listener, keyring *Keyring) {
+	sock, err := SecureListener(sock, true)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Serving keys on", sock.Addr())
+	AcceptLoop(sock, func(conn net.Conn) {
+		serveConn(conn, keyring)
+	})
+}
+
+func serveConn(c net.Conn, keyring *Keyring) {
+	defer c.Close()
+	server, err := AcceptRPC(c)
+	if err != nil {
+		PeerFailed(c.RemoteAddr(), err)
+		return
+	}
+	for {
+		method, err := server.ReadHeader()
+		if err != nil {
+			return
+		}
+		switch method {
+		case "CreateKey":
+			var name string
+			if err := server.ReadBody(&name); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return
+			}
+			if err := keyring.Create(name); err != nil {
+				server.Error(err)
+				continue
+			}
+			server.SendOkay()
+
+		case "RollKey":
+			var name string
+			if err := server.ReadBody(&name); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return
+			}
+			version, err := keyring.Roll(name)
+			if err != nil {
+				server.Error(err)
+				continue
+			}
+			server.Send(&version)
+
+		case "KeyVersions":
+			var name string
+			if err := server.ReadBody(&name); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return
+			}
+			versions, err := keyring.Versions(name)
+			if err != nil {
+				server.Error(err)
+				continue
+			}
+			server.Send(&versions)
+
+		case "Wrap":
+			var msg WrapRequest
+			if err := server.ReadBody(&msg); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return
+			}
+			version, wrapped, err := keyring.Wrap(msg.Name, msg.Key)
+			if err != nil {
+				server.Error(err)
+				continue
+			}
+			server.Send(&WrappedKey{version, wrapped})
+
+		case "Unwrap":
+			var msg UnwrapRequest
+			if err := server.ReadBody(&msg); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return
+			}
+			key, err := keyring.Unwrap(msg.Name, msg.Version, msg.Wrapped)
+			if err != nil {
+				server.Error(err)
+				continue
+			}
+			server.Send(&key)
+
+		case "Ping":
+			if err := server.ReadBody(nil); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return
+			}
+			server.SendOkay()
+
+		default:
+			log.Println("Unacceptable:", method)
+			server.Unacceptable()
+		}
+	}
+}
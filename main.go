@@ -1,13 +1,22 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	"net"
+	"os"
+	"strings"
 	"time"
 
 	"golang-distributed-filesystem/utils/command"
 
+	"golang-distributed-filesystem/auth"
+	. "golang-distributed-filesystem/common"
 	"golang-distributed-filesystem/datanode"
+	"golang-distributed-filesystem/download"
+	"golang-distributed-filesystem/kms"
 	"golang-distributed-filesystem/metadatanode"
 	"golang-distributed-filesystem/upload"
 )
@@ -16,10 +25,65 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	var debug bool
+	var tlsCert, tlsKey, tlsCA, token *string
+	var dialTimeout, readTimeout, writeTimeout, idleTimeout *time.Duration
 
 	cli := command.App()
 	cli.Global(func(flag command.Flags) {
 		flag.BoolVar(&debug, "debug", false, "Show debug messages")
+		tlsCert = flag.String("tlsCert", "", "Certificate for TLS, which servers need")
+		tlsKey = flag.String("tlsKey", "", "")
+		tlsCA = flag.String("tlsCA", "", "CA to check peers' certificates against, TLS is off without one")
+		token = flag.String("token", os.Getenv("DFS_TOKEN"), "Token from the auth command to give the leader, $DFS_TOKEN by default")
+		dialTimeout = flag.Duration("dialTimeout", DefaultTimeouts.Dial, "How long connecting can take, 0 for no limit")
+		readTimeout = flag.Duration("readTimeout", DefaultTimeouts.Read, "How long to wait on a reply")
+		writeTimeout = flag.Duration("writeTimeout", DefaultTimeouts.Write, "How long to wait for a peer to take what's sent")
+		idleTimeout = flag.Duration("idleTimeout", DefaultTimeouts.Idle, "How long servers keep quiet connections open")
+	})
+	cli.Setup(func() {
+		if err := LoadTLS(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			log.Fatalln("TLS error:", err)
+		}
+		SetToken(*token)
+		SetTimeouts(Timeouts{*dialTimeout, *readTimeout, *writeTimeout, *idleTimeout})
+	})
+
+	cli.Command("auth", "Issue a token for a user, signed with the leader's secret", func(flag command.Flags) {
+		secretFile := flag.String("secretFile", "auth.secret", "The leader's -authSecret, made if it doesn't exist")
+		user := flag.String("user", "", "")
+		groups := flag.String("groups", "", "Comma-separated, the first is the user's primary group")
+		ttl := flag.Duration("ttl", 24*time.Hour, "How long the token is good for")
+		flag.Parse()
+
+		if *user == "" {
+			log.Fatalln("Tokens need a user")
+		}
+		secret, err := auth.LoadSecret(*secretFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		var groupList []string
+		if *groups != "" {
+			groupList = strings.Split(*groups, ",")
+		}
+		fmt.Println(auth.NewHMAC(secret).Issue(Identity{*user, groupList}, *ttl))
+	})
+
+	cli.Command("gencerts", "Make a test CA and a certificate signed by it", func(flag command.Flags) {
+		dir := flag.String("dir", "certs", "Where the CA is kept, made if it isn't there")
+		name := flag.String("name", "node", "Certificate is written to <name>.pem and <name>-key.pem")
+		hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "Comma-separated hostnames and IPs the certificate is for")
+		flag.Parse()
+
+		if err := GenerateCert(*dir, *name, strings.Split(*hosts, ",")); err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println("Wrote", *dir+"/"+*name+".pem", "signed by", *dir+"/ca.pem")
+	})
+
+	cli.Command("version", "Show the build and the protocol versions it speaks", func(flag command.Flags) {
+		flag.Parse()
+		fmt.Println(LocalVersion())
 	})
 
 	cli.Command("datanode", "Run storage node", func(flag command.Flags) {
@@ -27,14 +91,23 @@ func main() {
 		dataDir := flag.String("dataDir", "_data", "")
 		leaderAddress := flag.String("leaderAddress", "[::1]:5051", "")
 		heartbeatInterval := flag.Duration("heartbeatInterval", 3*time.Second, "")
+		scanBytesPerSecond := flag.Int("scanBytesPerSecond", 1024*1024, "")
+		scanPeriod := flag.Duration("scanPeriod", 3*7*24*time.Hour, "")
+		joinToken := flag.String("joinToken", "", "The leader's -joinToken, if it has one and there's no TLS certificate")
+		var requireBlockTokens bool
+		flag.BoolVar(&requireBlockTokens, "requireBlockTokens", false, "Serve no blocks until the leader sends keys for the tokens it hands out")
 		flag.Parse()
 
 		conf := datanode.Config{
-			DataDir:           *dataDir,
-			Debug:             debug,
-			Listener:          listener.Get(),
-			HeartbeatInterval: *heartbeatInterval,
-			LeaderAddress:     *leaderAddress}
+			DataDir:            *dataDir,
+			Debug:              debug,
+			Listener:           listener.Get(),
+			HeartbeatInterval:  *heartbeatInterval,
+			LeaderAddress:      *leaderAddress,
+			ScanBytesPerSecond: int64(*scanBytesPerSecond),
+			ScanPeriod:         *scanPeriod,
+			JoinToken:          *joinToken,
+			RequireBlockTokens: requireBlockTokens}
 		datanode.Create(conf)
 		// Wait on goroutines
 		<-make(chan bool)
@@ -44,25 +117,315 @@ func main() {
 		clientListener := command.ListenerFlag(flag, "clientPort", 5050, "")
 		clusterListener := command.ListenerFlag(flag, "clusterPort", 5051, "")
 		replicationFactor := flag.Int("replicationFactor", 2, "")
+		blockSize := flag.Int("blockSize", 128*1024*1024, "")
+		leaseTimeout := flag.Duration("leaseTimeout", time.Hour, "How long to keep an unfinished upload around for its client to resume")
+		convertAfter := flag.Duration("convertAfter", 0, "Erasure code replicated blobs nobody has touched for this long, 0 for never")
+		convertPolicy := flag.String("convertPolicy", "RS-6-3", "Erasure coding policy for converted blobs")
+		keyFile := flag.String("keyFile", "", "Master key for encrypted blobs, made if it doesn't exist")
+		kmsAddress := flag.String("kmsAddress", "", "KMS to keep encryption zones' keys in")
+		keyClients := flag.String("keyClients", "", "Comma-separated networks of clients that may have data keys, loopback if empty")
+		authSecret := flag.String("authSecret", "", "Secret that client tokens are signed with, anyone can do anything without one")
+		blockTokenLifetime := flag.Duration("blockTokenLifetime", time.Hour, "How long block tokens last")
+		joinToken := flag.String("joinToken", "", "Secret DataNodes without TLS certificates need to join")
+		hosts := flag.String("hosts", "", "File of hosts DataNodes may join from, any if empty")
+		hostsExclude := flag.String("hostsExclude", "", "File of hosts DataNodes may not join from")
+		var blockTokens bool
+		flag.BoolVar(&blockTokens, "blockTokens", false, "Have DataNodes insist on tokens from the leader to read or write blocks")
 		flag.Parse()
 
+		var keyNetworks []*net.IPNet
+		for _, cidr := range strings.Split(*keyClients, ",") {
+			if cidr == "" {
+				continue
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			keyNetworks = append(keyNetworks, network)
+		}
+
+		var authenticator auth.Authenticator
+		if *authSecret != "" {
+			secret, err := auth.LoadSecret(*authSecret)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			authenticator = auth.NewHMAC(secret)
+		}
+
 		log.Println("Replication factor of", *replicationFactor)
 		conf := metadatanode.Config{
 			clientListener.Get(),
 			clusterListener.Get(),
 			*replicationFactor,
-			"metadata.db"}
-		metadatanode.Create(conf)
+			"metadata.db",
+			int64(*blockSize),
+			*leaseTimeout,
+			*convertAfter,
+			*convertPolicy,
+			*keyFile,
+			*kmsAddress,
+			keyNetworks,
+			authenticator,
+			blockTokens,
+			*blockTokenLifetime,
+			*joinToken,
+			*hosts,
+			*hostsExclude}
+		if _, err := metadatanode.Create(conf); err != nil {
+			log.Fatalln(err)
+		}
 		// Wait on goroutines
 		<-make(chan bool)
 	})
 
 	cli.Command("upload", "Upload a file", func(flag command.Flags) {
-		file := command.FileFlag(flag, "file", "")
+		file := command.FileFlag(flag, "file", "File to upload, - for stdin")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "")
+		parallel := flag.Int("parallel", 1, "Blocks to upload at once")
+		policy := flag.String("policy", "", "Erasure code the blob, like RS-6-3, instead of replicating it")
+		compression := flag.String("codec", "", "Compress the blob's blocks with gzip, flate or lz")
+		zone := flag.String("zone", "", "Encryption zone to put the blob in")
+		mode := flag.String("mode", "640", "Permissions of the blob, in octal")
+		acl := flag.String("acl", "", "Extra permissions, like user:alice:rw,group:eng:r")
+		var resume, dedup, encrypt bool
+		flag.BoolVar(&resume, "resume", false, "Keep a checkpoint next to the file, and pick up from it if there's one already")
+		flag.BoolVar(&dedup, "dedup", false, "Don't send blocks the cluster already has")
+		flag.BoolVar(&encrypt, "encrypt", false, "Encrypt the blob's blocks, the leader needs a -keyFile")
+		flag.Parse()
+
+		perms, err := auth.ParseMode(*mode)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		entries, err := auth.ParseACL(*acl)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		r := file.Get()
+		var checkpoint string
+		if resume {
+			// Stdin and the like can't be read again, and have nowhere to
+			// put a checkpoint
+			if info, err := r.Stat(); err != nil {
+				log.Fatalln(err)
+			} else if !info.Mode().IsRegular() {
+				log.Fatalln("-resume only works with regular files")
+			}
+			checkpoint = r.Name() + ".upload"
+		}
+		blobID, err := upload.UploadWith(upload.Config{
+			LeaderAddress: *leaderAddress,
+			Debug:         debug,
+			Parallel:      *parallel,
+			Checkpoint:    checkpoint,
+			Dedup:         dedup,
+			Policy:        *policy,
+			Codec:         *compression,
+			Encrypt:       encrypt,
+			Zone:          *zone,
+			Mode:          perms,
+			ACL:           entries}, r)
+		if err != nil {
+			log.Fatalln("Upload error:", err)
+		}
+		fmt.Println("Blob ID:", blobID)
+	})
+
+	cli.Command("kms", "Run a local key-management service for the leader", func(flag command.Flags) {
+		listener := command.ListenerFlag(flag, "port", 5060, "")
+		keyring := flag.String("keyring", "keyring.json", "File to keep master keys in")
+		flag.Parse()
+
+		k, err := kms.OpenKeyring(*keyring)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		kms.Serve(listener.Get(), k)
+	})
+
+	cli.Command("zone", "Create an encryption zone", func(flag command.Flags) {
+		name := flag.String("name", "", "")
+		keyName := flag.String("key", "", "KMS key to wrap the zone's data keys with, made if it doesn't exist")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "")
+		flag.Parse()
+
+		conf := upload.Config{LeaderAddress: *leaderAddress, Debug: debug}
+		if err := upload.CreateZone(conf, EncryptionZone{*name, *keyName}); err != nil {
+			log.Fatalln("CreateZone error:", err)
+		}
+	})
+
+	cli.Command("rekey", "Rewrap data keys with a new version of a KMS key", func(flag command.Flags) {
+		keyName := flag.String("key", "", "")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "")
+		var audit bool
+		flag.BoolVar(&audit, "audit", false, "Just list which key versions are still in use")
+		flag.Parse()
+
+		conf := upload.Config{LeaderAddress: *leaderAddress, Debug: debug}
+		if !audit {
+			rewrapped, err := upload.Rekey(conf, *keyName)
+			if err != nil {
+				log.Fatalln("Rekey error:", err)
+			}
+			fmt.Println("Rewrapped", rewrapped, "data keys")
+		}
+		uses, err := upload.KeyAudit(conf)
+		if err != nil {
+			log.Fatalln("KeyAudit error:", err)
+		}
+		for _, use := range uses {
+			name := use.KeyName
+			if name == "" {
+				name = "(master key)"
+			}
+			fmt.Printf("%s\tversion %d\t%d blobs\n", name, use.Version, use.Blobs)
+		}
+	})
+
+	cli.Command("append", "Add to the end of a blob", func(flag command.Flags) {
+		blobID := flag.String("blob", "", "")
+		file := command.FileFlag(flag, "file", "File to append, - for stdin")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "")
+		var hflush bool
+		flag.BoolVar(&hflush, "hflush", false, "Make data visible to readers as soon as it's read, for following logs")
+		flag.Parse()
+
+		w, err := upload.OpenForAppend(upload.Config{LeaderAddress: *leaderAddress, Debug: debug}, *blobID)
+		if err != nil {
+			log.Fatalln("OpenForAppend error:", err)
+		}
+		r := file.Get()
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					log.Fatalln("Write error:", err)
+				}
+				if hflush {
+					if err := w.Hflush(); err != nil {
+						log.Fatalln("Hflush error:", err)
+					}
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatalln("Read error:", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			log.Fatalln("Commit error:", err)
+		}
+	})
+
+	cli.Command("delete", "Delete a blob", func(flag command.Flags) {
+		blobID := flag.String("blob", "", "")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "")
+		flag.Parse()
+
+		if err := upload.Delete(upload.Config{LeaderAddress: *leaderAddress, Debug: debug}, *blobID); err != nil {
+			log.Fatalln("DeleteBlob error:", err)
+		}
+	})
+
+	cli.Command("chmod", "Change who may read and write a blob", func(flag command.Flags) {
+		blobID := flag.String("blob", "", "")
+		mode := flag.String("mode", "640", "In octal")
+		owner := flag.String("owner", "", "New owner, only the superuser can give blobs away")
+		group := flag.String("group", "", "New group")
+		acl := flag.String("acl", "", "Extra permissions, like user:alice:rw,group:eng:r")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "")
+		flag.Parse()
+
+		perms := Permissions{Owner: *owner, Group: *group}
+		var err error
+		if perms.Mode, err = auth.ParseMode(*mode); err != nil {
+			log.Fatalln(err)
+		}
+		if perms.ACL, err = auth.ParseACL(*acl); err != nil {
+			log.Fatalln(err)
+		}
+		if err := upload.SetPermissions(upload.Config{LeaderAddress: *leaderAddress, Debug: debug}, *blobID, perms); err != nil {
+			log.Fatalln("SetPermissions error:", err)
+		}
+	})
+
+	cli.Command("refreshnodes", "Have the leader reread its hosts files", func(flag command.Flags) {
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "")
+		flag.Parse()
+
+		if err := upload.RefreshNodes(upload.Config{LeaderAddress: *leaderAddress, Debug: debug}); err != nil {
+			log.Fatalln("RefreshNodes error:", err)
+		}
+	})
+
+	cli.Command("retries", "Show which peers a DataNode has had to retry", func(flag command.Flags) {
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "Where to get a token for the DataNode from")
+		dataNode := flag.String("dataNode", "", "Address the DataNode takes blocks on")
+		flag.Parse()
+
+		if *dataNode == "" {
+			log.Fatalln("Which DataNode?")
+		}
+		stats, err := upload.DataNodeRetries(upload.Config{LeaderAddress: *leaderAddress, Debug: debug}, *dataNode)
+		if err != nil {
+			log.Fatalln("RetryStats error:", err)
+		}
+		for _, stat := range stats {
+			fmt.Println(stat.Target, stat.Failures, "of", stat.Attempts, "attempts failed,", stat.GaveUp, "given up on, last:", stat.LastError)
+		}
+	})
+
+	cli.Command("failures", "Show which peers the leader or a DataNode has hung up on", func(flag command.Flags) {
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "")
+		dataNode := flag.String("dataNode", "", "Ask this DataNode instead of the leader")
+		flag.Parse()
+
+		conf := upload.Config{LeaderAddress: *leaderAddress, Debug: debug}
+		var failures []PeerFailure
+		var err error
+		if *dataNode != "" {
+			failures, err = upload.DataNodePeerFailures(conf, *dataNode)
+		} else {
+			failures, err = upload.LeaderPeerFailures(conf)
+		}
+		if err != nil {
+			log.Fatalln("PeerFailures error:", err)
+		}
+		for _, failure := range failures {
+			fmt.Println(failure.Peer, failure.Failures, "failures, last at", failure.Last.Format(time.RFC3339)+":", failure.LastError)
+		}
+	})
+
+	cli.Command("list", "List the blobs you can read", func(flag command.Flags) {
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "")
+		flag.Parse()
+
+		blobs, err := download.List(*leaderAddress, debug)
+		if err != nil {
+			log.Fatalln("ListBlobs error:", err)
+		}
+		for _, blobID := range blobs {
+			fmt.Println(blobID)
+		}
+	})
+
+	cli.Command("download", "Download a blob to stdout", func(flag command.Flags) {
+		blobID := flag.String("blob", "", "")
+		offset := flag.Int("offset", 0, "")
+		length := flag.Int("length", -1, "Bytes to read, -1 for the rest of the blob")
 		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "")
 		flag.Parse()
 
-		upload.Upload(file.Get(), debug, *leaderAddress)
+		err := download.Download(os.Stdout, *blobID, int64(*offset), int64(*length), debug, *leaderAddress)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	})
 
 	cli.Run()
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
@@ -10,37 +19,31 @@ import (
 	"net/rpc"
 	"net/rpc/jsonrpc"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"golang-distributed-filesystem/auth"
 	. "golang-distributed-filesystem/common"
+	"golang-distributed-filesystem/crypt"
 	"golang-distributed-filesystem/datanode"
+	"golang-distributed-filesystem/download"
+	"golang-distributed-filesystem/kms"
 	"golang-distributed-filesystem/metadatanode"
 	"golang-distributed-filesystem/upload"
 )
 
-type ByRandom []string
-
-func (s ByRandom) Len() int {
-	return len(s)
-}
-func (s ByRandom) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
-}
-func (s ByRandom) Less(i, j int) bool {
-	return rand.Intn(2) == 0 // 0 or 1
-}
-
 // Here's a test. It uploads 18 small blobs onto 2 data nodes, then starts
 // 2 additional datanodes, then downloads the blobs.
 // TODO:
 //   - Decommission nodes
-//   - Check that files are the same
 //   - Random data
 //   - Bigger blobs / more blocks
-func TestIntegration(*testing.T) {
+func TestIntegration(t *testing.T) {
+	scratch(t, "metadata.test.db*", "_data", "_data[0-9]")
 
 	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
 	if err != nil {
@@ -64,7 +67,7 @@ func TestIntegration(*testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, _ = datanode.Create(datanode.Config{
+	startDataNode(t, datanode.Config{
 		Listener:          dnListener1,
 		LeaderAddress:     mdnClusterListener.Addr().String(),
 		DataDir:           "_data",
@@ -75,13 +78,18 @@ func TestIntegration(*testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, _ = datanode.Create(datanode.Config{
+	startDataNode(t, datanode.Config{
 		Listener:          dnListener2,
 		LeaderAddress:     mdnClusterListener.Addr().String(),
 		DataDir:           "_data2",
 		HeartbeatInterval: 1 * time.Second,
 	})
 
+	expected, err := ioutil.ReadFile("Makefile")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	wg := new(sync.WaitGroup)
 	wg2 := new(sync.WaitGroup)
 	doneBalancing := new(sync.WaitGroup)
@@ -94,63 +102,35 @@ func TestIntegration(*testing.T) {
 			if err != nil {
 				panic(err)
 			}
-			blobID := upload.Upload(file, false, mdnClientListener.Addr().String())
+			blobID, err := upload.Upload(file, false, mdnClientListener.Addr().String())
+			if err != nil {
+				log.Fatal("Upload error:", err)
+			}
 
 			wg.Done()
 			doneBalancing.Wait()
 
-			conn, err := net.Dial("tcp", mdnClientListener.Addr().String())
+			reader, err := download.Open(mdnClientListener.Addr().String(), blobID, false)
 			if err != nil {
-				log.Fatal("Dial error:", err)
+				log.Fatal("Open error:", err)
 			}
-			defer conn.Close()
-			codec := jsonrpc.NewClientCodec(conn)
-			client := rpc.NewClientWithCodec(codec)
-
-			var blocks []BlockID
-			fmt.Println(blobID)
-			if err := client.Call("GetBlob", blobID, &blocks); err != nil {
-				log.Fatal("GetBlob error:", err)
+			downloaded, err := ioutil.ReadAll(reader)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if !bytes.Equal(downloaded, expected) {
+				log.Fatalln("Downloaded blob", blobID, "doesn't match what was uploaded")
 			}
-			fmt.Println(blocks)
-
-			for _, b := range blocks {
-				for {
-					conn, err := net.Dial("tcp", mdnClientListener.Addr().String())
-					if err != nil {
-						log.Fatal("Dial error:", err)
-					}
-					defer conn.Close()
-					codec := jsonrpc.NewClientCodec(conn)
-					client := rpc.NewClientWithCodec(codec)
-
-					var nodes []string
-					if err := client.Call("GetBlock", b, &nodes); err != nil {
-						log.Fatal("GetBlock error:", err)
-					}
-					fmt.Println(nodes)
-					sort.Sort(ByRandom(nodes))
-
-					conn, err = net.Dial("tcp", nodes[0])
-					if err != nil {
-						log.Fatalln("Dial error:", err)
-					}
-					defer conn.Close()
-					codec = jsonrpc.NewClientCodec(conn)
-					client = rpc.NewClientWithCodec(codec)
-					if err := client.Call("Get", b, nil); err != nil {
-						if fmt.Sprint(err) == "Couldn't get read lock" {
-							time.Sleep(100 * time.Millisecond)
-							continue
-						}
-						log.Fatalln(err)
-					}
 
-					if _, err := io.Copy(ioutil.Discard, conn); err != nil {
-						log.Fatalln(err)
-					}
-					break
-				}
+			// Ranged reads from the middle of the blob
+			start := rand.Int63n(reader.Size())
+			end := start + rand.Int63n(reader.Size()-start+1)
+			section := make([]byte, end-start)
+			if _, err := reader.ReadAt(section, start); err != nil {
+				log.Fatalln(err)
+			}
+			if !bytes.Equal(section, expected[start:end]) {
+				log.Fatalln("Ranged read from", blobID, "doesn't match what was uploaded")
 			}
 
 			wg2.Done()
@@ -162,7 +142,7 @@ func TestIntegration(*testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, _ = datanode.Create(datanode.Config{
+	startDataNode(t, datanode.Config{
 		Listener:          dnListener3,
 		LeaderAddress:     mdnClusterListener.Addr().String(),
 		DataDir:           "_data3",
@@ -172,7 +152,7 @@ func TestIntegration(*testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, _ = datanode.Create(datanode.Config{
+	startDataNode(t, datanode.Config{
 		Listener:          dnListener4,
 		LeaderAddress:     mdnClusterListener.Addr().String(),
 		DataDir:           "_data4",
@@ -184,3 +164,2956 @@ func TestIntegration(*testing.T) {
 	}
 	wg2.Wait()
 }
+
+// Reads a blob a little at a time through a proxy counting calls to the
+// leader. Each block is only looked up once.
+func TestReadCaching(t *testing.T) {
+	scratch(t, "metadata.reads.test.db*", "_data_reads")
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "metadata.reads.test.db",
+		BlockSize:         4096,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	startDataNode(t, datanode.Config{
+		Listener:          dnListener,
+		LeaderAddress:     mdnClusterListener.Addr().String(),
+		DataDir:           "_data_reads",
+		HeartbeatInterval: 1 * time.Second,
+	})
+	time.Sleep(2 * time.Second)
+
+	expected := make([]byte, 3*4096+100)
+	rand.Read(expected)
+	blobID := mustUpload(upload.Config{LeaderAddress: mdnClientListener.Addr().String()}, bytes.NewReader(expected))
+	// Until the DataNode has told the leader about every block
+	time.Sleep(2 * time.Second)
+
+	proxy, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer proxy.Close()
+	var lock sync.Mutex
+	var sent bytes.Buffer
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			leader, err := net.Dial("tcp", mdnClientListener.Addr().String())
+			if err != nil {
+				log.Fatal(err)
+			}
+			go io.Copy(conn, leader)
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					lock.Lock()
+					sent.Write(buf[:n])
+					lock.Unlock()
+					if err != nil {
+						leader.Close()
+						return
+					}
+					leader.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	lookups := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return strings.Count(sent.String(), `"GetBlock"`)
+	}
+
+	reader, err := download.Open(proxy.Addr().String(), blobID, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer reader.Close()
+	var downloaded []byte
+	buf := make([]byte, 1000)
+	for {
+		n, err := reader.Read(buf)
+		downloaded = append(downloaded, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !bytes.Equal(downloaded, expected) {
+		log.Fatalln("Downloaded blob doesn't match what was uploaded")
+	}
+	if n := lookups(); n != 4 {
+		log.Fatalln("Looked up 4 blocks", n, "times")
+	}
+
+	// Going back, and jumping ahead part way through a block
+	for _, offset := range []int64{100, 5000, 4200, 9000} {
+		p := make([]byte, 700)
+		if _, err := reader.ReadAt(p, offset); err != nil {
+			log.Fatal(err)
+		}
+		if !bytes.Equal(p, expected[offset:offset+700]) {
+			log.Fatalln("Read at", offset, "doesn't match")
+		}
+	}
+	if n := lookups(); n != 4 {
+		log.Fatalln("Looked up 4 blocks", n, "times")
+	}
+}
+
+// Uploads random data spanning many small blocks from a file in parallel,
+// and reads it back.
+func TestMultiBlockUpload(t *testing.T) {
+	leaderAddress := multiBlockCluster(t, "multiblock")
+	expected := make([]byte, 50*1024+123)
+	rand.Read(expected)
+	file, err := ioutil.TempFile("", "multiblock")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(expected); err != nil {
+		log.Fatal(err)
+	}
+
+	blobID := mustUpload(upload.Config{LeaderAddress: leaderAddress, Parallel: 4}, file)
+	checkRanges(leaderAddress, blobID, expected)
+}
+
+// Uploads from a pipe, which can't say how big it is, written to in pieces
+// that don't line up with blocks
+func TestStreamingUpload(t *testing.T) {
+	leaderAddress := multiBlockCluster(t, "streaming")
+	expected := make([]byte, 50*1024+123)
+	rand.Read(expected)
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		for i := 0; i < len(expected); i += 1000 {
+			end := i + 1000
+			if end > len(expected) {
+				end = len(expected)
+			}
+			pipeWriter.Write(expected[i:end])
+		}
+		pipeWriter.Close()
+	}()
+	blobID := mustUpload(upload.Config{LeaderAddress: leaderAddress, Parallel: 4}, pipeReader)
+	checkRanges(leaderAddress, blobID, expected)
+}
+
+// Fails partway through
+type failingReader struct {
+	left int
+	err  error
+}
+
+func (self *failingReader) Read(p []byte) (int, error) {
+	if self.left == 0 {
+		return 0, self.err
+	}
+	if len(p) > self.left {
+		p = p[:self.left]
+	}
+	rand.Read(p)
+	self.left -= len(p)
+	return len(p), nil
+}
+
+// Uploads hand back whatever went wrong, with its code, instead of exiting
+func TestUploadErrors(t *testing.T) {
+	leaderAddress := multiBlockCluster(t, "uploaderrors")
+	conf := upload.Config{LeaderAddress: leaderAddress, Parallel: 2}
+
+	broken := errors.New("disk on fire")
+	if _, err := upload.UploadWith(conf, &failingReader{10000, broken}); err != broken {
+		log.Fatalln("Reader's error wasn't returned:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := conf
+	cancelled.Context = ctx
+	cancelling := io.MultiReader(io.LimitReader(&failingReader{10000, nil}, 10000), readerFunc(func(p []byte) (int, error) {
+		cancel()
+		return 0, io.EOF
+	}))
+	if _, err := upload.UploadWith(cancelled, cancelling); err != context.Canceled {
+		log.Fatalln("Cancelling didn't return context.Canceled:", err)
+	}
+
+	file, err := ioutil.TempFile("", "uploaderrors")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Write(make([]byte, 10000))
+	checkpoint := file.Name() + ".upload"
+	defer os.Remove(checkpoint)
+	if err := ioutil.WriteFile(checkpoint, []byte(`{"BlobID": "made-up"}`), 0644); err != nil {
+		log.Fatal(err)
+	}
+	resumed := conf
+	resumed.Checkpoint = checkpoint
+	if _, err := upload.UploadWith(resumed, file); ErrorCodeOf(err) != NotFound {
+		log.Fatalln("Resuming a blob nobody created ->", err)
+	}
+	if _, err := upload.UploadWith(resumed, bytes.NewReader(nil)); ErrorCodeOf(err) != InvalidArgument {
+		log.Fatalln("Resumed something that isn't a file ->", err)
+	}
+	if _, err := upload.UploadWith(upload.Config{LeaderAddress: leaderAddress, Policy: "RS-0-0"}, bytes.NewReader(nil)); err == nil {
+		log.Fatalln("Uploaded with a nonsense policy")
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// Picks up an upload from a client that dropped out after its first block
+func TestResumeUpload(t *testing.T) {
+	leaderAddress := multiBlockCluster(t, "resume")
+	expected := make([]byte, 50*1024+123)
+	rand.Read(expected)
+	file, err := ioutil.TempFile("", "resume")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(expected); err != nil {
+		log.Fatal(err)
+	}
+
+	// Send the first block by hand and hang up, as if the client died
+	leader, err := DialRPC(leaderAddress, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var resumed string
+	if err := leader.Call("CreateBlob", nil, &resumed); err != nil {
+		log.Fatal(err)
+	}
+	var nodesMsg ForwardBlock
+	if err := leader.Call("Append", nil, &nodesMsg); err != nil {
+		log.Fatal(err)
+	}
+	first := expected[:nodesMsg.Size]
+	dataNode, err := DialTransfer(nodesMsg.Nodes[0], false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = dataNode.Call("Forward", &ForwardBlock{nodesMsg.BlockID, nodesMsg.Nodes[1:], nodesMsg.Size, nil}, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := dataNode.SendBlock(bytes.NewReader(first), nodesMsg.Size); err != nil {
+		log.Fatal(err)
+	}
+	checksum := fmt.Sprint(crc32.ChecksumIEEE(first))
+	if err := dataNode.Call("Confirm", checksum, nil); err != nil {
+		log.Fatal(err)
+	}
+	dataNode.Close()
+	leader.Close()
+
+	// Blobs nobody created can't be resumed into being
+	if leader, err = DialRPC(leaderAddress, false); err != nil {
+		log.Fatal(err)
+	}
+	var replicated []BlockID
+	err = leader.Call("ResumeBlob", ResumeBlob{"made-up", []BlockID{"made-up:block"}}, &replicated)
+	if ErrorCodeOf(err) != NotFound {
+		log.Fatalln("Resumed a blob nobody created:", err)
+	}
+	leader.Close()
+
+	checkpoint := file.Name() + ".upload"
+	defer os.Remove(checkpoint)
+	err = ioutil.WriteFile(checkpoint, []byte(fmt.Sprintf(
+		`{"BlobID": %q, "Blocks": [{"Index": 0, "BlockID": %q, "Size": %d, "Checksum": %q}]}`,
+		resumed, nodesMsg.BlockID, nodesMsg.Size, checksum)), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Let the DataNodes tell the leader they have it
+	time.Sleep(2 * time.Second)
+	conf := upload.Config{LeaderAddress: leaderAddress, Parallel: 4, Checkpoint: checkpoint}
+	if blobID := mustUpload(conf, file); blobID != resumed {
+		log.Fatalln("Resumed upload went to", blobID, "instead of", resumed)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		log.Fatalln("Checkpoint wasn't removed after commit")
+	}
+	checkRanges(leaderAddress, resumed, expected)
+}
+
+// Adds to the end of a blob, first in place and then past the end of its
+// last block
+func TestAppend(t *testing.T) {
+	leaderAddress := multiBlockCluster(t, "append")
+	expected := make([]byte, 50*1024+123)
+	rand.Read(expected)
+	conf := upload.Config{LeaderAddress: leaderAddress}
+	blobID := mustUpload(conf, bytes.NewReader(expected))
+
+	before, err := download.Open(leaderAddress, blobID, false)
+	if err != nil {
+		log.Fatal("Open error:", err)
+	}
+	appender, err := upload.OpenForAppend(conf, blobID)
+	if err != nil {
+		log.Fatal("OpenForAppend error:", err)
+	}
+	if _, err := upload.OpenForAppend(conf, blobID); err == nil {
+		log.Fatalln("Opened a blob for appending twice")
+	}
+	appended := make([]byte, 10*1024)
+	for i := range appended {
+		appended[i] = byte(rand.Intn(256))
+	}
+	appender.Write(appended[:1000])
+	if err := appender.Hflush(); err != nil {
+		log.Fatal("Hflush error:", err)
+	}
+	flushed, err := download.Open(leaderAddress, blobID, false)
+	if err != nil {
+		log.Fatal("Open error:", err)
+	}
+	if flushed.Size() != int64(len(expected)+1000) {
+		log.Fatalln("Flushed blob is", flushed.Size(), "bytes, expected", len(expected)+1000)
+	}
+	if before.Size() != int64(len(expected)) {
+		log.Fatalln("Blob grew under a reader that opened it before the flush")
+	}
+	appender.Write(appended[1000:])
+	if err := appender.Close(); err != nil {
+		log.Fatal("Close error:", err)
+	}
+	checkRanges(leaderAddress, blobID, append(expected, appended...))
+}
+
+// Uploads the same data twice, deduplicating: the second copy should use the
+// first one's blocks, and keep them when the first is deleted
+func TestDedup(t *testing.T) {
+	leaderAddress := multiBlockCluster(t, "dedup")
+	expected := make([]byte, 50*1024+123)
+	rand.Read(expected)
+	conf := upload.Config{LeaderAddress: leaderAddress, Parallel: 4, Dedup: true}
+	firstCopy := mustUpload(conf, bytes.NewReader(expected))
+	// Let the DataNodes tell the leader they have its blocks
+	time.Sleep(2 * time.Second)
+	secondCopy := mustUpload(conf, bytes.NewReader(expected))
+	var firstBlocks, secondBlocks []BlockID
+	if err := CallLeader(leaderAddress, false, "GetBlob", firstCopy, &firstBlocks); err != nil {
+		log.Fatal(err)
+	}
+	if err := CallLeader(leaderAddress, false, "GetBlob", secondCopy, &secondBlocks); err != nil {
+		log.Fatal(err)
+	}
+	if fmt.Sprint(firstBlocks) != fmt.Sprint(secondBlocks) {
+		log.Fatalln("Deduplicated upload has its own blocks:", secondBlocks)
+	}
+	if err := upload.Delete(conf, firstCopy); err != nil {
+		log.Fatal("Delete error:", err)
+	}
+	if _, err := download.Open(leaderAddress, firstCopy, false); err == nil {
+		log.Fatalln("Deleted blob is still there")
+	}
+	// Give the DataNodes a chance to wrongly delete something
+	time.Sleep(2 * time.Second)
+	checkRanges(leaderAddress, secondCopy, expected)
+}
+
+// Blobs committed before block sizes were recorded ask the DataNodes how
+// big their blocks are
+func TestLegacyBlockSizes(t *testing.T) {
+	leaderAddress := multiBlockCluster(t, "legacy")
+	expected := make([]byte, 50*1024+123)
+	rand.Read(expected)
+	legacy := mustUpload(upload.Config{LeaderAddress: leaderAddress}, bytes.NewReader(expected))
+	db, err := sql.Open("sqlite3", "metadata.legacy.test.db")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE file_blocks SET size=NULL, stored=NULL WHERE blob=?", legacy); err != nil {
+		log.Fatal(err)
+	}
+	db.Close()
+	var legacyBlocks []BlockInfo
+	if err := CallLeader(leaderAddress, false, "GetBlobInfo", legacy, &legacyBlocks); err != nil || legacyBlocks[0].Size != -1 {
+		log.Fatalln("Legacy blob's blocks:", legacyBlocks, err)
+	}
+	checkRanges(leaderAddress, legacy, expected)
+}
+
+// Starts a leader that splits blobs into 4KB blocks and keeps two copies of
+// each, and three DataNodes, all named after name. Returns the leader's
+// client address.
+func multiBlockCluster(t *testing.T, name string) string {
+	scratch(t, "metadata."+name+".test.db*", "_data_"+name+"*")
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata." + name + ".test.db",
+		BlockSize:         4096,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		listener, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		startDataNode(t, datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     mdnClusterListener.Addr().String(),
+			DataDir:           fmt.Sprint("_data_", name, i),
+			HeartbeatInterval: 1 * time.Second,
+		})
+	}
+	return mdnClientListener.Addr().String()
+}
+
+// Uploads an erasure-coded blob across six DataNodes, corrupts one of its
+// internal blocks, and reads it back while the leader has it rebuilt from
+// the rest of its group. Meanwhile a replicated blob nobody reads gets
+// converted.
+func TestErasureCoding(t *testing.T) {
+	scratch(t, "metadata.erasure.test.db*", "_data_ec*")
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, _ = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata.erasure.test.db",
+		BlockSize:         400000,
+		ConvertAfter:      2 * time.Second,
+		ConvertPolicy:     "RS-3-2",
+	})
+	dataDirs := map[string]string{}
+	for i := 1; i <= 6; i++ {
+		listener, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		dataDir := fmt.Sprint("_data_ec", i)
+		dataDirs[listener.Addr().String()] = dataDir
+		startDataNode(t, datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     mdnClusterListener.Addr().String(),
+			DataDir:           dataDir,
+			HeartbeatInterval: 1 * time.Second,
+		})
+	}
+	// Groups need a DataNode for each internal block
+	time.Sleep(2 * time.Second)
+
+	expected := make([]byte, 1000*1000+17)
+	for i := range expected {
+		expected[i] = byte(rand.Intn(256))
+	}
+	// The leader takes one call per connection
+	call := func(method string, args interface{}, reply interface{}) {
+		leader, err := DialRPC(mdnClientListener.Addr().String(), false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer leader.Close()
+		if err := leader.Call(method, args, reply); err != nil {
+			log.Fatal(method, " error:", err)
+		}
+	}
+	// Where the leader thinks the internal block is, once it's heard
+	locate := func(cell BlockID) []string {
+		var located LocatedBlock
+		leader, err := DialRPC(mdnClientListener.Addr().String(), false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer leader.Close()
+		leader.Call("GetBlock", cell, &located)
+		return located.Nodes
+	}
+
+	conf := upload.Config{LeaderAddress: mdnClientListener.Addr().String(), Parallel: 2}
+	cold := mustUpload(conf, bytes.NewReader(expected[:300000]))
+	var replicas []BlockID
+	call("GetBlob", cold, &replicas)
+
+	conf.Policy = "RS-3-2"
+	blobID := mustUpload(conf, bytes.NewReader(expected))
+
+	check := func() {
+		reader, err := download.Open(mdnClientListener.Addr().String(), blobID, false)
+		if err != nil {
+			log.Fatal("Open error:", err)
+		}
+		downloaded, err := ioutil.ReadAll(reader)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !bytes.Equal(downloaded, expected) {
+			log.Fatalln("Downloaded blob", blobID, "doesn't match what was uploaded")
+		}
+	}
+	check()
+
+	var groups []BlockID
+	call("GetBlob", blobID, &groups)
+	cell := CellID(groups[0], 0)
+	holders := locate(cell)
+	for len(holders) == 0 {
+		time.Sleep(200 * time.Millisecond)
+		holders = locate(cell)
+	}
+	if len(holders) != 1 {
+		log.Fatalln("Internal block", cell, "is on", holders)
+	}
+	cellFile := dataDirs[holders[0]] + "/blocks/" + string(cell)
+	original, err := ioutil.ReadFile(cellFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	corrupted := append([]byte{}, original...)
+	for i := 1000; i < 2000; i++ {
+		corrupted[i] ^= 0xff
+	}
+	if err := ioutil.WriteFile(cellFile, corrupted, 0777); err != nil {
+		log.Fatal(err)
+	}
+
+	// Reading it fails over to the parity, and gets the DataNode to scan
+	// the block and throw it away
+	check()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			log.Fatalln("Internal block", cell, "wasn't rebuilt")
+		}
+		time.Sleep(500 * time.Millisecond)
+		// It can end up back on the same DataNode, which no longer has
+		// any of the group
+		nodes := locate(cell)
+		if len(nodes) != 1 {
+			continue
+		}
+		rebuilt, _ := ioutil.ReadFile(dataDirs[nodes[0]] + "/blocks/" + string(cell))
+		if bytes.Equal(rebuilt, original) {
+			break
+		}
+	}
+	check()
+	for {
+		if time.Now().After(deadline) {
+			log.Fatalln("Blob", cold, "wasn't converted")
+		}
+		var policy string
+		call("GetBlobPolicy", cold, &policy)
+		if policy == "RS-3-2" {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	reader, err := download.Open(mdnClientListener.Addr().String(), cold, false)
+	if err != nil {
+		log.Fatal("Open error:", err)
+	}
+	downloaded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !bytes.Equal(downloaded, expected[:300000]) {
+		log.Fatalln("Converted blob", cold, "doesn't match what was uploaded")
+	}
+	for _, block := range replicas {
+		for len(locate(block)) > 0 {
+			if time.Now().After(deadline) {
+				log.Fatalln("Replicas of", block, "weren't deleted")
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+}
+
+func mustUpload(conf upload.Config, r io.Reader) string {
+	blobID, err := upload.UploadWith(conf, r)
+	if err != nil {
+		log.Fatal("Upload error:", err)
+	}
+	return blobID
+}
+
+// Downloads the whole blob, then reads bits of it, all at once as ReadAt
+// allows
+func checkRanges(leaderAddress string, blobID string, expected []byte) {
+	reader, err := download.Open(leaderAddress, blobID, false)
+	if err != nil {
+		log.Fatal("Open error:", err)
+	}
+	defer reader.Close()
+	downloaded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !bytes.Equal(downloaded, expected) {
+		log.Fatalln("Downloaded blob", blobID, "doesn't match what was uploaded")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		offset := rand.Intn(len(expected))
+		p := make([]byte, rand.Intn(len(expected)-offset)%150000+1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := reader.ReadAt(p, int64(offset)); err != nil {
+				log.Fatalln("ReadAt error:", err)
+			}
+			if !bytes.Equal(p, expected[offset:offset+len(p)]) {
+				log.Fatalln("Read of", len(p), "bytes at", offset, "of", blobID, "doesn't match")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCompression(t *testing.T) {
+	scratch(t, "metadata.compression.test.db*", "_data_compress*")
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, _ = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata.compression.test.db",
+		BlockSize:         200000,
+	})
+	for i := 1; i <= 5; i++ {
+		listener, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		startDataNode(t, datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     mdnClusterListener.Addr().String(),
+			DataDir:           fmt.Sprint("_data_compress", i),
+			HeartbeatInterval: 1 * time.Second,
+		})
+	}
+	time.Sleep(2 * time.Second)
+
+	// Something like a log file
+	var text bytes.Buffer
+	words := []string{"block", "leader", "replica", "heartbeat", "DataNode", "checksum", "lease"}
+	for text.Len() < 700*1000 {
+		fmt.Fprintf(&text, "%d %s %s\n", rand.Intn(100000), words[rand.Intn(len(words))], words[rand.Intn(len(words))])
+	}
+	random := make([]byte, 300*1000)
+	for i := range random {
+		random[i] = byte(rand.Intn(256))
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+
+	check := func(blobID string, expected []byte, compressed bool) {
+		leader, err := DialRPC(leaderAddress, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var blocks []BlockInfo
+		if err := leader.Call("GetBlobInfo", blobID, &blocks); err != nil {
+			log.Fatal("GetBlobInfo error:", err)
+		}
+		leader.Close()
+		var size, stored int64
+		for _, b := range blocks {
+			size += b.Size
+			stored += b.Stored
+		}
+		if size != int64(len(expected)) {
+			log.Fatalln("Blob", blobID, "is", size, "bytes, not", len(expected))
+		}
+		if compressed && stored >= size/2 {
+			log.Fatalln("Blob", blobID, "takes", stored, "bytes for", size)
+		}
+
+		checkRanges(leaderAddress, blobID, expected)
+	}
+
+	for _, name := range []string{"gzip", "flate", "lz"} {
+		conf := upload.Config{LeaderAddress: leaderAddress, Parallel: 2, Codec: name}
+		check(mustUpload(conf, bytes.NewReader(text.Bytes())), text.Bytes(), true)
+	}
+	// Frames that don't compress are stored as they are
+	conf := upload.Config{LeaderAddress: leaderAddress, Parallel: 2, Codec: "lz"}
+	check(mustUpload(conf, bytes.NewReader(random)), random, false)
+	conf.Policy = "RS-3-2"
+	check(mustUpload(conf, bytes.NewReader(text.Bytes())), text.Bytes(), true)
+
+	// Every send is a new block, and so is every append
+	conf = upload.Config{LeaderAddress: leaderAddress, Codec: "lz"}
+	w, err := upload.Create(conf)
+	if err != nil {
+		log.Fatal("Create error:", err)
+	}
+	w.Write(text.Bytes()[:100000])
+	if err := w.Hflush(); err != nil {
+		log.Fatal("Hflush error:", err)
+	}
+	w.Write(text.Bytes()[100000:150000])
+	if err := w.Close(); err != nil {
+		log.Fatal("Close error:", err)
+	}
+	check(w.BlobID(), text.Bytes()[:150000], true)
+	w, err = upload.OpenForAppend(upload.Config{LeaderAddress: leaderAddress}, w.BlobID())
+	if err != nil {
+		log.Fatal("OpenForAppend error:", err)
+	}
+	w.Write(text.Bytes()[150000:400000])
+	if err := w.Close(); err != nil {
+		log.Fatal("Close error:", err)
+	}
+	check(w.BlobID(), text.Bytes()[:400000], true)
+}
+
+func TestEncryption(t *testing.T) {
+	scratch(t, "metadata.encryption.test.db*", "_data_keyring.json", "_data_master.key", "_data_encrypt*")
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	kmsListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Left over from last time, the zone and its keys would already exist
+	keyring, err := kms.OpenKeyring("_data_keyring.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go kms.Serve(kmsListener, keyring)
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata.encryption.test.db",
+		BlockSize:         200000,
+		KeyFile:           "_data_master.key",
+		KMSAddress:        kmsListener.Addr().String(),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	var dataDirs []string
+	for i := 1; i <= 5; i++ {
+		listener, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		dataDir := fmt.Sprint("_data_encrypt", i)
+		dataDirs = append(dataDirs, dataDir)
+		startDataNode(t, datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     mdnClusterListener.Addr().String(),
+			DataDir:           dataDir,
+			HeartbeatInterval: 1 * time.Second,
+		})
+	}
+	time.Sleep(2 * time.Second)
+
+	var text bytes.Buffer
+	for text.Len() < 500*1000 {
+		fmt.Fprintf(&text, "%d confidential record\n", rand.Intn(100000))
+	}
+	expected := text.Bytes()
+	leaderAddress := mdnClientListener.Addr().String()
+
+	// A block's chunks only decrypt in its own place in the blob
+	key := crypt.NewKey()
+	sealed, err := crypt.EncryptBlock(key, 1, bytes.NewReader(expected[:1000]), 1000)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := crypt.DecryptChunks(key, 0, 0, sealed); err != crypt.ErrCorrupt {
+		log.Fatal("Chunk from block 1 decrypted as block 0:", err)
+	}
+	if plain, err := crypt.DecryptChunks(key, 1, 0, sealed); err != nil || !bytes.Equal(plain, expected[:1000]) {
+		log.Fatal("Chunk didn't decrypt in its own place:", err)
+	}
+
+	conf := upload.Config{LeaderAddress: leaderAddress, Parallel: 2, Encrypt: true}
+	checkRanges(leaderAddress, mustUpload(conf, bytes.NewReader(expected)), expected)
+	conf.Codec = "lz"
+	conf.Policy = "RS-3-2"
+	checkRanges(leaderAddress, mustUpload(conf, bytes.NewReader(expected)), expected)
+
+	w, err := upload.Create(upload.Config{LeaderAddress: leaderAddress, Encrypt: true})
+	if err != nil {
+		log.Fatal("Create error:", err)
+	}
+	w.Write(expected[:100000])
+	if err := w.Hflush(); err != nil {
+		log.Fatal("Hflush error:", err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal("Close error:", err)
+	}
+	w, err = upload.OpenForAppend(upload.Config{LeaderAddress: leaderAddress}, w.BlobID())
+	if err != nil {
+		log.Fatal("OpenForAppend error:", err)
+	}
+	w.Write(expected[100000:250000])
+	if err := w.Close(); err != nil {
+		log.Fatal("Close error:", err)
+	}
+	checkRanges(leaderAddress, w.BlobID(), expected[:250000])
+
+	conf = upload.Config{LeaderAddress: leaderAddress, Parallel: 2}
+	if err := upload.CreateZone(conf, EncryptionZone{"secure", "zone-key"}); err != nil {
+		log.Fatal("CreateZone error:", err)
+	}
+	if _, err := upload.Create(upload.Config{LeaderAddress: leaderAddress, Zone: "nowhere"}); err == nil {
+		log.Fatalln("Created a blob in a zone that doesn't exist")
+	}
+	conf.Zone = "secure"
+	zoned := mustUpload(conf, bytes.NewReader(expected))
+	checkRanges(leaderAddress, zoned, expected)
+	audit := func() string {
+		uses, err := upload.KeyAudit(conf)
+		if err != nil {
+			log.Fatal("KeyAudit error:", err)
+		}
+		return fmt.Sprint(uses)
+	}
+	if uses := audit(); uses != "[{ 0 3} {zone-key 1 1}]" {
+		log.Fatalln("Keys in use:", uses)
+	}
+	rewrapped, err := upload.Rekey(conf, "zone-key")
+	if err != nil {
+		log.Fatal("Rekey error:", err)
+	}
+	if rewrapped != 1 {
+		log.Fatalln("Rewrapped", rewrapped, "keys")
+	}
+	if uses := audit(); uses != "[{ 0 3} {zone-key 1 0} {zone-key 2 1}]" {
+		log.Fatalln("Keys in use after rekeying:", uses)
+	}
+	checkRanges(leaderAddress, zoned, expected)
+
+	// Nothing readable on disk
+	blocks := 0
+	for _, dataDir := range dataDirs {
+		files, err := ioutil.ReadDir(dataDir + "/blocks")
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, file := range files {
+			data, err := ioutil.ReadFile(dataDir + "/blocks/" + file.Name())
+			if err != nil {
+				log.Fatal(err)
+			}
+			if bytes.Contains(data, []byte("confidential")) {
+				log.Fatalln("Block", file.Name(), "is stored in the clear")
+			}
+			blocks++
+		}
+	}
+	if blocks == 0 {
+		log.Fatalln("No blocks were stored")
+	}
+}
+
+func TestTLS(t *testing.T) {
+	scratch(t, "metadata.tls.test.db*", "_data_tls*")
+	if err := GenerateCert("_data_tls", "node", []string{"::1", "localhost"}); err != nil {
+		log.Fatal(err)
+	}
+	if err := LoadTLS("_data_tls/node.pem", "_data_tls/node-key.pem", "_data_tls/ca.pem"); err != nil {
+		log.Fatal(err)
+	}
+	defer LoadTLS("", "", "")
+
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata.tls.test.db",
+		BlockSize:         20000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		listener, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		startDataNode(t, datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     mdnClusterListener.Addr().String(),
+			DataDir:           fmt.Sprint("_data_tls", i),
+			HeartbeatInterval: 1 * time.Second,
+		})
+	}
+	time.Sleep(2 * time.Second)
+
+	expected := make([]byte, 70*1000)
+	for i := range expected {
+		expected[i] = byte(rand.Intn(256))
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+	blobID := mustUpload(upload.Config{LeaderAddress: leaderAddress, Parallel: 2}, bytes.NewReader(expected))
+	checkRanges(leaderAddress, blobID, expected)
+
+	// Plain TCP gets nowhere
+	plain, err := jsonrpc.Dial("tcp", leaderAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var blocks []BlockID
+	if err := plain.Call("GetBlob", blobID, &blocks); err == nil {
+		log.Fatalln("Leader answered over plain TCP")
+	}
+	plain.Close()
+	// and DataNodes need a certificate to join
+	ca, err := ioutil.ReadFile("_data_tls/ca.pem")
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	conn, err := tls.Dial("tcp", mdnClusterListener.Addr().String(), &tls.Config{RootCAs: pool})
+	if err == nil {
+		if _, err = ClientHandshake(conn); err == nil {
+			var nodeID NodeID
+			err = jsonrpc.NewClient(conn).Call("Register", &RegistrationMsg{"[::1]:1", nil, "", LocalVersion()}, &nodeID)
+		}
+		conn.Close()
+	}
+	if err == nil {
+		log.Fatalln("Registered a DataNode without a certificate")
+	}
+}
+
+// Blobs belong to whoever uploaded them, and other clients get what the mode
+// and ACL allow
+func TestAuth(t *testing.T) {
+	scratch(t, "metadata.auth.test.db*", "_data_auth*")
+	secret, err := auth.LoadSecret("_data_auth.secret")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokens := auth.NewHMAC(secret)
+	alice := tokens.Issue(Identity{"alice", []string{"eng"}}, time.Hour)
+	bob := tokens.Issue(Identity{"bob", []string{"eng"}}, time.Hour)
+	carol := tokens.Issue(Identity{"carol", []string{"ops"}}, time.Hour)
+	dave := tokens.Issue(Identity{"dave", []string{"ops"}}, time.Hour)
+	root := tokens.Issue(Identity{"root", nil}, time.Hour)
+	expired := tokens.Issue(Identity{"alice", []string{"eng"}}, -time.Minute)
+	forged := auth.NewHMAC([]byte("not the secret")).Issue(Identity{"root", nil}, time.Hour)
+	defer SetToken("")
+
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata.auth.test.db",
+		BlockSize:         20000,
+		Authenticator:     tokens,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		listener, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		startDataNode(t, datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     mdnClusterListener.Addr().String(),
+			DataDir:           fmt.Sprint("_data_auth", i),
+			HeartbeatInterval: 1 * time.Second,
+		})
+	}
+	time.Sleep(2 * time.Second)
+
+	leaderAddress := mdnClientListener.Addr().String()
+	conf := upload.Config{LeaderAddress: leaderAddress, Parallel: 2}
+	as := func(token string) context.Context {
+		return WithToken(context.Background(), token)
+	}
+	canRead := func(token string, blobID string) bool {
+		reader, err := download.OpenContext(as(token), leaderAddress, blobID, false)
+		if err != nil {
+			return false
+		}
+		if _, err := ioutil.ReadAll(reader); err != nil {
+			log.Fatal(err)
+		}
+		return true
+	}
+	listed := func(token string, blobID string) bool {
+		blobs, err := download.ListContext(as(token), leaderAddress, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, b := range blobs {
+			if b == blobID {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Anonymous clients can't create anything
+	if _, err := upload.Create(conf); err == nil {
+		log.Fatalln("Created a blob without logging in")
+	}
+
+	expected := make([]byte, 50*1000)
+	for i := range expected {
+		expected[i] = byte(rand.Intn(256))
+	}
+	aliceConf, bobConf := conf, conf
+	aliceConf.Token, bobConf.Token = alice, bob
+	aclConf := aliceConf
+	aclConf.ACL = []ACLEntry{{User: "carol", Mode: auth.Read}}
+	blobID := mustUpload(aclConf, bytes.NewReader(expected))
+	// Calls without a token of their own go as whoever SetToken says
+	SetToken(alice)
+	checkRanges(leaderAddress, blobID, expected)
+	SetToken("")
+
+	for _, c := range []struct {
+		who     string
+		token   string
+		allowed bool
+	}{
+		{"alice", alice, true},
+		{"bob, in the group", bob, true},
+		{"carol, in the ACL", carol, true},
+		{"dave", dave, false},
+		{"root", root, true},
+		{"anonymous", "", false},
+	} {
+		if canRead(c.token, blobID) != c.allowed || listed(c.token, blobID) != c.allowed {
+			log.Fatalln("Wrong access for", c.who)
+		}
+	}
+	// Clients with different tokens at once each get their own connections
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if !canRead(alice, blobID) {
+				log.Fatalln("Owner couldn't read alongside someone else")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if canRead(dave, blobID) {
+				log.Fatalln("Read a blob on someone else's connection")
+			}
+		}()
+	}
+	wg.Wait()
+	for _, token := range []string{expired, forged, "nonsense"} {
+		if _, err := download.ListContext(as(token), leaderAddress, false); err == nil {
+			log.Fatalln("Leader took a bad token")
+		}
+	}
+
+	// Only the owner can write or change permissions
+	if err := upload.Delete(bobConf, blobID); err == nil {
+		log.Fatalln("Deleted someone else's blob")
+	}
+	if _, err := upload.OpenForAppend(bobConf, blobID); err == nil {
+		log.Fatalln("Appended to someone else's blob")
+	}
+	if err := upload.SetPermissions(bobConf, blobID, Permissions{Mode: 0666}); err == nil {
+		log.Fatalln("Changed someone else's blob's permissions")
+	}
+	if err := upload.SetPermissions(aliceConf, blobID, Permissions{Mode: 0600}); err != nil {
+		log.Fatal(err)
+	}
+	if canRead(bob, blobID) || canRead(carol, blobID) {
+		log.Fatalln("Read a blob after losing access")
+	}
+	if !canRead(alice, blobID) {
+		log.Fatalln("Owner lost access")
+	}
+
+	// Readers of a blob can't find other blobs' blocks
+	client, err := DialLeaderContext(as(alice), leaderAddress, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var blocks []BlockID
+	if err := client.Call("GetBlob", blobID, &blocks); err != nil {
+		log.Fatal(err)
+	}
+	client.Close()
+	if client, err = DialLeaderContext(as(bob), leaderAddress, false); err != nil {
+		log.Fatal(err)
+	}
+	var located LocatedBlock
+	if err := client.Call("GetBlock", blocks[0], &located); err == nil {
+		log.Fatalln("Found a block of a blob it can't read")
+	}
+	client.Close()
+
+	// or take them into their own by resuming with them
+	resumeWith := func(token string, block BlockID) error {
+		client, err := DialLeaderContext(as(token), leaderAddress, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var newBlob string
+		if err := client.Call("CreateBlob", CreateBlob{}, &newBlob); err != nil {
+			log.Fatal(err)
+		}
+		client.Close()
+		if client, err = DialLeaderContext(as(token), leaderAddress, false); err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		var replicated []BlockID
+		return client.Call("ResumeBlob", ResumeBlob{newBlob, []BlockID{block}}, &replicated)
+	}
+	if err := resumeWith(bob, blocks[0]); ErrorCodeOf(err) != PermissionDenied {
+		log.Fatalln("Resumed with a block of a blob it can't read:", err)
+	}
+	if err := resumeWith(alice, blocks[0]); err != nil {
+		log.Fatalln("Couldn't resume with a block of its own blob:", err)
+	}
+	// and blobs nobody created can't be resumed into being
+	for _, token := range []string{"", alice} {
+		client, err := DialLeaderContext(as(token), leaderAddress, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var replicated []BlockID
+		err = client.Call("ResumeBlob", ResumeBlob{"made-up", nil}, &replicated)
+		if ErrorCodeOf(err) != NotFound {
+			log.Fatalln("Resumed a blob nobody created:", err)
+		}
+		client.Close()
+	}
+
+	// or by deduplicating against them
+	private := make([]byte, 30*1000)
+	rand.Read(private)
+	aliceDedup, bobDedup := aliceConf, bobConf
+	aliceDedup.Dedup, bobDedup.Dedup = true, true
+	aliceDedup.Mode, bobDedup.Mode = 0600, 0600
+	// Each as whoever uploaded it
+	blobBlocks := func(token string, blobID string) string {
+		var blocks []BlockID
+		if err := CallLeaderContext(as(token), leaderAddress, false, "GetBlob", blobID, &blocks); err != nil {
+			log.Fatal(err)
+		}
+		return fmt.Sprint(blocks)
+	}
+	original := blobBlocks(alice, mustUpload(aliceDedup, bytes.NewReader(private)))
+	// Let the DataNodes tell the leader they have its blocks
+	time.Sleep(2 * time.Second)
+	if copied := mustUpload(bobDedup, bytes.NewReader(private)); blobBlocks(bob, copied) == original {
+		log.Fatalln("Deduplicated against a blob it can't read")
+	}
+	if copied := mustUpload(aliceDedup, bytes.NewReader(private)); blobBlocks(alice, copied) != original {
+		log.Fatalln("Didn't deduplicate against its own blob")
+	}
+
+	// Only admins can ask DataNodes how they're doing, so the leader turns
+	// everyone else away before they get that far
+	if _, err := upload.DataNodeRetries(bobConf, "[::1]:1"); ErrorCodeOf(err) != PermissionDenied {
+		log.Fatalln("Non-admin got a DataNode stats token ->", err)
+	}
+
+	if err := upload.Delete(aliceConf, blobID); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// DataNodes only take blocks from, and give them to, whoever has a token
+// from the leader for them, DataNodes included
+func TestBlockTokens(t *testing.T) {
+	scratch(t, "metadata.tokens.test.db*", "_data_tokens*")
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata.tokens.test.db",
+		BlockSize:         20000,
+		BlockTokens:       true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	start := func(i int) {
+		listener, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		startDataNode(t, datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     mdnClusterListener.Addr().String(),
+			DataDir:           fmt.Sprint("_data_tokens", i),
+			HeartbeatInterval: 1 * time.Second,
+		})
+	}
+	for i := 1; i <= 3; i++ {
+		start(i)
+	}
+	time.Sleep(2 * time.Second)
+
+	expected := make([]byte, 150*1000)
+	for i := range expected {
+		expected[i] = byte(rand.Intn(256))
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+	conf := upload.Config{LeaderAddress: leaderAddress, Parallel: 2}
+	blobID := mustUpload(conf, bytes.NewReader(expected))
+	checkRanges(leaderAddress, blobID, expected)
+	ecConf := conf
+	ecConf.Policy = "RS-2-1"
+	checkRanges(leaderAddress, mustUpload(ecConf, bytes.NewReader(expected)), expected)
+
+	// Appending in place uses the token for the last block
+	w, err := upload.Create(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := w.Write(expected[:5000]); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+	// Once the leader knows where the block is
+	time.Sleep(2 * time.Second)
+	if w, err = upload.OpenForAppend(conf, w.BlobID()); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := w.Write(expected[5000:8000]); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+	checkRanges(leaderAddress, w.BlobID(), expected[:8000])
+
+	leader, err := DialLeader(leaderAddress, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var blocks []BlockID
+	if err := leader.Call("GetBlob", blobID, &blocks); err != nil {
+		log.Fatal(err)
+	}
+	leader.Close()
+	located := func(block BlockID) LocatedBlock {
+		leader, err := DialLeader(leaderAddress, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer leader.Close()
+		var located LocatedBlock
+		if err := leader.Call("GetBlock", block, &located); err != nil {
+			log.Fatal(err)
+		}
+		return located
+	}
+	first, second := located(blocks[0]), located(blocks[1])
+	if first.Token == nil {
+		log.Fatalln("No token with the block's location")
+	}
+	buf := make([]byte, 100)
+	if err := ReadBlockRange(context.Background(), first.Nodes[0], blocks[0], 0, buf, first.Token, false); err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(buf, expected[:100]) {
+		log.Fatalln("Read the wrong data with a token")
+	}
+	forged := *first.Token
+	forged.Expires += 3600
+	for _, token := range []*BlockToken{nil, second.Token, &forged} {
+		if err := ReadBlockRange(context.Background(), first.Nodes[0], blocks[0], 0, buf, token, false); ErrorCodeOf(err) != PermissionDenied {
+			log.Fatalln("Read a block with token", token, "->", err)
+		}
+	}
+	// Read tokens don't let anyone write
+	dataNode, err := DialTransfer(first.Nodes[0], false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := dataNode.Call("Forward", &ForwardBlock{blocks[0] + "x", nil, 100, first.Token}, nil); err == nil {
+		log.Fatalln("Wrote a block with a read token")
+	}
+	dataNode.Close()
+
+	// DataNodes only say how they're doing with a token for it, and
+	// connections only get pinged once they've shown one
+	dataNode, err = DialTransfer(first.Nodes[0], false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var ok string
+	if err := dataNode.Call("Ping", nil, &ok); ErrorCodeOf(err) != PermissionDenied {
+		log.Fatalln("Pinged a DataNode without a token ->", err)
+	}
+	dataNode.Close()
+	for _, token := range []*BlockToken{nil, first.Token} {
+		if dataNode, err = DialTransfer(first.Nodes[0], false); err != nil {
+			log.Fatal(err)
+		}
+		var stats []RetryStat
+		if err := dataNode.Call("RetryStats", token, &stats); ErrorCodeOf(err) != PermissionDenied {
+			log.Fatalln("Got a DataNode's stats with token", token, "->", err)
+		}
+		dataNode.Close()
+	}
+	if _, err := upload.DataNodeScanProgress(conf, first.Nodes[0]); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := upload.DataNodePeerFailures(conf, first.Nodes[0]); err != nil {
+		log.Fatal(err)
+	}
+	if err := ReadBlockRange(context.Background(), first.Nodes[0], blocks[0], 0, buf, first.Token, false); err != nil {
+		log.Fatal(err)
+	}
+
+	// The leader's keys outlast it, so its tokens still work after a restart
+	clientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	clusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	restarted, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    clientListener,
+		ClusterListener:   clusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata.tokens.test.db",
+		BlockSize:         20000,
+		BlockTokens:       true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	var keys auth.BlockKeys
+	keys.Set(restarted.BlockKeys())
+	if err := keys.Verify(first.Token, blocks[0], auth.Read); err != nil {
+		log.Fatalln("Token stopped working when the leader restarted ->", err)
+	}
+
+	// DataNodes that require tokens serve nothing before they have keys
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	startDataNode(t, datanode.Config{
+		Listener:           listener,
+		LeaderAddress:      "[::1]:1",
+		DataDir:            "_data_tokens_required",
+		HeartbeatInterval:  1 * time.Second,
+		RequireBlockTokens: true,
+	})
+	err = ReadBlockRange(context.Background(), listener.Addr().String(), blocks[0], 0, buf, nil, false)
+	if ErrorCodeOf(err) != Retryable {
+		log.Fatalln("Read from a DataNode with no keys ->", err)
+	}
+
+	// Rebalancing onto a new DataNode has the others send it blocks with
+	// tokens of their own
+	start(4)
+	for attempt := 0; ; attempt++ {
+		files, _ := ioutil.ReadDir("_data_tokens4/blocks")
+		if len(files) > 0 {
+			break
+		}
+		if attempt > 20 {
+			log.Fatalln("No blocks moved to the new DataNode")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	checkRanges(leaderAddress, blobID, expected)
+}
+
+// DataNodes need the join token, have to be where they say they are, and
+// can be shut out by the hosts files while the leader runs
+func TestRegistration(t *testing.T) {
+	scratch(t, "metadata.registration.test.db*", "_data_hosts.exclude", "_data_registration*")
+	if err := ioutil.WriteFile("_data_hosts.exclude", nil, 0644); err != nil {
+		log.Fatal(err)
+	}
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata.registration.test.db",
+		BlockSize:         20000,
+		JoinToken:         "let-me-in",
+		HostsExcludeFile:  "_data_hosts.exclude",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, token := range []string{"let-me-in", "let-me-in", "guess"} {
+		// Listening everywhere, so it's known by the address it came from
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		startDataNode(t, datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     mdnClusterListener.Addr().String(),
+			DataDir:           fmt.Sprint("_data_registration", i+1),
+			HeartbeatInterval: 1 * time.Second,
+			JoinToken:         token,
+		})
+	}
+	time.Sleep(2 * time.Second)
+
+	expected := make([]byte, 50*1000)
+	for i := range expected {
+		expected[i] = byte(rand.Intn(256))
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+	conf := upload.Config{LeaderAddress: leaderAddress}
+	blobID := mustUpload(conf, bytes.NewReader(expected))
+	checkRanges(leaderAddress, blobID, expected)
+	if files, _ := ioutil.ReadDir("_data_registration3/blocks"); len(files) > 0 {
+		log.Fatalln("DataNode with the wrong join token got blocks")
+	}
+
+	register := func(addr, token string) error {
+		leader, err := DialRPC(mdnClusterListener.Addr().String(), false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer leader.Close()
+		var nodeID NodeID
+		return leader.Call("Register", &RegistrationMsg{addr, nil, token, LocalVersion()}, &nodeID)
+	}
+	if err := register("[::1]:1", "guess"); err == nil {
+		log.Fatalln("Registered with the wrong join token")
+	}
+	if err := register("192.0.2.1:1", "let-me-in"); err == nil {
+		log.Fatalln("Registered for someone else's address")
+	}
+
+	client, err := DialLeader(leaderAddress, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var blocks []BlockID
+	if err := client.Call("GetBlob", blobID, &blocks); err != nil {
+		log.Fatal(err)
+	}
+	client.Close()
+	holders := func() int {
+		client, err := DialLeader(leaderAddress, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		var located LocatedBlock
+		if err := client.Call("GetBlock", blocks[0], &located); err != nil {
+			log.Fatal(err)
+		}
+		return len(located.Nodes)
+	}
+
+	// Shutting the host out drops every DataNode on it
+	if err := ioutil.WriteFile("_data_hosts.exclude", []byte("::1 # us\n"), 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := upload.RefreshNodes(conf); err != nil {
+		log.Fatal(err)
+	}
+	if holders() != 0 {
+		log.Fatalln("Excluded DataNodes still hold blocks")
+	}
+	if err := register("[::1]:1", "let-me-in"); err == nil {
+		log.Fatalln("Registered from an excluded host")
+	}
+
+	// and they come back once it's let in again
+	if err := ioutil.WriteFile("_data_hosts.exclude", nil, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := upload.RefreshNodes(conf); err != nil {
+		log.Fatal(err)
+	}
+	for attempt := 0; holders() < 2; attempt++ {
+		if attempt > 20 {
+			log.Fatalln("DataNodes didn't rejoin")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	checkRanges(leaderAddress, blobID, expected)
+}
+
+// Connections start by agreeing on a protocol version, and DataNodes the
+// leader can't talk to aren't let in
+func TestVersionHandshake(t *testing.T) {
+	scratch(t, "metadata.version.test.db*")
+	if (VersionRange{1, 3}).Agree(VersionRange{2, 5}) != 3 || (VersionRange{1, 1}).Agree(VersionRange{2, 2}) != 0 {
+		log.Fatalln("Wrong protocol version agreed")
+	}
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "metadata.version.test.db",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+
+	// Clients from before the handshake are told why they're turned away
+	old, err := jsonrpc.Dial("tcp", leaderAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var blobs []string
+	err = old.Call("ListBlobs", nil, &blobs)
+	old.Close()
+	if err == nil || !strings.Contains(err.Error(), "protocol version") {
+		log.Fatalln("Client without a handshake wasn't rejected clearly:", err)
+	}
+
+	// and ones that are too new get the range the leader speaks
+	conn, err := net.Dial("tcp", leaderAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn.Write([]byte("DFSV\x09\x09"))
+	reply := make([]byte, 7)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		log.Fatal(err)
+	}
+	conn.Close()
+	if string(reply) != "DFSV\x00"+string([]byte{MinProtocolVersion, ProtocolVersion}) {
+		log.Fatalf("Handshake from the future got %q", reply)
+	}
+
+	register := func(version VersionInfo) error {
+		leader, err := DialRPC(mdnClusterListener.Addr().String(), false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer leader.Close()
+		var nodeID NodeID
+		return leader.Call("Register", &RegistrationMsg{"[::1]:1", nil, "", version}, &nodeID)
+	}
+	future := LocalVersion()
+	future.Build, future.Protocol = "future", VersionRange{ProtocolVersion + 1, ProtocolVersion + 1}
+	if err := register(future); ErrorCodeOf(err) != Incompatible {
+		log.Fatalln("Registered a DataNode the leader can't talk to:", err)
+	}
+	// A different build that speaks the same protocols is fine
+	other := LocalVersion()
+	other.Build = "other"
+	if err := register(other); err != nil {
+		log.Fatalln("Compatible DataNode refused:", err)
+	}
+}
+
+// Connections take any number of calls, at the same time if the protocol
+// allows it, and pooled ones are checked and dropped when they go idle
+func TestConnectionReuse(t *testing.T) {
+	scratch(t, "metadata.reuse.test.db*", "_data_reuse")
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "metadata.reuse.test.db",
+		BlockSize:         20000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	startDataNode(t, datanode.Config{
+		Listener:          dnListener,
+		LeaderAddress:     mdnClusterListener.Addr().String(),
+		DataDir:           "_data_reuse",
+		HeartbeatInterval: 1 * time.Second,
+	})
+	time.Sleep(2 * time.Second)
+
+	expected := make([]byte, 50*1000)
+	for i := range expected {
+		expected[i] = byte(rand.Intn(256))
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+	blobID := mustUpload(upload.Config{LeaderAddress: leaderAddress}, bytes.NewReader(expected))
+	checkRanges(leaderAddress, blobID, expected)
+
+	// Lots of calls at once on one connection to the leader
+	client, err := DialLeader(leaderAddress, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var blocks []BlockInfo
+			if err := client.Call("GetBlobInfo", blobID, &blocks); err != nil || len(blocks) != 3 {
+				log.Fatalln("GetBlobInfo on a shared connection:", blocks, err)
+			}
+		}()
+	}
+	wg.Wait()
+	// then a blob written on it, and more calls once that's committed
+	var newBlob string
+	if err := client.Call("CreateBlob", &CreateBlob{}, &newBlob); err != nil {
+		log.Fatal(err)
+	}
+	var ok string
+	if err := client.Call("Commit", []BlockInfo{}, &ok); err != nil {
+		log.Fatal(err)
+	}
+	var blobs []string
+	if err := client.Call("ListBlobs", nil, &blobs); err != nil || len(blobs) == 0 {
+		log.Fatalln("ListBlobs after a commit:", blobs, err)
+	}
+	client.Close()
+
+	// One call after another on a DataNode connection
+	dataNode, err := DialTransfer(dnListener.Addr().String(), false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		var progress ScanProgress
+		if err := dataNode.Call("ScanProgress", nil, &progress); err != nil {
+			log.Fatal(err)
+		}
+	}
+	dataNode.Close()
+
+	dials := 0
+	pool := &Pool{
+		Dial: func(ctx context.Context, addr string) (io.Closer, error) {
+			dials++
+			return DialLeader(addr, false)
+		},
+		Check: func(conn io.Closer) error {
+			return conn.(*rpc.Client).Call("Ping", nil, &ok)
+		},
+		Shared:      true,
+		IdleTimeout: 200 * time.Millisecond,
+		CheckAfter:  50 * time.Millisecond,
+	}
+	first, err := pool.Get(context.Background(), leaderAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	second, err := pool.Get(context.Background(), leaderAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if first != second || dials != 1 {
+		log.Fatalln("Shared pool dialed", dials, "times")
+	}
+	pool.Put(leaderAddress, first)
+	pool.Put(leaderAddress, second)
+	// Broken connections fail the check and get replaced
+	first.Close()
+	time.Sleep(60 * time.Millisecond)
+	conn, err := pool.Get(context.Background(), leaderAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conn == first || dials != 2 {
+		log.Fatalln("Pool handed out a broken connection")
+	}
+	if err := conn.(*rpc.Client).Call("Ping", nil, &ok); err != nil {
+		log.Fatal(err)
+	}
+	pool.Put(leaderAddress, conn)
+	// and idle ones are closed
+	time.Sleep(400 * time.Millisecond)
+	if err := conn.(*rpc.Client).Call("Ping", nil, &ok); err != rpc.ErrShutdown {
+		log.Fatalln("Idle connection wasn't closed:", err)
+	}
+	pool.Close()
+}
+
+func TestTimeouts(t *testing.T) {
+	scratch(t, "metadata.timeouts.test.db*", "_data_timeouts")
+	SetTimeouts(Timeouts{
+		Dial:  300 * time.Millisecond,
+		Read:  500 * time.Millisecond,
+		Write: 500 * time.Millisecond,
+		Idle:  2 * time.Second,
+	})
+	defer SetTimeouts(DefaultTimeouts)
+
+	// Peers that take connections and never say anything
+	silent, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	stuck, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stuck.Close()
+	go func() {
+		// Kept so they aren't closed when they're collected
+		var conns []net.Conn
+		for {
+			conn, err := stuck.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+			// Shakes hands, then never answers a call
+			go ServerHandshake(conn)
+		}
+	}()
+
+	start := time.Now()
+	if _, err := DialRPC(silent.Addr().String(), false); !IsTimeout(err) {
+		log.Fatalln("Handshake with a silent peer didn't time out:", err)
+	}
+	if _, err := DialTransfer(silent.Addr().String(), false); !IsTimeout(err) {
+		log.Fatalln("Transfer handshake with a silent peer didn't time out:", err)
+	}
+	var ok string
+	if err := CallPeer(stuck.Addr().String(), false, "Ping", nil, &ok); !IsTimeout(err) {
+		log.Fatalln("Call to a stuck peer didn't time out:", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		log.Fatalln("Timing out took", time.Since(start))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := DialRPCContext(ctx, silent.Addr().String(), false); err != context.Canceled {
+		log.Fatalln("Cancelled dial returned", err)
+	}
+
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "metadata.timeouts.test.db",
+		BlockSize:         20000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	startDataNode(t, datanode.Config{
+		Listener:          dnListener,
+		LeaderAddress:     mdnClusterListener.Addr().String(),
+		DataDir:           "_data_timeouts",
+		HeartbeatInterval: 500 * time.Millisecond,
+	})
+	time.Sleep(2 * time.Second)
+
+	expected := make([]byte, 50*1000)
+	for i := range expected {
+		expected[i] = byte(rand.Intn(256))
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+	blobID := mustUpload(upload.Config{LeaderAddress: leaderAddress}, bytes.NewReader(expected))
+	checkRanges(leaderAddress, blobID, expected)
+
+	// Reads stop once they're cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	reader, err := download.OpenContext(ctx, leaderAddress, blobID, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if _, err := reader.ReadAt(buf, 0); err != nil {
+		log.Fatal(err)
+	}
+	cancel()
+	if _, err := reader.ReadAt(buf, 40000); err != context.Canceled {
+		log.Fatalln("Cancelled read returned", err)
+	}
+	if err := download.DownloadContext(ctx, ioutil.Discard, blobID, 0, -1, false, leaderAddress); err != context.Canceled {
+		log.Fatalln("Cancelled download returned", err)
+	}
+
+	// A writer that goes quiet is hung up on, and its lease given up
+	// long before the lease timeout
+	client, err := DialLeader(leaderAddress, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	var opened OpenedBlob
+	if err := client.Call("OpenForAppend", blobID, &opened); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := upload.OpenForAppend(upload.Config{LeaderAddress: leaderAddress}, blobID); err == nil {
+		log.Fatalln("Blob was opened for appending twice")
+	}
+	time.Sleep(3 * time.Second)
+	if err := client.Call("Flush", opened.Blocks, &ok); err == nil {
+		log.Fatalln("Idle session wasn't hung up on")
+	}
+	var writer *upload.Writer
+	for attempt := 0; attempt < 20 && writer == nil; attempt++ {
+		time.Sleep(500 * time.Millisecond)
+		writer, _ = upload.OpenForAppend(upload.Config{LeaderAddress: leaderAddress}, blobID)
+	}
+	if writer == nil {
+		log.Fatalln("Abandoned lease never expired")
+	}
+	writer.Write([]byte("more"))
+	if err := writer.Close(); err != nil {
+		log.Fatal(err)
+	}
+	checkRanges(leaderAddress, blobID, append(expected, "more"...))
+}
+
+// The leader stops waiting on the KMS for a client that's gone, rather than
+// until the read timeout
+func TestKMSCancellation(t *testing.T) {
+	scratch(t, "metadata.kmscancel.test.db*")
+	// A KMS that never answers, and says when the leader hangs up on it
+	kmsListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer kmsListener.Close()
+	asked := make(chan bool, 1)
+	gaveUp := make(chan bool, 1)
+	go func() {
+		for {
+			conn, err := kmsListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ServerHandshake(conn)
+				if _, err := conn.Read(make([]byte, 1)); err == nil {
+					select {
+					case asked <- true:
+					default:
+					}
+				}
+				io.Copy(ioutil.Discard, conn)
+				select {
+				case gaveUp <- true:
+				default:
+				}
+			}()
+		}
+	}()
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "metadata.kmscancel.test.db",
+		KMSAddress:        kmsListener.Addr().String(),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := DialLeader(mdnClientListener.Addr().String(), false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client.Go("Rekey", "zone-key", new(int), nil)
+	select {
+	case <-asked:
+	case <-time.After(5 * time.Second):
+		log.Fatalln("Leader never asked the KMS")
+	}
+	client.Close()
+	select {
+	case <-gaveUp:
+	case <-time.After(5 * time.Second):
+		log.Fatalln("Leader kept waiting on the KMS after its client left")
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	scratch(t, "metadata.errors.test.db*", "_data_errors")
+	sent := Errorf(Conflict, "Block is %d bytes, not %d", 10, 20).With("size", "10")
+	got := DecodeError(sent.Encode())
+	if got.Code != Conflict || got.Message != sent.Message || got.Details["size"] != "10" {
+		log.Fatalln("Error came back as", got.Code, got.Message, got.Details)
+	}
+	// Peers that don't send codes
+	if got := DecodeError("Nope: something broke"); got.Code != Unknown || got.Message != "Nope: something broke" {
+		log.Fatalln("Plain error came back as", got.Code, got.Message)
+	}
+
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "metadata.errors.test.db",
+		BlockSize:         20000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	startDataNode(t, datanode.Config{
+		Listener:          dnListener,
+		LeaderAddress:     mdnClusterListener.Addr().String(),
+		DataDir:           "_data_errors",
+		HeartbeatInterval: 1 * time.Second,
+	})
+	time.Sleep(2 * time.Second)
+
+	expected := make([]byte, 30*1000)
+	for i := range expected {
+		expected[i] = byte(rand.Intn(256))
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+	dnAddress := dnListener.Addr().String()
+	blobID := mustUpload(upload.Config{LeaderAddress: leaderAddress}, bytes.NewReader(expected))
+
+	var blocks []BlockInfo
+	err = CallLeader(leaderAddress, false, "GetBlobInfo", "no-such-blob", &blocks)
+	if ErrorCodeOf(err) != NotFound || IsRetryable(err) {
+		log.Fatalln("Missing blob ->", err)
+	}
+	var ok string
+	if err := CallLeader(leaderAddress, false, "Frobnicate", nil, &ok); ErrorCodeOf(err) != Unsupported {
+		log.Fatalln("Unknown method ->", err)
+	}
+	if _, err := upload.OpenForAppend(upload.Config{LeaderAddress: leaderAddress}, "no-such-blob"); ErrorCodeOf(err) != NotFound {
+		log.Fatalln("Appending to a missing blob ->", err)
+	}
+	if err := CallLeader(leaderAddress, false, "GetBlobInfo", blobID, &blocks); err != nil {
+		log.Fatal(err)
+	}
+
+	// DataNodes send codes too
+	buf := make([]byte, 100)
+	err = ReadBlockRange(context.Background(), dnAddress, blocks[0].BlockID, 1<<30, buf, nil, false)
+	if e, _ := AsError(err); e == nil || e.Code != InvalidArgument || e.Details["size"] != "20000" {
+		log.Fatalln("Reading past the end of a block ->", err)
+	}
+	err = ReadBlockRange(context.Background(), dnAddress, "no-such-block", 0, buf, nil, false)
+	if ErrorCodeOf(err) != Retryable || !IsRetryable(err) {
+		log.Fatalln("Reading a block the DataNode doesn't have ->", err)
+	}
+
+	// and nodes that can't be reached are worth another try
+	closed, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	closed.Close()
+	_, err = DialTransfer(closed.Addr().String(), false)
+	if err == nil || ErrorCodeOf(err) != Unknown || !IsRetryable(err) {
+		log.Fatalln("Dialing nothing ->", err)
+	}
+	for _, err := range []error{context.Canceled, context.DeadlineExceeded, fmt.Errorf("Reading: %w", context.Canceled)} {
+		if IsRetryable(err) {
+			log.Fatalln("Calls that were given up on aren't worth retrying:", err)
+		}
+	}
+	if !IsRetryable(os.ErrDeadlineExceeded) {
+		log.Fatalln("Peers that are too slow are worth retrying")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	scratch(t, "metadata.retries.test.db*", "_data_retries")
+	policy := RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.5}
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		if wait := policy.Wait(attempt); wait < want/2 || wait > want {
+			log.Fatalln("Waited", wait, "after attempt", attempt)
+		}
+	}
+
+	policy = RetryPolicy{MaxAttempts: 4, Backoff: time.Millisecond, Jitter: 0.5}
+	calls := 0
+	err := policy.Do(context.Background(), "flaky.test", func() error {
+		if calls++; calls < 3 {
+			return NewError(Retryable, "Not yet")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		log.Fatalln("Took", calls, "calls ->", err)
+	}
+	calls = 0
+	err = policy.Do(context.Background(), "denied.test", func() error {
+		calls++
+		return NewError(PermissionDenied, "No")
+	})
+	if ErrorCodeOf(err) != PermissionDenied || calls != 1 {
+		log.Fatalln("Retried", calls, "times after", err)
+	}
+	policy.Retryable = Always
+	calls = 0
+	err = policy.Do(context.Background(), "denied.test", func() error {
+		calls++
+		return NewError(PermissionDenied, "No")
+	})
+	if err == nil || calls != 4 {
+		log.Fatalln("Gave up after", calls, "calls")
+	}
+	stats := map[string]RetryStat{}
+	for _, stat := range RetryStats() {
+		stats[stat.Target] = stat
+	}
+	if flaky := stats["flaky.test"]; flaky.Attempts != 3 || flaky.Failures != 2 || flaky.GaveUp != 0 {
+		log.Fatalln("Flaky peer's stats:", flaky)
+	}
+	if denied := stats["denied.test"]; denied.Attempts != 5 || denied.GaveUp != 2 || denied.LastError != "No" {
+		log.Fatalln("Denying peer's stats:", denied)
+	}
+	// Policies that never give up stop when they're cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	policy = RetryPolicy{Backoff: 10 * time.Millisecond}
+	if err := policy.Do(ctx, "", func() error { return errors.New("Down") }); err == nil {
+		log.Fatalln("Retried forever")
+	}
+
+	// DataNodes keep trying to register until the leader turns up
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	clusterAddress := mdnClusterListener.Addr().String()
+	mdnClusterListener.Close()
+	dnListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	startDataNode(t, datanode.Config{
+		Listener:          dnListener,
+		LeaderAddress:     clusterAddress,
+		DataDir:           "_data_retries",
+		HeartbeatInterval: 300 * time.Millisecond,
+	})
+	time.Sleep(1500 * time.Millisecond)
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if mdnClusterListener, err = net.Listen("tcp", clusterAddress); err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "metadata.retries.test.db",
+		BlockSize:         20000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+
+	expected := make([]byte, 30*1000)
+	for i := range expected {
+		expected[i] = byte(rand.Intn(256))
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+	blobID := mustUpload(upload.Config{LeaderAddress: leaderAddress}, bytes.NewReader(expected))
+	checkRanges(leaderAddress, blobID, expected)
+
+	// and the failures show up in its stats
+	dnStats, err := upload.DataNodeRetries(upload.Config{LeaderAddress: leaderAddress}, dnListener.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	var leader *RetryStat
+	for i := range dnStats {
+		if dnStats[i].Target == clusterAddress {
+			leader = &dnStats[i]
+		}
+	}
+	if leader == nil || leader.Failures < 2 || leader.Attempts <= leader.Failures {
+		log.Fatalln("Leader's stats:", dnStats)
+	}
+}
+
+func TestPeerFailures(t *testing.T) {
+	scratch(t, "metadata.failures.test.db*", "_data_failures")
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata.failures.test.db",
+		BlockSize:         20000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+	clusterAddress := mdnClusterListener.Addr().String()
+	dnListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnAddress := dnListener.Addr().String()
+	startDataNode(t, datanode.Config{
+		Listener:          dnListener,
+		LeaderAddress:     clusterAddress,
+		DataDir:           "_data_failures",
+		HeartbeatInterval: 300 * time.Millisecond,
+	})
+	time.Sleep(time.Second)
+
+	expected := make([]byte, 30*1000)
+	for i := range expected {
+		expected[i] = byte(rand.Intn(256))
+	}
+	blobID := mustUpload(upload.Config{LeaderAddress: leaderAddress}, bytes.NewReader(expected))
+	checkRanges(leaderAddress, blobID, expected)
+
+	// Everything here connects from the same host, so only what's new counts
+	failuresOf := func(failures []PeerFailure, err error) int64 {
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, failure := range failures {
+			if failure.Peer == "::1" {
+				return failure.Failures
+			}
+		}
+		return 0
+	}
+	leaderFailures := func() int64 {
+		return failuresOf(upload.LeaderPeerFailures(upload.Config{LeaderAddress: leaderAddress}))
+	}
+	dnFailures := func() int64 {
+		return failuresOf(upload.DataNodePeerFailures(upload.Config{LeaderAddress: leaderAddress}, dnAddress))
+	}
+	leaderBefore, dnBefore := leaderFailures(), dnFailures()
+
+	// A client that doesn't speak the protocol
+	for _, addr := range []string{leaderAddress, dnAddress} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+
+	// A client that hangs up halfway through a blob
+	client, err := DialLeader(leaderAddress, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var abandoned string
+	if err := client.Call("CreateBlob", CreateBlob{}, &abandoned); err != nil {
+		log.Fatal(err)
+	}
+	var forward ForwardBlock
+	if err := client.Call("Append", nil, &forward); err != nil {
+		log.Fatal(err)
+	}
+	client.Close()
+
+	// and one that hangs up halfway through sending the block
+	dataNode, err := DialTransfer(dnAddress, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := dataNode.Call("Forward", &ForwardBlock{forward.BlockID, nil, 1000, forward.Token}, nil); err != nil {
+		log.Fatal(err)
+	}
+	dataNode.Close()
+
+	// A DataNode that goes before the leader can answer its heartbeat
+	leader, err := DialRPC(clusterAddress, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var fakeID NodeID
+	if err := leader.Call("Register", &RegistrationMsg{"[::1]:1", nil, "", LocalVersion()}, &fakeID); err != nil {
+		log.Fatal(err)
+	}
+	leader.Go("Heartbeat", HeartbeatMsg{fakeID, 0, nil, nil}, &HeartbeatResponse{}, nil)
+	leader.Close()
+
+	// A DataNode that takes blocks and hangs up on them. The real one's told
+	// to copy the blob there, since it's the only copy.
+	broken, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer broken.Close()
+	go func() {
+		for {
+			conn, err := broken.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if peer, err := AcceptTransfer(conn, false); err == nil {
+					peer.ReadHeader()
+				}
+			}()
+		}
+	}()
+	brokenAddress := broken.Addr().String()
+	var brokenID NodeID
+	if err := CallPeer(clusterAddress, false, "Register", &RegistrationMsg{brokenAddress, nil, "", LocalVersion()}, &brokenID); err != nil {
+		log.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(300 * time.Millisecond):
+			}
+			var resp HeartbeatResponse
+			CallPeer(clusterAddress, false, "Heartbeat", HeartbeatMsg{brokenID, 0, nil, nil}, &resp)
+		}
+	}()
+	// It's tried three times before it's left for the leader to ask again
+	var failed int64
+	for deadline := time.Now().Add(20 * time.Second); failed < 3 && time.Now().Before(deadline); {
+		time.Sleep(500 * time.Millisecond)
+		stats, err := upload.DataNodeRetries(upload.Config{LeaderAddress: leaderAddress}, dnAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, stat := range stats {
+			if stat.Target == brokenAddress {
+				failed = stat.Failures
+			}
+		}
+	}
+	if failed < 3 {
+		log.Fatalln("DataNode only tried the broken one", failed, "times")
+	}
+
+	// Everyone's still up, and knows who broke
+	checkRanges(leaderAddress, blobID, expected)
+	blobID = mustUpload(upload.Config{LeaderAddress: leaderAddress}, bytes.NewReader(expected))
+	checkRanges(leaderAddress, blobID, expected)
+	if n := leaderFailures() - leaderBefore; n < 2 {
+		log.Fatalln("Leader counted", n, "failures")
+	}
+	if n := dnFailures() - dnBefore; n < 2 {
+		log.Fatalln("DataNode counted", n, "failures")
+	}
+}
+
+func TestBlockScanner(t *testing.T) {
+	scratch(t, "_data_scanner")
+	store := datanode.BlockStore{DataDir: "_data_scanner"}
+	for _, dir := range []string{store.BlocksDirectory(), store.MetaDirectory()} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var blocks []BlockID
+	for i := 0; i < 100; i++ {
+		block := BlockID(fmt.Sprintf("scanner:%03d", i))
+		data := make([]byte, 1000)
+		rand.Read(data)
+		checksum, err := store.WriteBlock(block, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			log.Fatal(err)
+		}
+		// One before where the last run got to, and one after
+		if i == 10 || i == 99 {
+			checksum = "corrupt"
+		}
+		if err := store.WriteChecksum(block, checksum); err != nil {
+			log.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+	// A DataNode that stopped half way through a pass
+	cursor, err := json.Marshal(map[string]interface{}{
+		"PeriodStart":   time.Now(),
+		"LastBlock":     blocks[49],
+		"BlocksScanned": 50,
+		"BytesScanned":  50 * 1000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("_data_scanner/scanner.json", cursor, 0666); err != nil {
+		log.Fatal(err)
+	}
+
+	// It comes back without a leader, which doesn't stop it scanning
+	gone, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	gone.Close()
+	dnListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	start := time.Now()
+	dn := startDataNode(t, datanode.Config{
+		Listener:           dnListener,
+		LeaderAddress:      gone.Addr().String(),
+		DataDir:            "_data_scanner",
+		HeartbeatInterval:  time.Second,
+		ScanBytesPerSecond: 10 * 1000,
+		ScanPeriod:         time.Hour,
+	})
+
+	// Once it's listed the blocks for the pass, prioritized blocks go ahead
+	// of it
+	for deadline := time.Now().Add(2 * time.Second); dn.Scanner.Progress().BlocksTotal == 0; {
+		if time.Now().After(deadline) {
+			log.Fatalln("Blocks weren't listed:", dn.Scanner.Progress())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dn.Scanner.Prioritize(blocks[99])
+	for deadline := time.Now().Add(2 * time.Second); dn.Scanner.Progress().Corrupt == 0; {
+		if time.Now().After(deadline) {
+			log.Fatalln("Prioritized block wasn't scanned:", dn.Scanner.Progress())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if progress := dn.Scanner.Progress(); progress.LastBlock >= blocks[60] {
+		log.Fatalln("Prioritized block was only scanned after", progress.LastBlock)
+	}
+
+	// The pass carries on from the cursor, at no more than the rate
+	var progress ScanProgress
+	for deadline := time.Now().Add(20 * time.Second); ; {
+		if progress = dn.Scanner.Progress(); progress.LastFinished.After(start) {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Fatalln("Scan didn't finish:", progress)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 4*time.Second {
+		log.Fatalln("Scanned 50 blocks of 1000 bytes at 10000 bytes/s in", elapsed)
+	}
+	if progress.BlocksScanned != 100 || progress.BlocksTotal != 100 || progress.Corrupt != 1 {
+		log.Fatalln("Scan progress:", progress)
+	}
+	if _, err := os.Stat(store.BlockFilename(blocks[10])); err != nil {
+		log.Fatalln("Block before the cursor was scanned:", err)
+	}
+	if _, err := os.Stat(store.BlockFilename(blocks[99])); !os.IsNotExist(err) {
+		log.Fatalln("Corrupt block wasn't removed:", err)
+	}
+}
+
+// Writes malformed packets onto a DataNode's port. Each should get the
+// connection closed, rather than the DataNode waiting for more or falling
+// over.
+func TestTransferFraming(t *testing.T) {
+	scratch(t, "_data_framing")
+	gone, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	gone.Close()
+	dnListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	startDataNode(t, datanode.Config{
+		Listener:          dnListener,
+		LeaderAddress:     gone.Addr().String(),
+		DataDir:           "_data_framing",
+		HeartbeatInterval: time.Second,
+	})
+	dnAddress := dnListener.Addr().String()
+
+	// Packet types, as in common/transfer.go
+	const request, data = 1, 3
+	packet := func(kind uint8, seq uint64, payload []byte) []byte {
+		header := make([]byte, 17)
+		header[0] = kind
+		binary.BigEndian.PutUint64(header[1:], seq)
+		binary.BigEndian.PutUint32(header[9:], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[13:], crc32.ChecksumIEEE(payload))
+		return append(header, payload...)
+	}
+	call := func(method string, body interface{}) []byte {
+		b, err := json.Marshal(map[string]interface{}{"Method": method, "Body": body})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return packet(request, 0, b)
+	}
+	handshake := append([]byte("DFSX"), 1)
+	block := BlockID("framing:block")
+	forward := call("Forward", ForwardBlock{block, nil, 2 * PacketSize, nil})
+
+	oversized := packet(request, 0, nil)
+	binary.BigEndian.PutUint32(oversized[9:], 64*1024*1024)
+	truncated := call("Ping", nil)
+	truncated = truncated[:len(truncated)-3]
+	corrupted := call("Ping", nil)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	for name, sent := range map[string][]byte{
+		"bad magic":       []byte("GET / HTTP/1.0\r\n\r\n"),
+		"no version":      append([]byte("DFSX"), 0),
+		"oversized":       append(handshake, oversized...),
+		"truncated":       append(handshake, truncated...),
+		"bad checksum":    append(handshake, corrupted...),
+		"out of sequence": append(append(handshake, forward...), packet(data, 1, make([]byte, PacketSize))...),
+	} {
+		conn, err := net.Dial("tcp", dnAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := conn.Write(sent); err != nil {
+			log.Fatalln(name, "->", err)
+		}
+		// The rest of a truncated packet is never coming. Anything else
+		// the DataNode should notice by itself.
+		if name == "truncated" {
+			conn.(*net.TCPConn).CloseWrite()
+		}
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := ioutil.ReadAll(conn); IsTimeout(err) {
+			log.Fatalln("DataNode kept the connection open after", name)
+		}
+		conn.Close()
+	}
+	if _, err := os.Stat("_data_framing/blocks/" + string(block)); !os.IsNotExist(err) {
+		log.Fatalln("Block sent out of sequence was kept:", err)
+	}
+
+	// and it's still there for clients that get it right
+	dataNode, err := DialTransfer(dnAddress, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dataNode.Close()
+	var ok string
+	if err := dataNode.Call("Ping", nil, &ok); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Removes what the test leaves on disk, before it starts in case an earlier
+// run didn't get to, and again once it's done. Patterns are as in
+// filepath.Glob. Call it before starting DataNodes, so they're closed first.
+func scratch(t *testing.T, patterns ...string) {
+	clean := func() {
+		for _, pattern := range patterns {
+			paths, _ := filepath.Glob(pattern)
+			for _, path := range paths {
+				os.RemoveAll(path)
+			}
+		}
+	}
+	clean()
+	t.Cleanup(clean)
+}
+
+// A DataNode that's closed once the test is done
+func startDataNode(t *testing.T, conf datanode.Config) *datanode.DataNodeState {
+	dn, err := datanode.Create(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dn.Close()
+	})
+	return dn
+}
+
+// Registers a DataNode with the leader that's really handle, which gets
+// each connection made to it once it's shaken hands. It heartbeats until
+// stop is called.
+func fakeDataNode(clusterAddress string, handle func(*TransferConn)) (addr string, stop func()) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if peer, err := AcceptTransfer(conn, false); err == nil {
+					handle(peer)
+				}
+			}()
+		}
+	}()
+	addr = listener.Addr().String()
+	var nodeID NodeID
+	if err := CallPeer(clusterAddress, false, "Register", &RegistrationMsg{addr, nil, "", LocalVersion()}, &nodeID); err != nil {
+		log.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(300 * time.Millisecond):
+			}
+			var resp HeartbeatResponse
+			CallPeer(clusterAddress, false, "Heartbeat", HeartbeatMsg{nodeID, 0, nil, nil}, &resp)
+		}
+	}()
+	return addr, func() {
+		close(done)
+		listener.Close()
+	}
+}
+
+// A DataNode that takes part of each block and hangs up. Whoever's upstream
+// should report it, and uploads should find somewhere else for the block.
+func TestPipelineFailures(t *testing.T) {
+	scratch(t, "metadata.pipeline.test.db*", "_data_pipeline*")
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata.pipeline.test.db",
+		BlockSize:         20000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+	clusterAddress := mdnClusterListener.Addr().String()
+	var dnAddresses []string
+	for _, dataDir := range []string{"_data_pipeline1", "_data_pipeline2"} {
+		listener, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		startDataNode(t, datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     clusterAddress,
+			DataDir:           dataDir,
+			HeartbeatInterval: 300 * time.Millisecond,
+		})
+		dnAddresses = append(dnAddresses, listener.Addr().String())
+	}
+	// Never uses any space, so the leader puts it in every pipeline
+	brokenAddress, stop := fakeDataNode(clusterAddress, func(peer *TransferConn) {
+		if method, err := peer.ReadHeader(); err != nil || method != "Forward" {
+			return
+		}
+		peer.SendOkay()
+		io.ReadFull(peer.NewDataReader(true), make([]byte, 1000))
+	})
+	defer stop()
+	time.Sleep(time.Second)
+
+	// Sent by hand, the DataNode upstream of it says how it went
+	block := make([]byte, 5000)
+	rand.Read(block)
+	dataNode, err := DialTransfer(dnAddresses[0], false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = dataNode.Call("Forward", &ForwardBlock{"pipeline:block", []string{brokenAddress}, int64(len(block)), nil}, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := dataNode.SendBlock(bytes.NewReader(block), int64(len(block))); err != nil {
+		log.Fatal(err)
+	}
+	var statuses []ReplicaStatus
+	if err := dataNode.Call("Confirm", fmt.Sprint(crc32.ChecksumIEEE(block)), &statuses); err != nil {
+		log.Fatal(err)
+	}
+	dataNode.Close()
+	if len(statuses) != 2 || statuses[0] != (ReplicaStatus{dnAddresses[0], ""}) ||
+		statuses[1].Addr != brokenAddress || statuses[1].Error == "" {
+		log.Fatalln("Pipeline with a broken replica reported", statuses)
+	}
+
+	// Uploads go round it
+	expected := make([]byte, 50*1000)
+	rand.Read(expected)
+	blobID := mustUpload(upload.Config{LeaderAddress: leaderAddress}, bytes.NewReader(expected))
+	var brokenFailures int64
+	for _, stat := range RetryStats() {
+		if stat.Target == brokenAddress {
+			brokenFailures = stat.Failures
+		}
+	}
+	if brokenFailures == 0 {
+		log.Fatalln("Upload never tried the broken DataNode")
+	}
+	// Let the DataNodes tell the leader what they have
+	time.Sleep(time.Second)
+	sort.Strings(dnAddresses)
+	var blocks []BlockID
+	if err := CallLeader(leaderAddress, false, "GetBlob", blobID, &blocks); err != nil {
+		log.Fatal(err)
+	}
+	for _, b := range blocks {
+		var located LocatedBlock
+		if err := CallLeader(leaderAddress, false, "GetBlock", b, &located); err != nil {
+			log.Fatal(err)
+		}
+		sort.Strings(located.Nodes)
+		if fmt.Sprint(located.Nodes) != fmt.Sprint(dnAddresses) {
+			log.Fatalln("Block", b, "is on", located.Nodes, "rather than", dnAddresses)
+		}
+	}
+	checkRanges(leaderAddress, blobID, expected)
+}
+
+// When the DataNodes a block was given to die before taking it, the client
+// asks for another block somewhere else, and it mustn't land on them again.
+func TestReplacementBlocks(t *testing.T) {
+	scratch(t, "metadata.replacement.test.db*", "_data_replacement*")
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "metadata.replacement.test.db",
+		BlockSize:         20000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+	clusterAddress := mdnClusterListener.Addr().String()
+	listeners := map[string]net.Listener{}
+	for _, dataDir := range []string{"_data_replacement1", "_data_replacement2", "_data_replacement3"} {
+		listener, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		startDataNode(t, datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     clusterAddress,
+			DataDir:           dataDir,
+			HeartbeatInterval: 300 * time.Millisecond,
+		})
+		listeners[listener.Addr().String()] = listener
+	}
+	time.Sleep(time.Second)
+
+	client, err := DialLeader(leaderAddress, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	var blobID string
+	if err := client.Call("CreateBlob", CreateBlob{}, &blobID); err != nil {
+		log.Fatal(err)
+	}
+	var forward ForwardBlock
+	if err := client.Call("Append", nil, &forward); err != nil {
+		log.Fatal(err)
+	}
+	if len(forward.Nodes) != 2 {
+		log.Fatalln("Block went to", forward.Nodes)
+	}
+	// They stop taking connections, but still heartbeat, so the leader
+	// doesn't know they're gone
+	for _, addr := range forward.Nodes {
+		listeners[addr].Close()
+	}
+	var replacement ForwardBlock
+	if err := client.Call("AppendExcluding", &AppendExcluding{forward.BlockID, forward.Nodes}, &replacement); err != nil {
+		log.Fatal(err)
+	}
+	if replacement.BlockID == forward.BlockID || len(replacement.Nodes) != 1 {
+		log.Fatalln("Replacement for", forward, "was", replacement)
+	}
+	for _, addr := range forward.Nodes {
+		if replacement.Nodes[0] == addr {
+			log.Fatalln("Replacement block went to excluded DataNode", addr)
+		}
+	}
+	if _, ok := listeners[replacement.Nodes[0]]; !ok {
+		log.Fatalln("Replacement block went to unknown DataNode", replacement.Nodes[0])
+	}
+}
+
+// Blocks sent in parallel finish in whatever order they like, but the blob
+// has to come out in the order they were read.
+func TestParallelUpload(t *testing.T) {
+	scratch(t, "metadata.parallel.test.db*")
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "metadata.parallel.test.db",
+		BlockSize:         20000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	leaderAddress := mdnClientListener.Addr().String()
+
+	expected := make([]byte, 4*20000)
+	rand.Read(expected)
+	// The only DataNode, which keeps blocks in memory and holds on to the
+	// first one until the rest are done
+	var lock sync.Mutex
+	stored := map[BlockID][]byte{}
+	var finished []BlockID
+	var dnAddress string
+	addr, stop := fakeDataNode(mdnClusterListener.Addr().String(), func(peer *TransferConn) {
+		for {
+			method, err := peer.ReadHeader()
+			if err != nil {
+				return
+			}
+			switch method {
+			case "Ping":
+				peer.ReadBody(nil)
+				peer.SendOkay()
+			case "Forward":
+				var msg ForwardBlock
+				if err := peer.ReadBody(&msg); err != nil {
+					return
+				}
+				peer.SendOkay()
+				reader := peer.NewDataReader(true)
+				data, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return
+				}
+				if bytes.HasPrefix(expected, data) {
+					time.Sleep(time.Second)
+				}
+				if reader.Finish() != nil {
+					return
+				}
+				var checksum string
+				if method, err := peer.ReadHeader(); err != nil || method != "Confirm" || peer.ReadBody(&checksum) != nil {
+					return
+				}
+				lock.Lock()
+				stored[msg.BlockID] = data
+				finished = append(finished, msg.BlockID)
+				statuses := []ReplicaStatus{{dnAddress, ""}}
+				lock.Unlock()
+				peer.Send(&statuses)
+			default:
+				peer.Unacceptable()
+				return
+			}
+		}
+	})
+	defer stop()
+	lock.Lock()
+	dnAddress = addr
+	lock.Unlock()
+	time.Sleep(time.Second)
+
+	blobID := mustUpload(upload.Config{LeaderAddress: leaderAddress, Parallel: 4}, bytes.NewReader(expected))
+	var blocks []BlockID
+	if err := CallLeader(leaderAddress, false, "GetBlob", blobID, &blocks); err != nil {
+		log.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(finished) != 4 || finished[3] != blocks[0] {
+		log.Fatalln("First block didn't finish last:", finished, "committed as", blocks)
+	}
+	var actual []byte
+	for _, b := range blocks {
+		actual = append(actual, stored[b]...)
+	}
+	if !bytes.Equal(actual, expected) {
+		log.Fatalln("Blocks committed out of order:", blocks, "finished", finished)
+	}
+}
@@ -0,0 +1,191 @@
+package metadatanode
+
+import (
+	"log"
+
+	"golang-distributed-filesystem/auth"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Mode of new blobs that don't ask for one
+const defaultMode = 0640
+
+var errDenied = NewError(PermissionDenied, "Permission denied")
+
+// Who the client is, nil if it's anonymous
+func (self *MetaDataNodeState) Authenticate(credential string) (*Identity, error) {
+	if self.authenticator == nil {
+		return nil, NewError(Unsupported, "The leader doesn't authenticate clients")
+	}
+	return self.authenticator.Authenticate(credential)
+}
+
+// Permissions for a new blob, nil if clients don't authenticate. Anonymous
+// clients can't create anything.
+func (self *MetaDataNodeState) NewPermissions(id *Identity, msg CreateBlob) (*Permissions, error) {
+	if self.authenticator == nil {
+		return nil, nil
+	}
+	if id == nil {
+		return nil, NewError(PermissionDenied, "Log in to create blobs")
+	}
+	perms := &Permissions{Owner: id.User, Mode: msg.Mode, ACL: msg.ACL}
+	if len(id.Groups) > 0 {
+		perms.Group = id.Groups[0]
+	}
+	if perms.Mode == 0 {
+		perms.Mode = defaultMode
+	}
+	return perms, nil
+}
+
+// Whether the client may read (auth.Read) or change (auth.Write) the blob.
+// Everyone may do anything if clients don't authenticate, or to blobs from
+// before they did.
+func (self *MetaDataNodeState) Authorize(id *Identity, blobID string, want uint32) error {
+	if self.authenticator == nil {
+		return nil
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.authorize(id, blobID, want)
+}
+
+// Needs the lock
+func (self *MetaDataNodeState) authorize(id *Identity, blobID string, want uint32) error {
+	perms, err := self.store.Permissions(blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if perms != nil && !auth.Allows(perms, id, want) {
+		return errDenied
+	}
+	return nil
+}
+
+// Clients can find out where a block is if they can read a blob that uses
+// it
+func (self *MetaDataNodeState) AuthorizeBlock(id *Identity, block BlockID) error {
+	if self.authenticator == nil {
+		return nil
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.authorizeBlock(id, block)
+}
+
+// Needs the lock
+func (self *MetaDataNodeState) authorizeBlock(id *Identity, block BlockID) error {
+	if group, _, ok := SplitCellID(block); ok {
+		block = group
+	}
+	blobs, err := self.store.BlobsWith(block)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, blobID := range blobs {
+		if self.authorize(id, blobID, auth.Read) == nil {
+			return nil
+		}
+	}
+	return errDenied
+}
+
+// Managing keys, zones and DataNodes is up to the superuser
+func (self *MetaDataNodeState) AuthorizeAdmin(id *Identity) error {
+	if self.authenticator == nil || (id != nil && id.User == auth.Superuser) {
+		return nil
+	}
+	return errDenied
+}
+
+// Only the owner can change a blob's permissions, and only the superuser
+// can give it away or change blobs from before clients authenticated
+func (self *MetaDataNodeState) SetPermissions(id *Identity, msg BlobPermissions) error {
+	if self.authenticator == nil {
+		return NewError(Unsupported, "The leader doesn't authenticate clients")
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	blocks, err := self.store.Get(msg.BlobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(blocks) == 0 && self.leases[msg.BlobID] == nil {
+		return NewError(NotFound, "No blob '"+msg.BlobID+"'")
+	}
+	perms, err := self.store.Permissions(msg.BlobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	superuser := id != nil && id.User == auth.Superuser
+	if !superuser {
+		if id == nil || perms == nil || perms.Owner != id.User {
+			return errDenied
+		}
+		if msg.Permissions.Owner != "" && msg.Permissions.Owner != perms.Owner {
+			return errDenied
+		}
+	}
+	if msg.Permissions.Owner == "" {
+		if perms == nil {
+			return NewError(InvalidArgument, "The blob needs an owner")
+		}
+		msg.Permissions.Owner = perms.Owner
+	}
+	if msg.Permissions.Group == "" && perms != nil {
+		msg.Permissions.Group = perms.Group
+	}
+	if err := self.store.SetPermissions(msg.BlobID, msg.Permissions); err != nil {
+		log.Fatalln(err)
+	}
+	return nil
+}
+
+// Lets the client do mode to the block, nil if DataNodes don't check
+func (self *MetaDataNodeState) BlockToken(block BlockID, mode uint32) *BlockToken {
+	if !self.blockTokens {
+		return nil
+	}
+	self.rollBlockKeys()
+	return self.blockKeys.Sign(block, mode, self.blockTokenLifetime)
+}
+
+// For DataNodes to check block tokens with
+func (self *MetaDataNodeState) BlockKeys() []BlockKey {
+	if !self.blockTokens {
+		return nil
+	}
+	return self.rollBlockKeys()
+}
+
+// New keys are saved, so tokens handed out still work after a restart.
+// Doesn't need the lock.
+func (self *MetaDataNodeState) rollBlockKeys() []BlockKey {
+	keys, made := self.blockKeys.Roll(self.blockTokenLifetime, self.blockTokenLifetime)
+	if made {
+		if err := self.store.SetBlockKeys(keys); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return keys
+}
+
+// Committed blobs the client can read
+func (self *MetaDataNodeState) ListBlobs(id *Identity) []string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	blobs, err := self.store.Blobs()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// Clients take a null reply as an error
+	readable := []string{}
+	for _, blobID := range blobs {
+		if self.authenticator == nil || self.authorize(id, blobID, auth.Read) == nil {
+			readable = append(readable, blobID)
+		}
+	}
+	return readable
+}
@@ -1,88 +1,513 @@
 package metadatanode
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log"
 	"net"
 
+	"golang-distributed-filesystem/auth"
+	"golang-distributed-filesystem/codec"
+
 	. "golang-distributed-filesystem/common"
 )
 
 func runClientRPC(c net.Conn, mdn *MetaDataNodeState) {
-	server := NewRPCServer(c)
 	defer c.Close()
-
-	var method string
-	method, err := server.ReadHeader()
+	server, err := AcceptRPC(c)
 	if err != nil {
-		log.Println(err)
+		PeerFailed(c.RemoteAddr(), err)
 		return
 	}
+	// Done once the client's gone, so calls still waiting to be answered
+	// don't bother
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Clients with credentials start with them, and anyone else is anonymous
+	var identity *Identity
+	calls := make(chan bool, MaxConcurrentCalls)
+	for {
+		method, call, err := server.ReadCall()
+		if err != nil {
+			if IsTimeout(err) {
+				log.Println("Client", c.RemoteAddr(), "was idle too long")
+			} else if err != io.EOF {
+				PeerFailed(c.RemoteAddr(), err)
+			}
+			return
+		}
+		switch method {
+		case "Authenticate":
+			var credential string
+			if err := call.ReadBody(&credential); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return
+			}
+			if identity, err = mdn.Authenticate(credential); err != nil {
+				log.Println("Client", c.RemoteAddr(), "failed to authenticate:", err)
+				call.Error(err)
+				return
+			}
+			call.Send(identity)
+
+		case "CreateBlob", "ResumeBlob", "OpenForAppend":
+			// The connection is the blob's until it's committed
+			if !runClientCall(ctx, c, call, method, mdn, identity) {
+				return
+			}
+
+		default:
+			calls <- true
+			go func(identity *Identity) {
+				defer func() { <-calls }()
+				if ctx.Err() != nil {
+					return
+				}
+				if !runClientCall(ctx, c, call, method, mdn, identity) {
+					c.Close()
+				}
+			}(identity)
+		}
+	}
+}
+
+// Answers one call, returning false if the connection can't be used for
+// any more
+func runClientCall(ctx context.Context, c net.Conn, server *RPCServer, method string, mdn *MetaDataNodeState, identity *Identity) bool {
+	// Answers the client and says whether it may go on
+	allowed := func(err error) bool {
+		if err != nil {
+			server.Error(err)
+		}
+		return err == nil
+	}
 	switch method {
 	case "CreateBlob":
-		if err := server.ReadBody(nil); err != nil {
-			// TODO: Fatal bc I want to see if passing nil fails
-			log.Fatalln(err)
-			return
+		// Older clients send nothing, and get a replicated blob
+		var msg CreateBlob
+		if err := server.ReadBody(&msg); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		policy, err := ParsePolicy(msg.Policy)
+		if err != nil {
+			server.Error(err)
+			return true
+		}
+		if _, err := codec.Get(msg.Codec); err != nil {
+			server.Error(err)
+			return true
+		}
+		perms, err := mdn.NewPermissions(identity, msg)
+		if err != nil {
+			server.Error(err)
+			return true
+		}
+		key, err := mdn.NewBlobKey(ctx, msg.Encrypted, msg.Zone)
+		if err != nil {
+			server.Error(err)
+			return true
 		}
 		blobID := mdn.GenerateBlobId()
+		mdn.OpenLease(blobID, policy, msg.Codec, key, perms)
 		server.Send(&blobID)
-		var blocks []BlockID
+		return runBlobSession(c, server, mdn, identity, blobID)
 
-		for {
-			method, err = server.ReadHeader()
-			if err != nil {
-				// TODO: Handle this better: remove blob, blocks?
-				log.Fatalln(err)
-				return
-			}
-			switch method {
-			case "Append":
-				forwardBlock := mdn.GenerateBlock(blobID)
-				blocks = append(blocks, forwardBlock.BlockID)
-				server.Send(&forwardBlock)
+	case "ResumeBlob":
+		var msg ResumeBlob
+		if err := server.ReadBody(&msg); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.Authorize(identity, msg.BlobID, auth.Write)) {
+			return true
+		}
+		replicated, err := mdn.ResumeLease(identity, msg)
+		if err != nil {
+			server.Error(err)
+			return true
+		}
+		log.Println("Resuming blob '"+msg.BlobID+"' for", c.RemoteAddr())
+		server.Send(&replicated)
+		return runBlobSession(c, server, mdn, identity, msg.BlobID)
 
-			case "Commit":
-				mdn.CommitBlob(blobID, blocks)
-				log.Println("Committed blob '"+blobID+"' for", c.RemoteAddr())
-				server.SendOkay()
-				return
+	case "OpenForAppend":
+		var blobID string
+		if err := server.ReadBody(&blobID); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.Authorize(identity, blobID, auth.Write)) {
+			return true
+		}
+		opened, err := mdn.OpenForAppend(blobID)
+		if err != nil {
+			server.Error(err)
+			return true
+		}
+		log.Println("Appending to blob '"+blobID+"' for", c.RemoteAddr())
+		server.Send(&opened)
+		return runBlobSession(c, server, mdn, identity, blobID)
 
-			default:
-				server.Unacceptable()
-			}
+	case "DeleteBlob":
+		var blobID string
+		if err := server.ReadBody(&blobID); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.Authorize(identity, blobID, auth.Write)) {
+			return true
+		}
+		if err := mdn.DeleteBlob(blobID); err != nil {
+			server.Error(err)
+			return true
 		}
+		log.Println("Deleted blob '"+blobID+"' for", c.RemoteAddr())
+		server.SendOkay()
 
 	case "GetBlob":
 		var blobID string
 		if err := server.ReadBody(&blobID); err != nil {
-			log.Println(err)
-			return
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.Authorize(identity, blobID, auth.Read)) {
+			return true
 		}
 		blocks := mdn.GetBlob(blobID)
+		if len(blocks) == 0 {
+			server.Error(NewError(NotFound, "No blob '"+blobID+"'"))
+			return true
+		}
 		server.Send(&blocks)
 
+	case "GetBlobInfo":
+		var blobID string
+		if err := server.ReadBody(&blobID); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.Authorize(identity, blobID, auth.Read)) {
+			return true
+		}
+		blocks := mdn.GetBlobInfo(blobID)
+		if len(blocks) == 0 {
+			server.Error(NewError(NotFound, "No blob '"+blobID+"'"))
+			return true
+		}
+		mdn.Touch(blobID)
+		server.Send(&blocks)
+
+	case "GetBlobPolicy":
+		var blobID string
+		if err := server.ReadBody(&blobID); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.Authorize(identity, blobID, auth.Read)) {
+			return true
+		}
+		policy := mdn.GetBlobPolicy(blobID)
+		server.Send(&policy)
+
+	case "GetBlobCodec":
+		var blobID string
+		if err := server.ReadBody(&blobID); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.Authorize(identity, blobID, auth.Read)) {
+			return true
+		}
+		name := mdn.GetBlobCodec(blobID)
+		server.Send(&name)
+
+	case "GetBlobKey":
+		var blobID string
+		if err := server.ReadBody(&blobID); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.Authorize(identity, blobID, auth.Read)) {
+			return true
+		}
+		key, err := mdn.GetBlobKey(ctx, blobID, c.RemoteAddr())
+		if err != nil {
+			server.Error(err)
+			return true
+		}
+		// Clients take a null reply as an error
+		if key == nil {
+			key = []byte{}
+		}
+		server.Send(&key)
+
+	case "CreateZone":
+		var zone EncryptionZone
+		if err := server.ReadBody(&zone); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.AuthorizeAdmin(identity)) {
+			return true
+		}
+		if err := mdn.CreateZone(ctx, zone, c.RemoteAddr()); err != nil {
+			server.Error(err)
+			return true
+		}
+		server.SendOkay()
+
+	case "Rekey":
+		var keyName string
+		if err := server.ReadBody(&keyName); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.AuthorizeAdmin(identity)) {
+			return true
+		}
+		rewrapped, err := mdn.Rekey(ctx, keyName, c.RemoteAddr())
+		if err != nil {
+			server.Error(err)
+			return true
+		}
+		server.Send(&rewrapped)
+
+	case "KeyAudit":
+		if err := server.ReadBody(nil); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.AuthorizeAdmin(identity)) {
+			return true
+		}
+		uses, err := mdn.KeyAudit(ctx)
+		if err != nil {
+			server.Error(err)
+			return true
+		}
+		server.Send(&uses)
+
 	case "GetBlock":
 		var blockID BlockID
 		if err := server.ReadBody(&blockID); err != nil {
-			log.Println(err)
-			return
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.AuthorizeBlock(identity, blockID)) {
+			return true
+		}
+		located := LocatedBlock{mdn.GetBlock(blockID), mdn.BlockToken(blockID, auth.Read)}
+		server.Send(&located)
+
+	case "RefreshNodes":
+		if err := server.ReadBody(nil); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.AuthorizeAdmin(identity)) {
+			return true
+		}
+		if err := mdn.RefreshNodes(); err != nil {
+			server.Error(err)
+			return true
+		}
+		server.SendOkay()
+
+	case "PeerFailures":
+		if err := server.ReadBody(nil); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.AuthorizeAdmin(identity)) {
+			return true
+		}
+		failures := PeerFailures()
+		server.Send(&failures)
+
+	case "StatsToken":
+		if err := server.ReadBody(nil); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.AuthorizeAdmin(identity)) {
+			return true
+		}
+		// Empty rather than null when DataNodes don't check tokens, since
+		// clients take a null reply as an error
+		token := mdn.BlockToken(auth.StatsBlock, auth.Read)
+		if token == nil {
+			token = &BlockToken{}
+		}
+		server.Send(token)
+
+	case "ListBlobs":
+		if err := server.ReadBody(nil); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		blobs := mdn.ListBlobs(identity)
+		server.Send(&blobs)
+
+	case "SetPermissions":
+		var msg BlobPermissions
+		if err := server.ReadBody(&msg); err != nil {
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		if !allowed(mdn.SetPermissions(identity, msg)) {
+			return true
 		}
-		nodes := mdn.GetBlock(blockID)
-		server.Send(&nodes)
+		server.SendOkay()
+
+	case "Ping":
+		server.SendOkay()
 
 	default:
 		log.Println("Unacceptable:", method)
 		server.Unacceptable()
 	}
+	return true
 }
 
-func (self *MetaDataNodeState) ClientRPCServer(sock net.Listener) {
-	log.Println("Accepting client connections on", sock.Addr())
+// Appends and commits for a blob being written. The blob's lease keeps track
+// of the blocks handed out, so the client can drop the connection and pick
+// up again with ResumeBlob. Once the blob is committed the connection can be
+// used for other calls again.
+func runBlobSession(c net.Conn, server *RPCServer, mdn *MetaDataNodeState, identity *Identity, blobID string) bool {
+	policy := mdn.LeasePolicy(blobID)
+
+	// Checks the block was handed out for this blob and answers the client
+	// if it wasn't. Internal blocks count as their group.
+	issued := func(block BlockID) bool {
+		if group, _, ok := SplitCellID(block); ok && policy != nil {
+			block = group
+		}
+		ok, err := mdn.LeaseHas(blobID, block)
+		switch {
+		case err != nil:
+			server.Error(err)
+		case !ok:
+			server.Error(NewError(InvalidArgument, "Block '"+string(block)+"' isn't part of this blob"))
+		}
+		return ok
+	}
+	generate := func(exclude []string, replaces BlockID) {
+		var forwardBlock ForwardBlock
+		var err error
+		if policy != nil {
+			forwardBlock, err = mdn.GenerateGroup(blobID, *policy, exclude)
+		} else {
+			forwardBlock, err = mdn.GenerateBlock(blobID, exclude)
+		}
+		if err != nil {
+			server.Error(err)
+			return
+		}
+		if err := mdn.IssueBlock(blobID, forwardBlock.BlockID, replaces); err != nil {
+			mdn.AbandonBlock(forwardBlock.BlockID)
+			server.Error(err)
+			return
+		}
+		forwardBlock.Token = mdn.BlockToken(forwardBlock.BlockID, auth.Write)
+		server.Send(&forwardBlock)
+	}
+
 	for {
-		client, err := sock.Accept()
+		method, err := server.ReadHeader()
 		if err != nil {
-			log.Fatal(err)
+			// The lease lives on; the client can resume or let it expire
+			PeerFailed(c.RemoteAddr(), fmt.Errorf("Left blob '%s' unfinished: %v", blobID, err))
+			if IsTimeout(err) {
+				mdn.AbandonLease(blobID)
+			}
+			return false
+		}
+		switch method {
+		case "Append":
+			if err := server.ReadBody(nil); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return false
+			}
+			generate(nil, "")
+
+		case "AppendExcluding":
+			var msg AppendExcluding
+			if err := server.ReadBody(&msg); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return false
+			}
+			if !issued(msg.Abandon) {
+				continue
+			}
+			mdn.AbandonBlock(msg.Abandon)
+			generate(msg.Exclude, msg.Abandon)
+
+		case "Dedup":
+			var msg DedupBlock
+			if err := server.ReadBody(&msg); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return false
+			}
+			existing, err := mdn.Dedup(identity, blobID, msg)
+			if err != nil {
+				server.Error(err)
+				continue
+			}
+			server.Send(&existing)
+
+		case "ReplaceNodes":
+			var msg ReplaceNodes
+			if err := server.ReadBody(&msg); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return false
+			}
+			if !issued(msg.BlockID) {
+				continue
+			}
+			addrs := mdn.ReplacementNodes(msg)
+			server.Send(&addrs)
+
+		case "Flush", "Commit":
+			// The client says what order the blocks go in and how big they
+			// turned out to be. Flushing makes that visible to readers but
+			// keeps the blob open.
+			var blocks []BlockInfo
+			if err := server.ReadBody(&blocks); err != nil {
+				PeerFailed(c.RemoteAddr(), err)
+				return false
+			}
+			ok := true
+			for _, b := range blocks {
+				if ok = issued(b.BlockID); !ok {
+					break
+				}
+			}
+			if !ok {
+				continue
+			}
+			mdn.CommitBlob(blobID, blocks)
+			if method == "Flush" {
+				server.SendOkay()
+				continue
+			}
+			// Anything it was given but didn't use goes
+			mdn.ReleaseLease(blobID, blocks)
+			log.Println("Committed blob '"+blobID+"' for", c.RemoteAddr())
+			server.SendOkay()
+			return true
+
+		default:
+			server.Unacceptable()
 		}
-		go runClientRPC(client, self)
 	}
 }
+
+func (self *MetaDataNodeState) ClientRPCServer(sock net.Listener) {
+	log.Println("Accepting client connections on", sock.Addr())
+	AcceptLoop(sock, func(client net.Conn) {
+		runClientRPC(client, self)
+	})
+}
@@ -1,6 +1,8 @@
 package metadatanode
 
 import (
+	"context"
+	"io"
 	"log"
 	"net"
 
@@ -8,38 +10,75 @@ import (
 )
 
 func runClusterRPC(c net.Conn, mdn *MetaDataNodeState) {
-	server := NewRPCServer(c)
 	defer c.Close()
-
-	var method string
-	method, err := server.ReadHeader()
+	server, err := AcceptRPC(c)
 	if err != nil {
-		log.Println(err)
+		PeerFailed(c.RemoteAddr(), err)
 		return
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := make(chan bool, MaxConcurrentCalls)
+	for {
+		method, call, err := server.ReadCall()
+		if err != nil {
+			if IsTimeout(err) {
+				log.Println("Peer", c.RemoteAddr(), "was idle too long")
+			} else if err != io.EOF {
+				PeerFailed(c.RemoteAddr(), err)
+			}
+			return
+		}
+		calls <- true
+		go func() {
+			defer func() { <-calls }()
+			if ctx.Err() != nil {
+				return
+			}
+			if !runClusterCall(c, call, method, mdn) {
+				c.Close()
+			}
+		}()
+	}
+}
+
+// Answers one call from a DataNode, returning false if the connection can't
+// be used for any more
+func runClusterCall(c net.Conn, server *RPCServer, method string, mdn *MetaDataNodeState) bool {
 	switch method {
 	case "Register":
 		var reg RegistrationMsg
 		if err := server.ReadBody(&reg); err != nil {
-			log.Println(err)
-			return
+			PeerFailed(c.RemoteAddr(), err)
+			return false
+		}
+		addr, err := mdn.AdmitDataNode(c, reg)
+		if err != nil {
+			log.Println("Refused to register DataNode at", reg.Addr, "from", c.RemoteAddr(), "->", err)
+			server.Error(err)
+			return true
 		}
-		nodeID := mdn.RegisterDataNode(reg.Addr, reg.Blocks)
+		if err := mdn.CheckVersion(reg.Version); err != nil {
+			log.Println("Refused to register DataNode at", addr, "->", err)
+			server.Error(err)
+			return true
+		}
+		nodeID := mdn.RegisterDataNode(addr, reg.Blocks, reg.Version)
 		server.Send(&nodeID)
-		log.Println("DataNode '"+string(nodeID)+"' with", len(reg.Blocks), "blocks registered at", reg.Addr)
+		log.Println("DataNode '"+string(nodeID)+"' with", len(reg.Blocks), "blocks registered at", addr)
 
 	case "Heartbeat":
 		var msg HeartbeatMsg
 		if err := server.ReadBody(&msg); err != nil {
-			log.Println(err)
-			return
+			PeerFailed(c.RemoteAddr(), err)
+			return false
 		}
 		var resp HeartbeatResponse
 		// If we don't recognize the node, it needs to re-register
 		resp.NeedToRegister = !mdn.HeartbeatFrom(msg.NodeID, msg.SpaceUsed)
 		if resp.NeedToRegister {
 			server.Send(&resp)
-			return
+			return true
 		}
 		log.Println("Heartbeat from '"+msg.NodeID+"', space used", msg.SpaceUsed)
 		// Update our record of what blocks this Node has
@@ -59,25 +98,32 @@ func runClusterRPC(c net.Conn, mdn *MetaDataNodeState) {
 			for _, n := range nodes {
 				addrs = append(addrs, mdn.dataNodes[n])
 			}
-			resp.ToReplicate = append(resp.ToReplicate, ForwardBlock{block, addrs, -1})
+			resp.ToReplicate = append(resp.ToReplicate, ForwardBlock{block, addrs, -1, nil})
 		}
+		// Tell this node to rebuild internal blocks of groups
+		resp.ToReconstruct = mdn.rebuildIntents.Get(msg.NodeID)
+		// Tell this node to erasure code blocks of cold blobs
+		resp.ToEncode = mdn.EncodeTasks(msg.NodeID)
+		resp.BlockKeys = mdn.BlockKeys()
 		if err := server.Send(&resp); err != nil {
-			log.Fatalln(err)
+			// What it was told to do will be asked of it again
+			PeerFailed(c.RemoteAddr(), err)
+			return false
 		}
 
+	case "Ping":
+		server.SendOkay()
+
 	default:
 		log.Println("Unacceptable:", method)
 		server.Unacceptable()
 	}
+	return true
 }
 
 func (self *MetaDataNodeState) ClusterRPCServer(sock net.Listener) {
 	log.Println("Accepting peer connections on", sock.Addr())
-	for {
-		peer, err := sock.Accept()
-		if err != nil {
-			log.Fatal(err)
-		}
-		go runClusterRPC(peer, self)
-	}
+	AcceptLoop(sock, func(peer net.Conn) {
+		runClusterRPC(peer, self)
+	})
 }
@@ -2,6 +2,9 @@ package metadatanode
 
 import (
 	"net"
+	"time"
+
+	"golang-distributed-filesystem/auth"
 )
 
 type Config struct {
@@ -9,4 +12,33 @@ type Config struct {
 	ClusterListener   net.Listener
 	ReplicationFactor int
 	DatabaseFile      string
+	// Defaults to 128MB
+	BlockSize int64
+	// How long an unfinished upload is kept for its client to resume it.
+	// Defaults to an hour.
+	LeaseTimeout time.Duration
+	// Replicated blobs nobody has read or written for this long are erasure
+	// coded with ConvertPolicy in the background. Off if zero.
+	ConvertAfter  time.Duration
+	ConvertPolicy string
+	// Master key that blobs outside any zone have their data keys wrapped
+	// with, made if it doesn't exist
+	KeyFile string
+	// Where the KMS is, for encryption zones
+	KMSAddress string
+	// Clients that may be given data keys. Defaults to loopback only.
+	KeyClients []*net.IPNet
+	// Checks clients' credentials. Without one everyone may do anything.
+	Authenticator auth.Authenticator
+	// Hand out tokens with block locations that DataNodes insist on
+	BlockTokens bool
+	// How long they last. Defaults to an hour.
+	BlockTokenLifetime time.Duration
+	// DataNodes without a certificate from the CA need this to join, if
+	// it's set
+	JoinToken string
+	// Only DataNodes on hosts in HostsFile, if there is one, and not in
+	// HostsExcludeFile can join. Both are reread by RefreshNodes.
+	HostsFile        string
+	HostsExcludeFile string
 }
@@ -0,0 +1,170 @@
+package metadatanode
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Blobs being erasure coded at once
+const maxConversions = 4
+
+// Long enough for a DataNode to read a whole block and send it back out
+const conversionTimeout = 2 * time.Minute
+
+// A replicated blob being turned into an erasure-coded one in the
+// background. Each of its blocks is encoded into a new block group by a
+// DataNode with a replica; once every group is stored, the blob is switched
+// over to them and the old replicas are deleted.
+type conversion struct {
+	blobID    string
+	policy    ErasurePolicy
+	blocks    []BlockInfo
+	groups    []BlockID
+	tasks     []*encodeTask
+	startedAt time.Time
+}
+
+type encodeTask struct {
+	node        NodeID
+	sentCommand bool
+	msg         EncodeBlock
+}
+
+// Starts converting blobs that have gone cold. Needs the lock.
+func (self *MetaDataNodeState) scheduleConversions() {
+	if self.ConvertAfter <= 0 || len(self.conversions) >= maxConversions {
+		return
+	}
+	blobs, err := self.store.ColdBlobs(time.Now().Add(-self.ConvertAfter), maxConversions+len(self.conversions))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, blobID := range blobs {
+		if len(self.conversions) >= maxConversions {
+			return
+		}
+		if self.conversions[blobID] == nil && self.leases[blobID] == nil {
+			self.startConversion(blobID, *self.convertPolicy)
+		}
+	}
+}
+
+// Needs the lock
+func (self *MetaDataNodeState) startConversion(blobID string, policy ErasurePolicy) {
+	blocks, err := self.store.Get(blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(blocks) == 0 {
+		return
+	}
+	c := &conversion{blobID: blobID, policy: policy, blocks: blocks, startedAt: time.Now()}
+	for _, b := range blocks {
+		var source NodeID
+		for nodeID, _ := range self.blocks[b.BlockID] {
+			source = nodeID
+			break
+		}
+		// Try again once every block has somewhere to be read from
+		if b.Stored < 0 || source == "" {
+			self.abandonConversion(c)
+			return
+		}
+		group, err := self.placeGroup(blobID, policy, nil)
+		if err != nil {
+			self.abandonConversion(c)
+			return
+		}
+		c.groups = append(c.groups, group.BlockID)
+		c.tasks = append(c.tasks, &encodeTask{source, false,
+			EncodeBlock{b.BlockID, b.Stored, group.BlockID, policy.String(), group.Nodes}})
+	}
+	log.Println("Converting blob '"+blobID+"' to", policy)
+	self.conversions[blobID] = c
+}
+
+// Needs the lock
+func (self *MetaDataNodeState) checkConversions() {
+	for blobID, c := range self.conversions {
+		if time.Since(c.startedAt) > conversionTimeout {
+			log.Println("Gave up converting blob '" + blobID + "'")
+			self.abandonConversion(c)
+			continue
+		}
+		done := true
+		for i, group := range c.groups {
+			for j := 0; j < c.policy.Cells(); j++ {
+				if c.policy.CellLength(c.blocks[i].Stored, j) > 0 && len(self.blocks[CellID(group, j)]) == 0 {
+					done = false
+				}
+			}
+		}
+		if done {
+			self.finishConversion(c)
+		}
+	}
+}
+
+// Switches the blob over, unless it's changed since it was encoded.
+// Needs the lock.
+func (self *MetaDataNodeState) finishConversion(c *conversion) {
+	current, err := self.store.Get(c.blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if self.leases[c.blobID] != nil || fmt.Sprint(current) != fmt.Sprint(c.blocks) {
+		log.Println("Blob '" + c.blobID + "' changed while it was being converted")
+		self.abandonConversion(c)
+		return
+	}
+	delete(self.conversions, c.blobID)
+
+	var groups []BlockInfo
+	for i, group := range c.groups {
+		groups = append(groups, BlockInfo{group, c.blocks[i].Size, c.blocks[i].Stored})
+	}
+	if err := self.store.Convert(c.blobID, groups, c.policy.String()); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Converted blob '"+c.blobID+"' to", c.policy)
+	// Unless another blob shares them
+	for _, b := range c.blocks {
+		self.collect(b.BlockID)
+	}
+}
+
+// Deletes whatever was stored of the new groups. Needs the lock.
+func (self *MetaDataNodeState) abandonConversion(c *conversion) {
+	delete(self.conversions, c.blobID)
+	for _, group := range c.groups {
+		self.collect(group)
+	}
+}
+
+// Blocks the DataNode is to encode
+func (self *MetaDataNodeState) EncodeTasks(node NodeID) []EncodeBlock {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var tasks []EncodeBlock
+	for _, c := range self.conversions {
+		for _, task := range c.tasks {
+			if task.node == node && !task.sentCommand {
+				task.sentCommand = true
+				tasks = append(tasks, task.msg)
+			}
+		}
+	}
+	return tasks
+}
+
+// Reading a blob keeps it from being converted
+func (self *MetaDataNodeState) Touch(blobID string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if err := self.store.Touch(blobID, time.Now()); err != nil {
+		log.Fatalln(err)
+	}
+}
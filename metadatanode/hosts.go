@@ -0,0 +1,150 @@
+package metadatanode
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Hosts from a file with an IP, network or hostname on each line. Hostnames
+// are looked up when the file is read. Blank lines and anything after a #
+// are ignored.
+type hostList []*net.IPNet
+
+func loadHosts(path string) (hostList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var hosts hostList
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(line); err == nil {
+			hosts = append(hosts, network)
+			continue
+		}
+		ips, err := net.LookupIP(line)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			hosts = append(hosts, hostNetwork(ip))
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func (self hostList) contains(ip net.IP) bool {
+	for _, network := range self {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rereads HostsFile and HostsExcludeFile, and forgets any DataNodes they no
+// longer let in. Their blocks are re-replicated from the rest.
+func (self *MetaDataNodeState) RefreshNodes() error {
+	var include, exclude hostList
+	var err error
+	if self.hostsFile != "" {
+		if include, err = loadHosts(self.hostsFile); err != nil {
+			return err
+		}
+	}
+	if self.hostsExcludeFile != "" {
+		if exclude, err = loadHosts(self.hostsExcludeFile); err != nil {
+			return err
+		}
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.includeHosts, self.excludeHosts = include, exclude
+	for id, addr := range self.dataNodes {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || !self.admits(net.ParseIP(host)) {
+			log.Println("Removing DataNode", id, "at", addr, "- not allowed by the hosts files")
+			self.forgetNode(id)
+		}
+	}
+	return nil
+}
+
+// Needs the lock
+func (self *MetaDataNodeState) admits(ip net.IP) bool {
+	if ip == nil || self.excludeHosts.contains(ip) {
+		return false
+	}
+	return self.includeHosts == nil || self.includeHosts.contains(ip)
+}
+
+// Checks a DataNode may join, and works out the address it should be known
+// by. It needs a certificate from the CA or the join token, if the leader
+// has either, has to be on an allowed host, and has to be listening on the
+// host it's connecting from.
+func (self *MetaDataNodeState) AdmitDataNode(conn net.Conn, reg RegistrationMsg) (string, error) {
+	certified := false
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		certified = len(tlsConn.ConnectionState().VerifiedChains) > 0
+	}
+	if !certified && self.joinToken != "" &&
+		subtle.ConstantTimeCompare([]byte(reg.JoinToken), []byte(self.joinToken)) != 1 {
+		return "", NewError(PermissionDenied, "Wrong join token")
+	}
+
+	remote, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return "", err
+	}
+	remoteIP := net.ParseIP(remote)
+	host, port, err := net.SplitHostPort(reg.Addr)
+	if err != nil {
+		return "", err
+	}
+	// DataNodes listening on every interface are known by the one they
+	// came from
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = remote
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	matches := false
+	for _, ip := range ips {
+		matches = matches || ip.Equal(remoteIP)
+	}
+	if !matches {
+		return "", NewError(PermissionDenied, "Address "+reg.Addr+" isn't the host the DataNode is on, "+remote)
+	}
+
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if !self.admits(remoteIP) {
+		return "", NewError(PermissionDenied, "Host "+remote+" isn't allowed to join")
+	}
+	return net.JoinHostPort(host, port), nil
+}
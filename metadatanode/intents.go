@@ -1,7 +1,6 @@
 package metadatanode
 
 import (
-	"log"
 	"time"
 
 	. "golang-distributed-filesystem/common"
@@ -19,11 +18,12 @@ type ReplicationIntents struct {
 	intents []*replicationIntent
 }
 
-func (self *ReplicationIntents) Add(block BlockID, from []NodeID, to []NodeID) {
+func (self *ReplicationIntents) Add(block BlockID, from []NodeID, to []NodeID) error {
 	if self.InProgress(block) {
-		log.Fatalln("Already replicating block '" + string(block))
+		return NewError(Conflict, "Already replicating block '"+string(block)+"'")
 	}
 	self.intents = append(self.intents, &replicationIntent{time.Now(), false, block, from, to})
+	return nil
 }
 
 func (self *ReplicationIntents) Count(node NodeID) int {
@@ -73,6 +73,44 @@ func (self *ReplicationIntents) Done(node NodeID, block BlockID) {
 	}
 }
 
+// Forget a block that's never going to be written, or all of a block
+// group's internal blocks
+func (self *ReplicationIntents) Cancel(block BlockID) {
+	var intents []*replicationIntent
+	for _, intent := range self.intents {
+		if group, _, ok := SplitCellID(intent.block); ok && group == block {
+			continue
+		}
+		if intent.block != block {
+			intents = append(intents, intent)
+		}
+	}
+	self.intents = intents
+}
+
+// Swap nodes that failed to take a new block for their replacements
+func (self *ReplicationIntents) Replace(block BlockID, failed []NodeID, replacements []NodeID) {
+	for _, intent := range self.intents {
+		if intent.block != block {
+			continue
+		}
+		var forwardTo []NodeID
+	Nodes:
+		for _, n := range intent.forwardTo {
+			for _, f := range failed {
+				if n == f {
+					continue Nodes
+				}
+			}
+			forwardTo = append(forwardTo, n)
+		}
+		intent.forwardTo = append(forwardTo, replacements...)
+		intent.startedAt = time.Now()
+		return
+	}
+	self.intents = append(self.intents, &replicationIntent{time.Now(), false, block, nil, replacements})
+}
+
 func (self *ReplicationIntents) InProgress(block BlockID) bool {
 	for i, intent := range self.intents {
 		if intent.block == block {
@@ -96,13 +134,14 @@ type DeletionIntents struct {
 	intents []*deletionIntent
 }
 
-func (self *DeletionIntents) Add(block BlockID, from []NodeID) {
+func (self *DeletionIntents) Add(block BlockID, from []NodeID) error {
+	if self.InProgress(block) {
+		return NewError(Conflict, "Already deleting block '"+string(block)+"'")
+	}
 	for _, node := range from {
-		if self.InProgress(block) {
-			log.Fatalln("Already deleting block '" + string(block) + "' from '" + string(node) + "'")
-		}
 		self.intents = append(self.intents, &deletionIntent{time.Now(), false, block, node})
 	}
+	return nil
 }
 
 func (self *DeletionIntents) Count(node NodeID) int {
@@ -151,3 +190,82 @@ func (self *DeletionIntents) InProgress(block BlockID) bool {
 	}
 	return false
 }
+
+// Internal blocks of a block group that a DataNode is to work out from the
+// rest of the group
+type rebuildIntent struct {
+	startedAt   time.Time
+	sentCommand bool
+	task        ReconstructCell
+	node        NodeID
+}
+
+type RebuildIntents struct {
+	intents []*rebuildIntent
+}
+
+func (self *RebuildIntents) Add(task ReconstructCell, node NodeID) error {
+	if self.InProgress(task.Cell) {
+		return NewError(Conflict, "Already reconstructing block '"+string(task.Cell)+"'")
+	}
+	self.intents = append(self.intents, &rebuildIntent{time.Now(), false, task, node})
+	return nil
+}
+
+func (self *RebuildIntents) Count(node NodeID) int {
+	count := 0
+	for _, intent := range self.intents {
+		if intent.node == node && time.Since(intent.startedAt) < 20*time.Second {
+			count++
+		}
+	}
+	return count
+}
+
+func (self *RebuildIntents) Get(node NodeID) []ReconstructCell {
+	var tasks []ReconstructCell
+	for _, intent := range self.intents {
+		if intent.sentCommand {
+			continue
+		}
+		if intent.node == node {
+			tasks = append(tasks, intent.task)
+			intent.sentCommand = true
+			intent.startedAt = time.Now()
+		}
+	}
+	return tasks
+}
+
+func (self *RebuildIntents) Done(node NodeID, block BlockID) {
+	for i, intent := range self.intents {
+		if intent.node == node && intent.task.Cell == block {
+			self.intents = append(self.intents[:i], self.intents[i+1:]...)
+			return
+		}
+	}
+}
+
+func (self *RebuildIntents) InProgress(block BlockID) bool {
+	for i, intent := range self.intents {
+		if intent.task.Cell == block {
+			if time.Since(intent.startedAt) < 20*time.Second {
+				return true
+			}
+			self.intents = append(self.intents[:i], self.intents[i+1:]...)
+			return false
+		}
+	}
+	return false
+}
+
+// Where the block is being rebuilt
+func (self *RebuildIntents) Nodes(block BlockID) []NodeID {
+	var nodes []NodeID
+	for _, intent := range self.intents {
+		if intent.task.Cell == block {
+			nodes = append(nodes, intent.node)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,237 @@
+package metadatanode
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+
+	"golang-distributed-filesystem/crypt"
+
+	. "golang-distributed-filesystem/common"
+)
+
+var loopback = []*net.IPNet{
+	{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+}
+
+// A blob's data key, wrapped by Version of KeyName in the KMS, or by the
+// leader's master key if KeyName is empty
+type BlobKey struct {
+	KeyName string
+	Version int
+	Wrapped []byte
+}
+
+var errNoKMS = NewError(Unsupported, "The leader has no KMS for encryption zones")
+
+// Makes a data key for a new blob, nil if it isn't to be encrypted. Blobs
+// in a zone always are. The context is the client's call, so the KMS isn't
+// waited on once the client's gone.
+func (self *MetaDataNodeState) NewBlobKey(ctx context.Context, encrypted bool, zone string) (*BlobKey, error) {
+	if zone != "" {
+		self.mutex.RLock()
+		keyName, err := self.store.ZoneKey(zone)
+		self.mutex.RUnlock()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if keyName == "" {
+			return nil, NewError(NotFound, "No encryption zone '"+zone+"'")
+		}
+		if self.kms == nil {
+			return nil, errNoKMS
+		}
+		version, wrapped, err := self.kms.Wrap(ctx, keyName, crypt.NewKey())
+		if err != nil {
+			return nil, err
+		}
+		return &BlobKey{keyName, version, wrapped}, nil
+	}
+	if !encrypted {
+		return nil, nil
+	}
+	if self.masterKey == nil {
+		return nil, NewError(Unsupported, "The leader has no master key to encrypt blobs with")
+	}
+	wrapped, err := crypt.Wrap(self.masterKey, crypt.NewKey())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return &BlobKey{"", 0, wrapped}, nil
+}
+
+func (self *MetaDataNodeState) unwrap(ctx context.Context, k BlobKey) ([]byte, error) {
+	if k.KeyName != "" {
+		if self.kms == nil {
+			return nil, errNoKMS
+		}
+		return self.kms.Unwrap(ctx, k.KeyName, k.Version, k.Wrapped)
+	}
+	if self.masterKey == nil {
+		return nil, NewError(Unsupported, "The leader has no master key to unwrap keys with")
+	}
+	return crypt.Unwrap(self.masterKey, k.Wrapped)
+}
+
+// The blob's data key, unwrapped, or nil if it isn't encrypted. This is the
+// only way a data key leaves the leader, and only to clients at KeyClients.
+func (self *MetaDataNodeState) GetBlobKey(ctx context.Context, blobID string, client net.Addr) ([]byte, error) {
+	self.mutex.RLock()
+	k, err := self.store.Key(blobID)
+	self.mutex.RUnlock()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if k == nil {
+		return nil, nil
+	}
+	if !self.mayHaveKeys(client) {
+		log.Println("Refused", client, "the key for blob '"+blobID+"'")
+		return nil, NewError(PermissionDenied, "Not allowed to have data keys")
+	}
+	return self.unwrap(ctx, *k)
+}
+
+// Makes the zone's key in the KMS if it isn't there yet
+func (self *MetaDataNodeState) CreateZone(ctx context.Context, zone EncryptionZone, client net.Addr) error {
+	if !self.mayHaveKeys(client) {
+		return NewError(PermissionDenied, "Not allowed to manage keys")
+	}
+	if self.kms == nil {
+		return errNoKMS
+	}
+	if zone.Name == "" || zone.KeyName == "" {
+		return NewError(InvalidArgument, "Zones need a name and a key")
+	}
+	if err := self.kms.Create(ctx, zone.KeyName); err != nil {
+		return err
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	existing, err := self.store.ZoneKey(zone.Name)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if existing != "" {
+		return NewError(Conflict, "Zone '"+zone.Name+"' already exists")
+	}
+	if err := self.store.SetZone(zone); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Created encryption zone '"+zone.Name+"' with key", zone.KeyName)
+	return nil
+}
+
+// Rolls the KMS key to a new version and rewraps every data key under an
+// older one with it. Block data doesn't change, so nothing on the DataNodes
+// has to be rewritten. Returns how many keys were rewrapped.
+func (self *MetaDataNodeState) Rekey(ctx context.Context, keyName string, client net.Addr) (int, error) {
+	if !self.mayHaveKeys(client) {
+		return 0, NewError(PermissionDenied, "Not allowed to manage keys")
+	}
+	if self.kms == nil {
+		return 0, errNoKMS
+	}
+	version, err := self.kms.Roll(ctx, keyName)
+	if err != nil {
+		return 0, err
+	}
+	self.mutex.RLock()
+	old, err := self.store.KeysBefore(keyName, version)
+	self.mutex.RUnlock()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rewrapped := 0
+	for blobID, k := range old {
+		key, err := self.unwrap(ctx, k)
+		if err != nil {
+			return rewrapped, err
+		}
+		newVersion, wrapped, err := self.kms.Wrap(ctx, keyName, key)
+		if err != nil {
+			return rewrapped, err
+		}
+		self.mutex.Lock()
+		// Skipped if the blob was deleted in the meantime
+		ok, err := self.store.Rewrap(blobID, k, BlobKey{keyName, newVersion, wrapped})
+		self.mutex.Unlock()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if ok {
+			rewrapped++
+		}
+	}
+	log.Println("Rewrapped", rewrapped, "data keys with version", version, "of key", keyName)
+	return rewrapped, nil
+}
+
+// Every version of every key in use, including versions the KMS still has
+// that nothing uses any more
+func (self *MetaDataNodeState) KeyAudit(ctx context.Context) ([]KeyUse, error) {
+	self.mutex.RLock()
+	uses, err := self.store.KeyUses()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	names, err := self.store.ZoneKeys()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	self.mutex.RUnlock()
+
+	seen := map[KeyUse]bool{}
+	for _, use := range uses {
+		seen[KeyUse{use.KeyName, use.Version, 0}] = true
+		if use.KeyName != "" {
+			names = append(names, use.KeyName)
+		}
+	}
+	if self.kms != nil {
+		for _, name := range names {
+			versions, err := self.kms.Versions(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			for _, version := range versions {
+				if unused := (KeyUse{name, version, 0}); !seen[unused] {
+					seen[unused] = true
+					uses = append(uses, unused)
+				}
+			}
+		}
+	}
+	sort.Sort(byKeyVersion(uses))
+	// Clients take a null reply as an error
+	if uses == nil {
+		uses = []KeyUse{}
+	}
+	return uses, nil
+}
+
+type byKeyVersion []KeyUse
+
+func (s byKeyVersion) Len() int      { return len(s) }
+func (s byKeyVersion) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byKeyVersion) Less(i, j int) bool {
+	if s[i].KeyName != s[j].KeyName {
+		return s[i].KeyName < s[j].KeyName
+	}
+	return s[i].Version < s[j].Version
+}
+
+func (self *MetaDataNodeState) mayHaveKeys(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range self.keyClients {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
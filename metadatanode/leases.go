@@ -0,0 +1,506 @@
+package metadatanode
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"golang-distributed-filesystem/auth"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// A client's hold on a blob it's still writing. Leases outlive the client's
+// connection, so one that gets cut off can reconnect with ResumeBlob and
+// pick up where it left off. Blocks handed out under a lease that don't end
+// up in the committed blob are deleted, whether the client commits or just
+// never comes back.
+type lease struct {
+	blobID  string
+	issued  map[BlockID]bool
+	renewed time.Time
+	// Content of new blocks, recorded once they're committed
+	hashes map[BlockID]DedupBlock
+	// Nil if the blob is replicated
+	policy *ErasurePolicy
+	// The client's session timed out, so it's probably not coming back
+	abandoned bool
+	// Block being extended in place by an append, if any
+	extending BlockID
+}
+
+func newLease(blobID string, policy *ErasurePolicy) *lease {
+	return &lease{blobID, map[BlockID]bool{}, time.Now(), map[BlockID]DedupBlock{}, policy, false, ""}
+}
+
+var ErrLeaseExpired = NewError(LeaseExpired, "Lease expired")
+
+// The policy, codec, key and permissions are stored straight away, so the
+// blob can be resumed after a restart
+func (self *MetaDataNodeState) OpenLease(blobID string, policy *ErasurePolicy, codec string, key *BlobKey, perms *Permissions) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if perms != nil {
+		if err := self.store.SetPermissions(blobID, *perms); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if key != nil {
+		if err := self.store.SetKey(blobID, *key); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if policy != nil {
+		if err := self.store.SetPolicy(blobID, policy.String()); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if codec != "" {
+		if err := self.store.SetCodec(blobID, codec); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	self.leases[blobID] = newLease(blobID, policy)
+}
+
+func (self *MetaDataNodeState) LeasePolicy(blobID string) *ErasurePolicy {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if l := self.leases[blobID]; l != nil {
+		return l.policy
+	}
+	return nil
+}
+
+// Nil for replicated blobs. Needs the lock.
+func (self *MetaDataNodeState) blobPolicy(blobID string) *ErasurePolicy {
+	name, err := self.store.Policy(blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	policy, err := ParsePolicy(name)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return policy
+}
+
+func (self *MetaDataNodeState) GetBlobPolicy(blobID string) string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if policy := self.blobPolicy(blobID); policy != nil {
+		return policy.String()
+	}
+	return ""
+}
+
+// Empty if the blob isn't compressed
+func (self *MetaDataNodeState) GetBlobCodec(blobID string) string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	codec, err := self.store.Codec(blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return codec
+}
+
+// Reopens a committed blob so more can be written to the end of it. Only
+// one client can have a blob open at once.
+func (self *MetaDataNodeState) OpenForAppend(blobID string) (OpenedBlob, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.leases[blobID] != nil {
+		return OpenedBlob{}, NewError(Conflict, "Blob '"+blobID+"' is already open for writing")
+	}
+	blocks, err := self.store.Get(blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(blocks) == 0 {
+		return OpenedBlob{}, NewError(NotFound, "No blob '"+blobID+"'")
+	}
+	// Block groups are written in one go
+	if self.blobPolicy(blobID) != nil {
+		return OpenedBlob{}, NewError(Unsupported, "Blob '"+blobID+"' is erasure coded and can't be appended to")
+	}
+
+	l := newLease(blobID, nil)
+	for _, b := range blocks {
+		if b.Size < 0 {
+			return OpenedBlob{}, NewError(Unsupported, "Blob '"+blobID+"' was committed without block sizes")
+		}
+		l.issued[b.BlockID] = true
+	}
+	self.leases[blobID] = l
+
+	codec, err := self.store.Codec(blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	key, err := self.store.Key(blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	opened := OpenedBlob{Blocks: blocks, BlockSize: self.BlockSize, Codec: codec, Encrypted: key != nil}
+	// Compressed and encrypted blocks can't be added to
+	if codec != "" || key != nil {
+		return opened, nil
+	}
+	// Blocks other blobs share, or that might be shared because of their
+	// content, can't change
+	last := blocks[len(blocks)-1]
+	refs, err := self.store.Refs(last.BlockID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	hashed, err := self.store.HasHash(last.BlockID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if last.Size < self.BlockSize && refs == 1 && !hashed && !self.replicationIntents.InProgress(last.BlockID) {
+		for nodeID, _ := range self.blocks[last.BlockID] {
+			opened.Last = append(opened.Last, self.dataNodes[nodeID])
+		}
+		opened.Token = self.BlockToken(last.BlockID, auth.Write)
+		l.extending = last.BlockID
+	}
+	return opened, nil
+}
+
+// Copies of a block that's being appended to would miss what's written
+// after they start, so it's left where it is until the lease is done
+func (self *MetaDataNodeState) extending(block BlockID) bool {
+	for _, l := range self.leases {
+		if l.extending == block {
+			return true
+		}
+	}
+	return false
+}
+
+// Takes back up a blob from a client's checkpoint, and tells it which of
+// the blocks it already sent are safely stored. Blocks from other blobs are
+// only taken if the client can read one of them, or it was already given
+// them.
+func (self *MetaDataNodeState) ResumeLease(id *Identity, msg ResumeBlob) ([]BlockID, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	l := self.leases[msg.BlobID]
+	if l == nil {
+		committed, err := self.store.Get(msg.BlobID)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(committed) > 0 {
+			return nil, NewError(Conflict, "Blob '"+msg.BlobID+"' is already committed")
+		}
+		if !self.created(msg) {
+			return nil, NewError(NotFound, "No unfinished blob '"+msg.BlobID+"' to resume")
+		}
+	}
+	for _, block := range msg.Blocks {
+		// Deduplicated blocks belong to other blobs
+		if strings.HasPrefix(string(block), msg.BlobID+":") || (l != nil && l.issued[block]) {
+			continue
+		}
+		if !self.referenced(block) {
+			return nil, NewError(InvalidArgument, "Block '"+string(block)+"' isn't part of this blob")
+		}
+		if self.authenticator != nil && self.authorizeBlock(id, block) != nil {
+			return nil, errDenied
+		}
+	}
+	if l == nil {
+		// We've restarted or the lease ran out, but the client remembers
+		// which blocks it was given
+		l = newLease(msg.BlobID, self.blobPolicy(msg.BlobID))
+		self.leases[msg.BlobID] = l
+	}
+	l.renewed = time.Now()
+	l.abandoned = false
+
+	var replicated []BlockID
+	for _, block := range msg.Blocks {
+		l.issued[block] = true
+		if self.durable(block, l.policy) {
+			replicated = append(replicated, block)
+		}
+	}
+	return replicated, nil
+}
+
+// Whether a blob without a lease came from CreateBlob, rather than being
+// made up by the client. If clients authenticate it has permissions,
+// otherwise some of its own blocks have to be on DataNodes. Needs the lock.
+func (self *MetaDataNodeState) created(msg ResumeBlob) bool {
+	if self.authenticator != nil {
+		perms, err := self.store.Permissions(msg.BlobID)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return perms != nil
+	}
+	policy := self.blobPolicy(msg.BlobID)
+	for _, block := range msg.Blocks {
+		if !strings.HasPrefix(string(block), msg.BlobID+":") {
+			continue
+		}
+		if len(self.blocks[block]) > 0 {
+			return true
+		}
+		for i := 0; policy != nil && i < policy.Cells(); i++ {
+			if len(self.blocks[CellID(block, i)]) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Enough DataNodes have told us they have the block, or enough of a block
+// group's internal blocks to read it back. Needs the lock.
+func (self *MetaDataNodeState) durable(block BlockID, policy *ErasurePolicy) bool {
+	if policy != nil {
+		stored := 0
+		for i := 0; i < policy.Cells(); i++ {
+			if len(self.blocks[CellID(block, i)]) > 0 {
+				stored++
+			}
+		}
+		return stored >= policy.DataCells
+	}
+	want := self.ReplicationFactor
+	if len(self.dataNodes) < want {
+		want = len(self.dataNodes)
+	}
+	return len(self.blocks[block]) > 0 && len(self.blocks[block]) >= want
+}
+
+// Also renews the lease. A block it replaces takes its content with it.
+func (self *MetaDataNodeState) IssueBlock(blobID string, block BlockID, replaces BlockID) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	l := self.leases[blobID]
+	if l == nil {
+		return ErrLeaseExpired
+	}
+	if replaces != "" {
+		delete(l.issued, replaces)
+		if hash, ok := l.hashes[replaces]; ok {
+			delete(l.hashes, replaces)
+			hash.BlockID = block
+			l.hashes[block] = hash
+		}
+	}
+	l.issued[block] = true
+	l.renewed = time.Now()
+	return nil
+}
+
+// Looks for a committed block with the same content as one the client is
+// about to send. If there is one the client uses it instead, otherwise the
+// content is remembered for the new block. Only blocks the client could
+// already read are offered, or it'd get to read them through its own blob.
+func (self *MetaDataNodeState) Dedup(id *Identity, blobID string, msg DedupBlock) (BlockID, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	l := self.leases[blobID]
+	if l == nil {
+		return "", ErrLeaseExpired
+	}
+	if !l.issued[msg.BlockID] {
+		return "", NewError(InvalidArgument, "Block '"+string(msg.BlockID)+"' isn't part of this blob")
+	}
+	l.renewed = time.Now()
+
+	found, err := self.store.FindHash(msg.Hash, msg.Size)
+	if err != nil {
+		return "", err
+	}
+	var candidates []BlockID
+	for _, block := range found {
+		if self.authenticator == nil || self.authorizeBlock(id, block) == nil {
+			candidates = append(candidates, block)
+		}
+	}
+	// Blocks of this upload that have already made it to a DataNode count too
+	for block, hash := range l.hashes {
+		if hash.Hash == msg.Hash && hash.Size == msg.Size && l.issued[block] {
+			candidates = append(candidates, block)
+		}
+	}
+	for _, existing := range candidates {
+		if len(self.blocks[existing]) > 0 && !self.deletionIntents.InProgress(existing) {
+			delete(l.issued, msg.BlockID)
+			self.replicationIntents.Cancel(msg.BlockID)
+			l.issued[existing] = true
+			return existing, nil
+		}
+	}
+	l.hashes[msg.BlockID] = msg
+	return "", nil
+}
+
+// Whether the block was handed out under the blob's lease. Also renews it.
+func (self *MetaDataNodeState) LeaseHas(blobID string, block BlockID) (bool, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	l := self.leases[blobID]
+	if l == nil {
+		return false, ErrLeaseExpired
+	}
+	l.renewed = time.Now()
+	return l.issued[block], nil
+}
+
+// For clients that went quiet without hanging up. Their blocks are only
+// kept for the idle timeout rather than the whole LeaseTimeout; if they do
+// resume after that, blocks that were deleted are just sent again.
+func (self *MetaDataNodeState) AbandonLease(blobID string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if l := self.leases[blobID]; l != nil {
+		l.abandoned = true
+	}
+}
+
+// Ends the lease, deleting any blocks it handed out that aren't in kept.
+func (self *MetaDataNodeState) ReleaseLease(blobID string, kept []BlockInfo) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.releaseLease(blobID, kept)
+}
+
+// Needs the lock
+func (self *MetaDataNodeState) releaseLease(blobID string, kept []BlockInfo) {
+	l := self.leases[blobID]
+	if l == nil {
+		return
+	}
+	delete(self.leases, blobID)
+
+	keep := map[BlockID]bool{}
+	for _, b := range kept {
+		keep[b.BlockID] = true
+	}
+	for block, _ := range l.issued {
+		if !keep[block] {
+			self.collect(block)
+		}
+	}
+	if len(kept) == 0 {
+		self.deleteSettings(blobID)
+	}
+}
+
+// Forgets the blob's policy, codec, key and permissions. Needs the lock.
+func (self *MetaDataNodeState) deleteSettings(blobID string) {
+	if err := self.store.DeletePermissions(blobID); err != nil {
+		log.Fatalln(err)
+	}
+	if err := self.store.DeletePolicy(blobID); err != nil {
+		log.Fatalln(err)
+	}
+	if err := self.store.DeleteCodec(blobID); err != nil {
+		log.Fatalln(err)
+	}
+	if err := self.store.DeleteKey(blobID); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Whether a committed blob or an unfinished one uses the block. Needs the
+// lock.
+func (self *MetaDataNodeState) referenced(block BlockID) bool {
+	refs, err := self.store.Refs(block)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if refs > 0 {
+		return true
+	}
+	for _, l := range self.leases {
+		if l.issued[block] {
+			return true
+		}
+	}
+	return false
+}
+
+// Deletes the block if nothing uses it any more, along with the internal
+// blocks if it's a block group. Needs the lock.
+func (self *MetaDataNodeState) collect(block BlockID) {
+	if self.referenced(block) {
+		return
+	}
+	if err := self.store.DeleteHash(block); err != nil {
+		log.Fatalln(err)
+	}
+	self.replicationIntents.Cancel(block)
+	self.forget(block)
+	for cell, _ := range self.blocks {
+		if group, _, ok := SplitCellID(cell); ok && group == block {
+			self.forget(cell)
+		}
+	}
+}
+
+// Has the DataNodes delete the block. Needs the lock.
+func (self *MetaDataNodeState) forget(block BlockID) {
+	var holders []NodeID
+	for nodeID, _ := range self.blocks[block] {
+		holders = append(holders, nodeID)
+		delete(self.dataNodesBlocks[nodeID], block)
+	}
+	// Nothing will re-replicate it now, and the DataNodes will tell us
+	// once it's gone
+	delete(self.blocks, block)
+	if len(holders) > 0 && !self.deletionIntents.InProgress(block) {
+		log.Println("Deleting unreferenced block '" + string(block) + "'")
+		if err := self.deletionIntents.Add(block, holders); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (self *MetaDataNodeState) DeleteBlob(blobID string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.leases[blobID] != nil {
+		return NewError(Conflict, "Blob '"+blobID+"' is open for writing")
+	}
+	blocks, err := self.store.Get(blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(blocks) == 0 {
+		return NewError(NotFound, "No blob '"+blobID+"'")
+	}
+	if err := self.store.Delete(blobID); err != nil {
+		log.Fatalln(err)
+	}
+	self.deleteSettings(blobID)
+	for _, b := range blocks {
+		self.collect(b.BlockID)
+	}
+	return nil
+}
+
+// Needs the lock. Whatever was last flushed or committed stays.
+func (self *MetaDataNodeState) expireLeases() {
+	for blobID, l := range self.leases {
+		timeout := self.LeaseTimeout
+		if idle := CurrentTimeouts().Idle; l.abandoned && idle > 0 && idle < timeout {
+			timeout = idle
+		}
+		if time.Since(l.renewed) > timeout {
+			log.Println("Lease on blob '" + blobID + "' expired")
+			committed, err := self.store.Get(blobID)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			self.releaseLease(blobID, committed)
+		}
+	}
+}
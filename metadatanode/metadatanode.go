@@ -3,7 +3,9 @@ package metadatanode
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
 	"log"
+	"net"
 	"sort"
 	"strings"
 	"sync"
@@ -11,6 +13,9 @@ import (
 
 	"golang-distributed-filesystem/3rdparty/github.com/dotcloud/docker/pkg/namesgenerator"
 	"golang-distributed-filesystem/3rdparty/github.com/nu7hatch/gouuid"
+	"golang-distributed-filesystem/auth"
+	"golang-distributed-filesystem/crypt"
+	"golang-distributed-filesystem/kms"
 
 	. "golang-distributed-filesystem/common"
 )
@@ -21,11 +26,31 @@ type MetaDataNodeState struct {
 	dataNodes            map[NodeID]string
 	dataNodesLastSeen    map[NodeID]time.Time
 	dataNodesUtilization map[NodeID]int
+	dataNodesVersions    map[NodeID]VersionInfo
 	blocks               map[BlockID]map[NodeID]bool
 	dataNodesBlocks      map[NodeID]map[BlockID]bool
 	replicationIntents   ReplicationIntents
 	deletionIntents      DeletionIntents
+	rebuildIntents       RebuildIntents
 	ReplicationFactor    int
+	BlockSize            int64
+	leases               map[string]*lease
+	LeaseTimeout         time.Duration
+	conversions          map[string]*conversion
+	ConvertAfter         time.Duration
+	convertPolicy        *ErasurePolicy
+	masterKey            []byte
+	kms                  *kms.Client
+	keyClients           []*net.IPNet
+	authenticator        auth.Authenticator
+	blockTokens          bool
+	blockTokenLifetime   time.Duration
+	blockKeys            auth.BlockKeys
+	joinToken            string
+	hostsFile            string
+	hostsExcludeFile     string
+	includeHosts         hostList
+	excludeHosts         hostList
 }
 
 func Create(conf Config) (*MetaDataNodeState, error) {
@@ -42,13 +67,70 @@ func Create(conf Config) (*MetaDataNodeState, error) {
 	self.dataNodesLastSeen = map[NodeID]time.Time{}
 	self.dataNodes = map[NodeID]string{}
 	self.dataNodesUtilization = map[NodeID]int{}
+	self.dataNodesVersions = map[NodeID]VersionInfo{}
 	self.blocks = map[BlockID]map[NodeID]bool{}
 	self.dataNodesBlocks = map[NodeID]map[BlockID]bool{}
+	self.leases = map[string]*lease{}
+	self.conversions = map[string]*conversion{}
 
 	self.ReplicationFactor = conf.ReplicationFactor
+	self.BlockSize = conf.BlockSize
+	if self.BlockSize <= 0 {
+		self.BlockSize = 128 * 1024 * 1024
+	}
+	self.LeaseTimeout = conf.LeaseTimeout
+	if self.LeaseTimeout <= 0 {
+		self.LeaseTimeout = time.Hour
+	}
+	self.ConvertAfter = conf.ConvertAfter
+	if self.convertPolicy, err = ParsePolicy(conf.ConvertPolicy); err != nil {
+		return nil, err
+	}
+	if self.ConvertAfter > 0 && self.convertPolicy == nil {
+		return nil, errors.New("Converting blobs needs a policy to convert them to")
+	}
+	if conf.KeyFile != "" {
+		if self.masterKey, err = crypt.LoadMasterKey(conf.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if conf.KMSAddress != "" {
+		self.kms = &kms.Client{conf.KMSAddress}
+	}
+	self.keyClients = conf.KeyClients
+	if self.keyClients == nil {
+		self.keyClients = loopback
+	}
+	self.authenticator = conf.Authenticator
+	self.blockTokens = conf.BlockTokens
+	self.blockTokenLifetime = conf.BlockTokenLifetime
+	if self.blockTokenLifetime <= 0 {
+		self.blockTokenLifetime = time.Hour
+	}
+	if self.blockTokens {
+		keys, err := self.store.BlockKeys()
+		if err != nil {
+			return nil, err
+		}
+		self.blockKeys.Set(keys)
+	}
+	self.joinToken = conf.JoinToken
+	self.hostsFile, self.hostsExcludeFile = conf.HostsFile, conf.HostsExcludeFile
+	if err := self.RefreshNodes(); err != nil {
+		return nil, err
+	}
+	clientListener, err := SecureListener(conf.ClientListener, false)
+	if err != nil {
+		return nil, err
+	}
+	// Only DataNodes with certificates from the CA can join
+	clusterListener, err := SecureListener(conf.ClusterListener, true)
+	if err != nil {
+		return nil, err
+	}
 	go self.Monitor()
-	go self.ClientRPCServer(conf.ClientListener)
-	go self.ClusterRPCServer(conf.ClusterListener)
+	go self.ClientRPCServer(clientListener)
+	go self.ClusterRPCServer(clusterListener)
 
 	return self, nil
 }
@@ -73,45 +155,146 @@ func (self *MetaDataNodeState) GenerateBlobId() string {
 	return u4.String()
 }
 
-func (self *MetaDataNodeState) GenerateBlock(blob string) ForwardBlock {
+// Won't pick any nodes whose addresses are in exclude
+func (self *MetaDataNodeState) GenerateBlock(blob string, exclude []string) (ForwardBlock, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
 	u4, err := uuid.NewV4()
 	if err != nil {
 		log.Fatalln(err)
 	}
 	block := BlockID(blob + ":" + u4.String())
 
-	nodes := self.LeastUsedNodes()
 	var forwardTo []NodeID
-	if len(nodes) < self.ReplicationFactor {
-		forwardTo = nodes
-	} else {
-		forwardTo = nodes[0:self.ReplicationFactor]
+Nodes:
+	for _, nodeID := range self.LeastUsedNodes() {
+		if len(forwardTo) >= self.ReplicationFactor {
+			break
+		}
+		for _, addr := range exclude {
+			if self.dataNodes[nodeID] == addr {
+				continue Nodes
+			}
+		}
+		forwardTo = append(forwardTo, nodeID)
 	}
 	var addrs []string
 	for _, nodeID := range forwardTo {
 		addrs = append(addrs, self.dataNodes[nodeID])
 	}
 
-	// Lock?
-	self.replicationIntents.Add(block, nil, forwardTo)
-	return ForwardBlock{block, addrs, 128 * 1024 * 1024}
+	if err := self.replicationIntents.Add(block, nil, forwardTo); err != nil {
+		return ForwardBlock{}, err
+	}
+	return ForwardBlock{block, addrs, self.BlockSize, nil}, nil
 }
 
-func (self *MetaDataNodeState) GetBlob(blobID string) []BlockID {
-	self.mutex.RLock()
-	defer self.mutex.RUnlock()
+// A block group for an erasure-coded blob, with each of its internal
+// blocks going to a different DataNode in the order of Nodes
+func (self *MetaDataNodeState) GenerateGroup(blob string, policy ErasurePolicy, exclude []string) (ForwardBlock, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.placeGroup(blob, policy, exclude)
+}
 
-	names, err := self.store.Get(blobID)
+// Needs the lock
+func (self *MetaDataNodeState) placeGroup(blob string, policy ErasurePolicy, exclude []string) (ForwardBlock, error) {
+	u4, err := uuid.NewV4()
 	if err != nil {
 		log.Fatalln(err)
 	}
+	group := BlockID(blob + ":" + u4.String())
+
+	var forwardTo []NodeID
+Nodes:
+	for _, nodeID := range self.LeastUsedNodes() {
+		if len(forwardTo) >= policy.Cells() {
+			break
+		}
+		for _, addr := range exclude {
+			if self.dataNodes[nodeID] == addr {
+				continue Nodes
+			}
+		}
+		forwardTo = append(forwardTo, nodeID)
+	}
+	if len(forwardTo) < policy.Cells() {
+		return ForwardBlock{}, Errorf(Retryable, "%v needs %d DataNodes, only %d available", policy, policy.Cells(), len(forwardTo))
+	}
+	var addrs []string
+	for i, nodeID := range forwardTo {
+		if err := self.replicationIntents.Add(CellID(group, i), nil, []NodeID{nodeID}); err != nil {
+			for j := 0; j < i; j++ {
+				self.replicationIntents.Cancel(CellID(group, j))
+			}
+			return ForwardBlock{}, err
+		}
+		addrs = append(addrs, self.dataNodes[nodeID])
+	}
+	return ForwardBlock{group, addrs, self.BlockSize, nil}, nil
+}
+
+// More places to put a new block, when some in its pipeline didn't take it
+func (self *MetaDataNodeState) ReplacementNodes(msg ReplaceNodes) []string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	byAddr := map[string]NodeID{}
+	for nodeID, addr := range self.dataNodes {
+		byAddr[addr] = nodeID
+	}
+	exclude := map[string]bool{}
+	var failed []NodeID
+	for _, addr := range msg.Failed {
+		exclude[addr] = true
+		if nodeID, ok := byAddr[addr]; ok {
+			failed = append(failed, nodeID)
+		}
+	}
+	for _, addr := range msg.Exclude {
+		exclude[addr] = true
+	}
+
+	var replacements []NodeID
+	// Sent as an empty list rather than null when there's nobody left
+	addrs := []string{}
+	for _, nodeID := range self.LeastUsedNodes() {
+		if len(replacements) >= msg.Count {
+			break
+		}
+		if !exclude[self.dataNodes[nodeID]] {
+			replacements = append(replacements, nodeID)
+			addrs = append(addrs, self.dataNodes[nodeID])
+		}
+	}
+	self.replicationIntents.Replace(msg.BlockID, failed, replacements)
+	return addrs
+}
+
+// For blocks the client gave up on before any DataNode had them
+func (self *MetaDataNodeState) AbandonBlock(block BlockID) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.replicationIntents.Cancel(block)
+}
 
-	// Is this really necessary?
+func (self *MetaDataNodeState) GetBlob(blobID string) []BlockID {
 	var blocks []BlockID
-	for _, n := range names {
-		blocks = append(blocks, BlockID(n))
+	for _, b := range self.GetBlobInfo(blobID) {
+		blocks = append(blocks, b.BlockID)
 	}
+	return blocks
+}
+
+func (self *MetaDataNodeState) GetBlobInfo(blobID string) []BlockInfo {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
 
+	blocks, err := self.store.Get(blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	return blocks
 }
 
@@ -121,6 +304,7 @@ func (self *MetaDataNodeState) HasBlocks(nodeID NodeID, blocks []BlockID) {
 
 	for _, blockID := range blocks {
 		self.replicationIntents.Done(nodeID, blockID)
+		self.rebuildIntents.Done(nodeID, blockID)
 		if self.blocks[blockID] == nil {
 			self.blocks[blockID] = map[NodeID]bool{}
 		}
@@ -159,7 +343,7 @@ func (self *MetaDataNodeState) GetBlock(blockID BlockID) []string {
 	return addrs
 }
 
-func (self *MetaDataNodeState) RegisterDataNode(addr string, blocks []BlockID) NodeID {
+func (self *MetaDataNodeState) RegisterDataNode(addr string, blocks []BlockID, version VersionInfo) NodeID {
 	name := strings.Replace(namesgenerator.GetRandomName(0), "_", "-", -1)
 	nodeID := NodeID(name)
 	self.HasBlocks(nodeID, blocks)
@@ -169,10 +353,44 @@ func (self *MetaDataNodeState) RegisterDataNode(addr string, blocks []BlockID) N
 	self.dataNodes[nodeID] = addr
 	self.dataNodesUtilization[nodeID] = len(blocks)
 	self.dataNodesLastSeen[nodeID] = time.Now()
+	self.dataNodesVersions[nodeID] = version
 
 	return nodeID
 }
 
+// Turns away DataNodes the leader can't talk to. Ones that can't send blocks
+// to some of the others, or are from a different build, are let in with a
+// warning, since that's what a rolling upgrade looks like for a while.
+func (self *MetaDataNodeState) CheckVersion(version VersionInfo) error {
+	local := LocalVersion()
+	if err := local.Compatible(version); err != nil {
+		return err
+	}
+	if version.Build != local.Build {
+		log.Println("Warning: DataNode is running", version, "and the leader", local)
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	for id, other := range self.dataNodesVersions {
+		if version.Transfer.Agree(other.Transfer) == 0 {
+			log.Println("Warning: DataNode running", version, "can't exchange blocks with", id, "running", other)
+		}
+	}
+	return nil
+}
+
+// Its blocks are re-replicated from elsewhere. Needs the lock.
+func (self *MetaDataNodeState) forgetNode(id NodeID) {
+	delete(self.dataNodesLastSeen, id)
+	delete(self.dataNodes, id)
+	delete(self.dataNodesUtilization, id)
+	delete(self.dataNodesVersions, id)
+	for block, _ := range self.dataNodesBlocks[id] {
+		delete(self.blocks[block], id)
+	}
+	delete(self.dataNodesBlocks, id)
+}
+
 func (self *MetaDataNodeState) HeartbeatFrom(nodeID NodeID, utilization int) bool {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
@@ -186,7 +404,7 @@ func (self *MetaDataNodeState) HeartbeatFrom(nodeID NodeID, utilization int) boo
 }
 
 func (self *MetaDataNodeState) Utilization(n NodeID) int {
-	return self.dataNodesUtilization[n] + self.replicationIntents.Count(n) - self.deletionIntents.Count(n)
+	return self.dataNodesUtilization[n] + self.replicationIntents.Count(n) + self.rebuildIntents.Count(n) - self.deletionIntents.Count(n)
 }
 
 // This is not concurrency safe
@@ -213,11 +431,25 @@ func (self *MetaDataNodeState) MostUsedNodes() []NodeID {
 	return nodes
 }
 
-func (self *MetaDataNodeState) CommitBlob(name string, blocks []BlockID) {
+// Also used to flush blobs that are still being written, so replaces
+// whatever was committed before
+func (self *MetaDataNodeState) CommitBlob(name string, blocks []BlockInfo) {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
-	for _, b := range blocks {
-		self.store.Append(name, string(b))
+	if err := self.store.Set(name, blocks); err != nil {
+		log.Fatalln(err)
+	}
+	if err := self.store.Touch(name, time.Now()); err != nil {
+		log.Fatalln(err)
+	}
+	if l := self.leases[name]; l != nil {
+		for _, b := range blocks {
+			if hash, ok := l.hashes[b.BlockID]; ok {
+				if err := self.store.SetHash(b.BlockID, hash.Hash, hash.Size); err != nil {
+					log.Fatalln(err)
+				}
+			}
+		}
 	}
 }
 
@@ -229,17 +461,20 @@ func (self *MetaDataNodeState) Monitor() {
 		for id, lastSeen := range self.dataNodesLastSeen {
 			if time.Since(lastSeen) > 10*time.Second {
 				log.Println("Forgetting absent node:", id)
-				delete(self.dataNodesLastSeen, id)
-				delete(self.dataNodes, id)
-				delete(self.dataNodesUtilization, id)
-				for block, _ := range self.dataNodesBlocks[id] {
-					delete(self.blocks[block], id)
-				}
-				delete(self.dataNodesBlocks, id)
+				self.forgetNode(id)
 			}
 		}
 
+		self.expireLeases()
+
 		for blockID, nodes := range self.blocks {
+			// Internal blocks of a group only need the one copy, and are
+			// rebuilt by checkGroups rather than copied
+			want := self.ReplicationFactor
+			_, _, cell := SplitCellID(blockID)
+			if cell {
+				want = 1
+			}
 			switch {
 			default:
 				continue
@@ -250,12 +485,18 @@ func (self *MetaDataNodeState) Monitor() {
 			case self.deletionIntents.InProgress(blockID):
 				continue
 
-			case len(nodes) > self.ReplicationFactor:
+			case self.rebuildIntents.InProgress(blockID):
+				continue
+
+			case self.extending(blockID):
+				continue
+
+			case len(nodes) > want:
 				log.Println("Block '" + blockID + "' is over-replicated")
 				var deleteFrom []NodeID
 				nodesByUtilization := self.MostUsedNodes()
 				for _, nodeID := range nodesByUtilization {
-					if len(nodes)-len(deleteFrom) <= self.ReplicationFactor {
+					if len(nodes)-len(deleteFrom) <= want {
 						break
 					}
 					if nodes[nodeID] {
@@ -263,9 +504,11 @@ func (self *MetaDataNodeState) Monitor() {
 					}
 				}
 				log.Printf("Deleting from: %v", deleteFrom)
-				self.deletionIntents.Add(blockID, deleteFrom)
+				if err := self.deletionIntents.Add(blockID, deleteFrom); err != nil {
+					log.Println(err)
+				}
 
-			case len(nodes) < self.ReplicationFactor:
+			case len(nodes) < want && !cell:
 				log.Println("Block '" + blockID + "' is under-replicated!")
 				var forwardTo []NodeID
 				nodesByUtilization := self.LeastUsedNodes()
@@ -282,10 +525,16 @@ func (self *MetaDataNodeState) Monitor() {
 				for n, _ := range nodes {
 					availableFrom = append(availableFrom, n)
 				}
-				self.replicationIntents.Add(blockID, availableFrom, forwardTo)
+				if err := self.replicationIntents.Add(blockID, availableFrom, forwardTo); err != nil {
+					log.Println(err)
+				}
 			}
 		}
 
+		self.checkGroups()
+		self.checkConversions()
+		self.scheduleConversions()
+
 		if len(self.dataNodes) != 0 {
 			totalUtilization := 0
 			for _, utilization := range self.dataNodesUtilization {
@@ -321,20 +570,32 @@ func (self *MetaDataNodeState) Monitor() {
 							}
 						}
 
+						_, _, cell := SplitCellID(block)
 						switch {
+						// Moving it could put two of a group's internal
+						// blocks on one node
+						case cell:
+							continue Blocks
+
 						case self.replicationIntents.InProgress(block):
 							continue Blocks
 
 						case self.deletionIntents.InProgress(block):
 							continue Blocks
 
+						case self.extending(block):
+							continue Blocks
+
 						default:
 							var nodes []NodeID
 							for n, _ := range self.blocks[block] {
 								nodes = append(nodes, n)
 							}
 							log.Println("Move a block from", moreThanAverage[0], "to", lessNode)
-							self.replicationIntents.Add(block, nodes, []NodeID{lessNode})
+							if err := self.replicationIntents.Add(block, nodes, []NodeID{lessNode}); err != nil {
+								log.Println(err)
+								continue Blocks
+							}
 							if self.Utilization(lessThanAverage[0]) >= avgUtilization {
 								lessThanAverage = lessThanAverage[1:]
 							}
@@ -361,3 +622,68 @@ func (self *MetaDataNodeState) Monitor() {
 		time.Sleep(3 * time.Second)
 	}
 }
+
+// Rebuilds internal blocks of committed block groups that no DataNode has
+// any more, on nodes that don't have any of the group yet. Needs the lock.
+func (self *MetaDataNodeState) checkGroups() {
+	groups, err := self.store.ErasureGroups()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, group := range groups {
+		policy, err := ParsePolicy(group.Policy)
+		if err != nil || policy == nil {
+			log.Println("Block group '"+group.BlockID+"' has a bad policy:", err)
+			continue
+		}
+		sources := make([]string, policy.Cells())
+		holders := map[NodeID]bool{}
+		available := 0
+		var missing []int
+		for i := 0; i < policy.Cells(); i++ {
+			cell := CellID(group.BlockID, i)
+			switch {
+			// Empty ones aren't stored
+			case policy.CellLength(group.Size, i) == 0:
+				available++
+
+			case len(self.blocks[cell]) > 0:
+				available++
+				for nodeID, _ := range self.blocks[cell] {
+					holders[nodeID] = true
+					sources[i] = self.dataNodes[nodeID]
+				}
+
+			case self.replicationIntents.InProgress(cell), self.rebuildIntents.InProgress(cell):
+				for _, nodeID := range self.rebuildIntents.Nodes(cell) {
+					holders[nodeID] = true
+				}
+
+			default:
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if available < policy.DataCells {
+			log.Println("Block group '"+group.BlockID+"' has lost data: only", available, "of", policy.Cells(), "internal blocks left")
+			continue
+		}
+		for _, i := range missing {
+			cell := CellID(group.BlockID, i)
+			for _, nodeID := range self.LeastUsedNodes() {
+				if holders[nodeID] {
+					continue
+				}
+				log.Println("Reconstructing '"+cell+"' on", nodeID)
+				if err := self.rebuildIntents.Add(ReconstructCell{cell, policy.String(), group.Size, sources}, nodeID); err != nil {
+					log.Println(err)
+					break
+				}
+				holders[nodeID] = true
+				break
+			}
+		}
+	}
+}
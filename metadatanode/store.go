@@ -2,9 +2,13 @@ package metadatanode
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
+	"time"
 
 	_ "golang-distributed-filesystem/3rdparty/github.com/mattn/go-sqlite3"
+
+	. "golang-distributed-filesystem/common"
 )
 
 type DB struct {
@@ -22,38 +26,503 @@ func OpenDB(filename string) (*DB, error) {
 		"select name from sqlite_master where type='table' and name='file_blocks'").Scan(&name)
 	switch {
 	case err == sql.ErrNoRows:
-		if _, err = conn.Exec("CREATE TABLE file_blocks(blob, block)"); err != nil {
+		if _, err = conn.Exec("CREATE TABLE file_blocks(blob, block, size, stored)"); err != nil {
 			log.Fatalln(err)
 		}
 	case err != nil:
 		log.Fatalln(err)
 	default:
+		// Databases from before block sizes were recorded
+		if !hasColumn(conn, "file_blocks", "size") {
+			if _, err = conn.Exec("ALTER TABLE file_blocks ADD COLUMN size"); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		// and from before blocks could be compressed
+		if !hasColumn(conn, "file_blocks", "stored") {
+			if _, err = conn.Exec("ALTER TABLE file_blocks ADD COLUMN stored"); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+
+	for _, stmt := range []string{
+		// SHA-256 of blocks uploaded for deduplication
+		"CREATE TABLE IF NOT EXISTS block_hashes(block PRIMARY KEY, hash, size)",
+		"CREATE INDEX IF NOT EXISTS block_hashes_hash ON block_hashes(hash, size)",
+		// Counting references to a block
+		"CREATE INDEX IF NOT EXISTS file_blocks_block ON file_blocks(block)",
+		// Erasure coding policies of blobs that aren't replicated
+		"CREATE TABLE IF NOT EXISTS blob_policies(blob PRIMARY KEY, policy)",
+		// Unix time each blob was last read or written
+		"CREATE TABLE IF NOT EXISTS blob_times(blob PRIMARY KEY, touched)",
+		// Codecs of compressed blobs
+		"CREATE TABLE IF NOT EXISTS blob_codecs(blob PRIMARY KEY, codec)",
+		// Data keys of encrypted blobs, wrapped by a version of a key in the
+		// KMS, or by the leader's own master key if key_name is empty
+		"CREATE TABLE IF NOT EXISTS blob_keys(blob PRIMARY KEY, wrapped, key_name, version)",
+		// Encryption zones, and the KMS key their blobs' keys are wrapped with
+		"CREATE TABLE IF NOT EXISTS zones(name PRIMARY KEY, key_name)",
+		// Owners, modes and ACLs of blobs created while clients had to
+		// authenticate. The ACL is JSON.
+		"CREATE TABLE IF NOT EXISTS blob_permissions(blob PRIMARY KEY, owner, grp, mode, acl)",
+		// Keys block tokens are signed with, oldest first
+		"CREATE TABLE IF NOT EXISTS block_keys(id PRIMARY KEY, secret, expires)",
+	} {
+		if _, err = conn.Exec(stmt); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	// Keys from before there was a KMS are all under the master key
+	if !hasColumn(conn, "blob_keys", "key_name") {
+		for _, stmt := range []string{
+			"ALTER TABLE blob_keys ADD COLUMN key_name",
+			"ALTER TABLE blob_keys ADD COLUMN version",
+		} {
+			if _, err = conn.Exec(stmt); err != nil {
+				log.Fatalln(err)
+			}
+		}
 	}
 
 	return &DB{conn}, err
 }
 
-// This is not concurrency-safe since SQLite3 is not
-func (self *DB) Append(key, value string) error {
-	_, err := self.conn.Exec("INSERT INTO file_blocks VALUES(?, ?)", key, value)
-	return err
+func hasColumn(conn *sql.DB, table, column string) bool {
+	rows, err := conn.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid int
+		var name string
+		var kind, dflt interface{}
+		var notNull, pk int
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &dflt, &pk); err != nil {
+			log.Fatalln(err)
+		}
+		if name == column {
+			return true
+		}
+	}
+	return false
 }
 
-func (self *DB) Get(key string) ([]string, error) {
-	rows, err := self.conn.Query("SELECT block FROM file_blocks WHERE blob=?", key)
+// Replaces everything stored for key in one go, so readers never see half
+// of an update. This is not concurrency-safe since SQLite3 is not
+func (self *DB) Set(key string, blocks []BlockInfo) error {
+	tx, err := self.conn.Begin()
+	if err != nil {
+		return err
+	}
+	if err := setBlocks(tx, key, blocks); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func setBlocks(tx *sql.Tx, key string, blocks []BlockInfo) error {
+	if _, err := tx.Exec("DELETE FROM file_blocks WHERE blob=?", key); err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		// Clients from before compression don't send it
+		stored := block.Stored
+		if stored == 0 {
+			stored = block.Size
+		}
+		_, err := tx.Exec("INSERT INTO file_blocks VALUES(?, ?, ?, ?)", key, string(block.BlockID), block.Size, stored)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Swaps a blob's blocks for block groups along with its policy, so it's
+// never read with the wrong one
+func (self *DB) Convert(key string, groups []BlockInfo, policy string) error {
+	tx, err := self.conn.Begin()
+	if err != nil {
+		return err
+	}
+	if err := setBlocks(tx, key, groups); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO blob_policies VALUES(?, ?)", key, policy); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (self *DB) Get(key string) ([]BlockInfo, error) {
+	rows, err := self.conn.Query("SELECT block, size, stored FROM file_blocks WHERE blob=? ORDER BY rowid", key)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var blocks []string
+	var blocks []BlockInfo
 	for rows.Next() {
 		var b string
-		err = rows.Scan(&b)
+		var size, stored sql.NullInt64
+		err = rows.Scan(&b, &size, &stored)
 		if err != nil {
 			return nil, err
 		}
-		blocks = append(blocks, b)
+		if !size.Valid {
+			size.Int64 = -1
+		}
+		if !stored.Valid {
+			stored.Int64 = size.Int64
+		}
+		blocks = append(blocks, BlockInfo{BlockID(b), size.Int64, stored.Int64})
+	}
+
+	return blocks, nil
+}
+
+func (self *DB) Delete(key string) error {
+	if _, err := self.conn.Exec("DELETE FROM file_blocks WHERE blob=?", key); err != nil {
+		return err
+	}
+	_, err := self.conn.Exec("DELETE FROM blob_times WHERE blob=?", key)
+	return err
+}
+
+func (self *DB) Touch(key string, when time.Time) error {
+	_, err := self.conn.Exec("INSERT OR REPLACE INTO blob_times VALUES(?, ?)", key, when.Unix())
+	return err
+}
+
+// Up to limit replicated blobs nobody has read or written since before.
+// Blobs from before access times were kept count as cold.
+func (self *DB) ColdBlobs(before time.Time, limit int) ([]string, error) {
+	rows, err := self.conn.Query(`SELECT DISTINCT f.blob FROM file_blocks f
+		LEFT JOIN blob_times t ON t.blob=f.blob
+		WHERE NOT EXISTS (SELECT 1 FROM blob_policies p WHERE p.blob=f.blob)
+		AND (t.touched IS NULL OR t.touched < ?) LIMIT ?`, before.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var blobs []string
+	for rows.Next() {
+		var blob string
+		if err := rows.Scan(&blob); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
 	}
+	return blobs, nil
+}
+
+// How many times committed blobs use the block
+func (self *DB) Refs(block BlockID) (int, error) {
+	var refs int
+	err := self.conn.QueryRow("SELECT COUNT(*) FROM file_blocks WHERE block=?", string(block)).Scan(&refs)
+	return refs, err
+}
+
+func (self *DB) SetHash(block BlockID, hash string, size int64) error {
+	_, err := self.conn.Exec("INSERT OR REPLACE INTO block_hashes VALUES(?, ?, ?)", string(block), hash, size)
+	return err
+}
 
+func (self *DB) HasHash(block BlockID) (bool, error) {
+	var n int
+	err := self.conn.QueryRow("SELECT COUNT(*) FROM block_hashes WHERE block=?", string(block)).Scan(&n)
+	return n > 0, err
+}
+
+func (self *DB) DeleteHash(block BlockID) error {
+	_, err := self.conn.Exec("DELETE FROM block_hashes WHERE block=?", string(block))
+	return err
+}
+
+// Blocks with this content that some committed blob uses
+func (self *DB) FindHash(hash string, size int64) ([]BlockID, error) {
+	rows, err := self.conn.Query(`SELECT block FROM block_hashes h WHERE hash=? AND size=?
+		AND EXISTS (SELECT 1 FROM file_blocks f WHERE f.block=h.block)`, hash, size)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var blocks []BlockID
+	for rows.Next() {
+		var b string
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, BlockID(b))
+	}
 	return blocks, nil
 }
+
+func (self *DB) SetPolicy(key string, policy string) error {
+	_, err := self.conn.Exec("INSERT OR REPLACE INTO blob_policies VALUES(?, ?)", key, policy)
+	return err
+}
+
+// Empty for replicated blobs
+func (self *DB) Policy(key string) (string, error) {
+	var policy string
+	err := self.conn.QueryRow("SELECT policy FROM blob_policies WHERE blob=?", key).Scan(&policy)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return policy, err
+}
+
+func (self *DB) DeletePolicy(key string) error {
+	_, err := self.conn.Exec("DELETE FROM blob_policies WHERE blob=?", key)
+	return err
+}
+
+func (self *DB) SetCodec(key string, codec string) error {
+	_, err := self.conn.Exec("INSERT OR REPLACE INTO blob_codecs VALUES(?, ?)", key, codec)
+	return err
+}
+
+// Empty for blobs that aren't compressed
+func (self *DB) Codec(key string) (string, error) {
+	var codec string
+	err := self.conn.QueryRow("SELECT codec FROM blob_codecs WHERE blob=?", key).Scan(&codec)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return codec, err
+}
+
+func (self *DB) DeleteCodec(key string) error {
+	_, err := self.conn.Exec("DELETE FROM blob_codecs WHERE blob=?", key)
+	return err
+}
+
+func (self *DB) SetKey(key string, k BlobKey) error {
+	_, err := self.conn.Exec("INSERT OR REPLACE INTO blob_keys VALUES(?, ?, ?, ?)", key, k.Wrapped, k.KeyName, k.Version)
+	return err
+}
+
+// Nil for blobs that aren't encrypted
+func (self *DB) Key(key string) (*BlobKey, error) {
+	var k BlobKey
+	var name sql.NullString
+	var version sql.NullInt64
+	err := self.conn.QueryRow("SELECT wrapped, key_name, version FROM blob_keys WHERE blob=?", key).Scan(&k.Wrapped, &name, &version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	k.KeyName, k.Version = name.String, int(version.Int64)
+	return &k, err
+}
+
+// Swaps the blob's wrapped key for one under another version, unless it's
+// changed since old was read
+func (self *DB) Rewrap(key string, old BlobKey, k BlobKey) (bool, error) {
+	result, err := self.conn.Exec("UPDATE blob_keys SET wrapped=?, version=? WHERE blob=? AND key_name=? AND version=?",
+		k.Wrapped, k.Version, key, old.KeyName, old.Version)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Blobs with keys wrapped by versions of the KMS key older than version
+func (self *DB) KeysBefore(keyName string, version int) (map[string]BlobKey, error) {
+	rows, err := self.conn.Query("SELECT blob, wrapped, version FROM blob_keys WHERE key_name=? AND version<?", keyName, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := map[string]BlobKey{}
+	for rows.Next() {
+		var blob string
+		k := BlobKey{KeyName: keyName}
+		if err := rows.Scan(&blob, &k.Wrapped, &k.Version); err != nil {
+			return nil, err
+		}
+		keys[blob] = k
+	}
+	return keys, nil
+}
+
+// How many blobs have keys wrapped by each version of each key
+func (self *DB) KeyUses() ([]KeyUse, error) {
+	rows, err := self.conn.Query(`SELECT COALESCE(key_name, ''), COALESCE(version, 0), COUNT(*)
+		FROM blob_keys GROUP BY 1, 2 ORDER BY 1, 2`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uses []KeyUse
+	for rows.Next() {
+		var use KeyUse
+		if err := rows.Scan(&use.KeyName, &use.Version, &use.Blobs); err != nil {
+			return nil, err
+		}
+		uses = append(uses, use)
+	}
+	return uses, nil
+}
+
+func (self *DB) SetZone(zone EncryptionZone) error {
+	_, err := self.conn.Exec("INSERT INTO zones VALUES(?, ?)", zone.Name, zone.KeyName)
+	return err
+}
+
+// Empty if there's no such zone
+func (self *DB) ZoneKey(zone string) (string, error) {
+	var keyName string
+	err := self.conn.QueryRow("SELECT key_name FROM zones WHERE name=?", zone).Scan(&keyName)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return keyName, err
+}
+
+// Keys used by any zone
+func (self *DB) ZoneKeys() ([]string, error) {
+	rows, err := self.conn.Query("SELECT DISTINCT key_name FROM zones")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (self *DB) DeleteKey(key string) error {
+	_, err := self.conn.Exec("DELETE FROM blob_keys WHERE blob=?", key)
+	return err
+}
+
+func (self *DB) SetPermissions(key string, p Permissions) error {
+	acl, err := json.Marshal(p.ACL)
+	if err != nil {
+		return err
+	}
+	_, err = self.conn.Exec("INSERT OR REPLACE INTO blob_permissions VALUES(?, ?, ?, ?, ?)", key, p.Owner, p.Group, p.Mode, string(acl))
+	return err
+}
+
+// Nil for blobs from before clients authenticated
+func (self *DB) Permissions(key string) (*Permissions, error) {
+	var p Permissions
+	var acl string
+	err := self.conn.QueryRow("SELECT owner, grp, mode, acl FROM blob_permissions WHERE blob=?", key).Scan(&p.Owner, &p.Group, &p.Mode, &acl)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, json.Unmarshal([]byte(acl), &p.ACL)
+}
+
+func (self *DB) DeletePermissions(key string) error {
+	_, err := self.conn.Exec("DELETE FROM blob_permissions WHERE blob=?", key)
+	return err
+}
+
+// Replaces every block key
+func (self *DB) SetBlockKeys(keys []BlockKey) error {
+	tx, err := self.conn.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM block_keys"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, key := range keys {
+		if _, err := tx.Exec("INSERT INTO block_keys VALUES(?, ?, ?)", key.ID, key.Secret, key.Expires); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (self *DB) BlockKeys() ([]BlockKey, error) {
+	rows, err := self.conn.Query("SELECT id, secret, expires FROM block_keys ORDER BY expires")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []BlockKey
+	for rows.Next() {
+		var key BlockKey
+		if err := rows.Scan(&key.ID, &key.Secret, &key.Expires); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Every committed blob
+func (self *DB) Blobs() ([]string, error) {
+	return self.blobs("SELECT DISTINCT blob FROM file_blocks ORDER BY blob")
+}
+
+// Committed blobs that use the block
+func (self *DB) BlobsWith(block BlockID) ([]string, error) {
+	return self.blobs("SELECT DISTINCT blob FROM file_blocks WHERE block=?", string(block))
+}
+
+func (self *DB) blobs(query string, args ...interface{}) ([]string, error) {
+	rows, err := self.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var blobs []string
+	for rows.Next() {
+		var blob string
+		if err := rows.Scan(&blob); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, nil
+}
+
+// Size is what's stored in the group, compressed or not
+type ErasureGroup struct {
+	BlockID BlockID
+	Size    int64
+	Policy  string
+}
+
+// Block groups of every committed erasure-coded blob
+func (self *DB) ErasureGroups() ([]ErasureGroup, error) {
+	rows, err := self.conn.Query(`SELECT DISTINCT f.block, COALESCE(f.stored, f.size), p.policy FROM file_blocks f
+		JOIN blob_policies p ON p.blob=f.blob`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []ErasureGroup
+	for rows.Next() {
+		var g ErasureGroup
+		var b string
+		if err := rows.Scan(&b, &g.Size, &g.Policy); err != nil {
+			return nil, err
+		}
+		g.BlockID = BlockID(b)
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
@@ -0,0 +1,55 @@
+package upload
+
+import (
+	. "golang-distributed-filesystem/common"
+)
+
+// Has the leader reread its hosts files, dropping DataNodes that aren't
+// allowed any more
+func RefreshNodes(conf Config) error {
+	var ok string
+	return CallLeaderContext(conf.context(), conf.LeaderAddress, conf.Debug, "RefreshNodes", nil, &ok)
+}
+
+// What a DataNode has had to retry, and which peers failed it
+func DataNodeRetries(conf Config, addr string) ([]RetryStat, error) {
+	var stats []RetryStat
+	err := callDataNode(conf, addr, "RetryStats", &stats)
+	return stats, err
+}
+
+// Which clients and DataNodes the leader has had to hang up on
+func LeaderPeerFailures(conf Config) ([]PeerFailure, error) {
+	var failures []PeerFailure
+	err := CallLeaderContext(conf.context(), conf.LeaderAddress, conf.Debug, "PeerFailures", nil, &failures)
+	return failures, err
+}
+
+// Which peers a DataNode has had to hang up on
+func DataNodePeerFailures(conf Config, addr string) ([]PeerFailure, error) {
+	var failures []PeerFailure
+	err := callDataNode(conf, addr, "PeerFailures", &failures)
+	return failures, err
+}
+
+// How far through its block scan a DataNode is
+func DataNodeScanProgress(conf Config, addr string) (ScanProgress, error) {
+	var progress ScanProgress
+	err := callDataNode(conf, addr, "ScanProgress", &progress)
+	return progress, err
+}
+
+// DataNodes only say how they're doing with a token from the leader, which
+// only gives them to admins
+func callDataNode(conf Config, addr string, method string, reply interface{}) error {
+	var token BlockToken
+	if err := CallLeaderContext(conf.context(), conf.LeaderAddress, conf.Debug, "StatsToken", nil, &token); err != nil {
+		return err
+	}
+	dataNode, err := DialTransfer(addr, conf.Debug)
+	if err != nil {
+		return err
+	}
+	defer dataNode.Close()
+	return dataNode.Call(method, &token, reply)
+}
@@ -0,0 +1,161 @@
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// What's been sent so far, kept on disk so an interrupted upload can be
+// picked back up with ResumeBlob instead of starting over.
+type checkpoint struct {
+	BlobID string
+	Policy string
+	Codec  string
+	Blocks []checkpointBlock
+
+	path string
+	lock sync.Mutex
+}
+
+type checkpointBlock struct {
+	// Where it goes in the blob
+	Index   int
+	BlockID BlockID
+	Size    int64
+	// Compressed size, the checksum is of what's in the file
+	Stored   int64
+	Checksum string
+}
+
+// nil if there's nothing to resume
+func loadCheckpoint(path string) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{path: path}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, errors.New("Checkpoint " + path + " is corrupt: " + err.Error())
+	}
+	return cp, nil
+}
+
+func newCheckpoint(path string, blobID string, policy string, codec string) (*checkpoint, error) {
+	cp := &checkpoint{BlobID: blobID, Policy: policy, Codec: codec, path: path}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	return cp, cp.save()
+}
+
+// Needs the lock. Written aside and renamed, so a crash never leaves half a
+// checkpoint.
+func (self *checkpoint) save() error {
+	data, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(self.path), ".checkpoint")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), self.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (self *checkpoint) Done(index int, block BlockInfo, data *io.SectionReader) error {
+	checksum, err := sectionChecksum(data)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.Blocks = append(self.Blocks, checkpointBlock{index, block.BlockID, block.Size, block.Stored, checksum})
+	return self.save()
+}
+
+func (self *checkpoint) Remove() {
+	if err := os.Remove(self.path); err != nil {
+		log.Println("Couldn't remove checkpoint:", err)
+	}
+}
+
+func (self *checkpoint) blockIDs() []BlockID {
+	var ids []BlockID
+	for _, b := range self.Blocks {
+		ids = append(ids, b.BlockID)
+	}
+	return ids
+}
+
+// The blocks from the start of the blob that can be kept: the leader says
+// they're replicated, and the file still has the same data there. Anything
+// after the first gap is sent again.
+func (self *checkpoint) Usable(file io.ReaderAt, replicated []BlockID) ([]BlockInfo, error) {
+	stored := map[BlockID]bool{}
+	for _, id := range replicated {
+		stored[id] = true
+	}
+	sort.Sort(byIndex(self.Blocks))
+
+	var kept []BlockInfo
+	var keptBlocks []checkpointBlock
+	var offset int64
+	for i, b := range self.Blocks {
+		if b.Index != i || !stored[b.BlockID] {
+			break
+		}
+		checksum, err := sectionChecksum(io.NewSectionReader(file, offset, b.Size))
+		if err != nil {
+			return nil, err
+		}
+		if checksum != b.Checksum {
+			log.Println("File changed in block", b.BlockID, "since it was sent")
+			break
+		}
+		kept = append(kept, BlockInfo{b.BlockID, b.Size, b.Stored})
+		keptBlocks = append(keptBlocks, b)
+		offset += b.Size
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.Blocks = keptBlocks
+	return kept, self.save()
+}
+
+type byIndex []checkpointBlock
+
+func (s byIndex) Len() int           { return len(s) }
+func (s byIndex) Less(i, j int) bool { return s[i].Index < s[j].Index }
+func (s byIndex) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func sectionChecksum(data *io.SectionReader) (string, error) {
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, io.NewSectionReader(data, 0, data.Size())); err != nil {
+		return "", err
+	}
+	return fmt.Sprint(hash.Sum32()), nil
+}
@@ -0,0 +1,78 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+
+	"golang-distributed-filesystem/erasure"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Stripes a block group across the DataNodes the leader picked, one
+// internal block each, encoding the parity as the data goes out. Internal
+// blocks that don't make it are retried on replacement nodes, and as long
+// as no more are missing than there's parity for, the leader rebuilds the
+// rest later.
+func uploadGroup(ctx context.Context, client *rpc.Client, policy ErasurePolicy, nodesMsg ForwardBlock, data *io.SectionReader, debug bool) (BlockID, error) {
+	group := nodesMsg.BlockID
+	size := data.Size()
+	if len(nodesMsg.Nodes) != policy.Cells() {
+		return "", fmt.Errorf("Leader gave %d DataNodes for %v block group %v", len(nodesMsg.Nodes), policy, group)
+	}
+	pending := map[int]string{}
+	for i, addr := range nodesMsg.Nodes {
+		if policy.CellLength(size, i) > 0 {
+			pending[i] = addr
+		}
+	}
+	want := len(pending)
+	used := append([]string{}, nodesMsg.Nodes...)
+	stored := 0
+	for attempt := 1; len(pending) > 0; attempt++ {
+		failed := map[int]string{}
+		results, err := erasure.SendGroup(ctx, policy, group, nodesMsg.Token, pending, io.NewSectionReader(data, 0, size), size, debug)
+		if err != nil {
+			return "", err
+		}
+		for i, err := range results {
+			if err == nil {
+				stored++
+				continue
+			}
+			log.Println("DataNode", pending[i], "didn't take", CellID(group, i), "->", err)
+			failed[i] = pending[i]
+		}
+		if len(failed) == 0 || attempt >= maxPipelineAttempts {
+			break
+		}
+		pending = map[int]string{}
+		for i, addr := range failed {
+			var replacements []string
+			err := CallContext(ctx, client, "ReplaceNodes",
+				&ReplaceNodes{CellID(group, i), []string{addr}, used, 1},
+				&replacements)
+			if err != nil {
+				// Counted against the group below if nothing else takes it
+				log.Println("ReplaceNodes error:", err)
+			}
+			if len(replacements) > 0 {
+				pending[i] = replacements[0]
+				used = append(used, replacements[0])
+			}
+		}
+	}
+
+	if missing := want - stored; missing > policy.ParityCells {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("Only %d of %d internal blocks of %v were stored", stored, want, group)
+	} else if missing > 0 {
+		log.Println("Block group", group, "is missing", missing, "internal blocks, the leader will rebuild them")
+	}
+	return group, nil
+}
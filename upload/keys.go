@@ -0,0 +1,27 @@
+package upload
+
+import (
+	. "golang-distributed-filesystem/common"
+)
+
+// Blobs uploaded with Config.Zone set to the zone's name are encrypted, with
+// data keys wrapped by the zone's key in the leader's KMS
+func CreateZone(conf Config, zone EncryptionZone) error {
+	var ok string
+	return CallLeaderContext(conf.context(), conf.LeaderAddress, conf.Debug, "CreateZone", &zone, &ok)
+}
+
+// Moves every blob with a data key wrapped by the KMS key onto a new version
+// of it, returning how many were moved
+func Rekey(conf Config, keyName string) (int, error) {
+	var rewrapped int
+	err := CallLeaderContext(conf.context(), conf.LeaderAddress, conf.Debug, "Rekey", keyName, &rewrapped)
+	return rewrapped, err
+}
+
+// Which versions of which keys still have data keys wrapped by them
+func KeyAudit(conf Config) ([]KeyUse, error) {
+	var uses []KeyUse
+	err := CallLeaderContext(conf.context(), conf.LeaderAddress, conf.Debug, "KeyAudit", nil, &uses)
+	return uses, err
+}
@@ -0,0 +1,105 @@
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Hands out the upload a block at a time. Each block has to be readable
+// more than once, in case its pipeline fails and it's sent again.
+type blockSource interface {
+	// Whether there's anything left to send
+	More() (bool, error)
+	// Up to size bytes, and something to call once they've been sent
+	Next(size int64) (*io.SectionReader, func(), error)
+}
+
+// Regular files can be read from wherever we like, so blocks are just
+// slices of the file.
+type fileSource struct {
+	file   io.ReaderAt
+	size   int64
+	offset int64
+}
+
+func (self *fileSource) More() (bool, error) {
+	return self.offset < self.size, nil
+}
+
+func (self *fileSource) Next(size int64) (*io.SectionReader, func(), error) {
+	if size > self.size-self.offset {
+		size = self.size - self.offset
+	}
+	data := io.NewSectionReader(self.file, self.offset, size)
+	self.offset += size
+	return data, func() {}, nil
+}
+
+// Small blocks are kept in memory, anything bigger than this is spooled to
+// a temporary file
+const maxBufferedBlock = 8 * 1024 * 1024
+
+// Pipes, stdin and the like only go forwards and don't know how long they
+// are, so each block is copied aside before it's sent.
+type streamSource struct {
+	r *bufio.Reader
+}
+
+func newStreamSource(r io.Reader) *streamSource {
+	return &streamSource{bufio.NewReader(r)}
+}
+
+func (self *streamSource) More() (bool, error) {
+	_, err := self.r.Peek(1)
+	switch err {
+	case nil:
+		return true, nil
+	case io.EOF:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (self *streamSource) Next(size int64) (*io.SectionReader, func(), error) {
+	if size <= maxBufferedBlock {
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, self.r, size)
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		return io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, n), func() {}, nil
+	}
+
+	spool, err := ioutil.TempFile("", "upload")
+	if err != nil {
+		return nil, nil, err
+	}
+	remove := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+	n, err := io.CopyN(spool, self.r, size)
+	if err != nil && err != io.EOF {
+		remove()
+		return nil, nil, err
+	}
+	return io.NewSectionReader(spool, 0, n), remove, nil
+}
+
+// Uses the file directly if it's a regular file, otherwise streams it
+func sourceFor(r io.Reader) (blockSource, error) {
+	if file, ok := r.(*os.File); ok {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().IsRegular() {
+			return &fileSource{file, info.Size(), 0}, nil
+		}
+	}
+	return newStreamSource(r), nil
+}
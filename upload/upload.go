@@ -2,112 +2,477 @@
 package upload
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash/crc32"
-	"encoding/hex"
 	"io"
 	"log"
-	"net"
 	"net/rpc"
-	"net/rpc/jsonrpc"
 	"os"
 	"strings"
+	"sync"
+
+	"golang-distributed-filesystem/codec"
+	"golang-distributed-filesystem/crypt"
+	"golang-distributed-filesystem/download"
 
 	. "golang-distributed-filesystem/common"
 )
 
-func Upload(file *os.File, debug bool, leaderAddress string) string {
-	localFileInfo, err := file.Stat()
-	if err != nil {
-		log.Fatal("Stat error: ", err)
+type Config struct {
+	LeaderAddress string
+	Debug         bool
+	// How many blocks to send at once
+	Parallel int
+	// Where to keep track of progress, so an interrupted upload can be
+	// resumed by running it again. Only works for regular files.
+	Checkpoint string
+	// Hash blocks before sending them, and use blocks already stored with
+	// the same content instead
+	Dedup bool
+	// Erasure coding policy for new blobs, like RS-6-3. They're replicated
+	// if it's empty.
+	Policy string
+	// Compresses new blobs' blocks before they're sent: gzip, flate or lz
+	Codec string
+	// Encrypts new blobs' blocks with a data key from the leader
+	Encrypt bool
+	// Encryption zone to put new blobs in, which encrypts them too
+	Zone string
+	// Permissions of new blobs, when the leader authenticates clients
+	Mode uint32
+	ACL  []ACLEntry
+	// Cancelling it abandons the upload. The leader lets go of the blob
+	// once its session times out.
+	Context context.Context
+	// From the auth command, to use instead of whatever SetToken says
+	Token string
+	// How many times to ask for other DataNodes when none will take a
+	// block, and how long to wait in between. Defaults to 8 attempts, 100ms
+	// to 5s apart.
+	Retry RetryPolicy
+}
+
+func (self Config) context() context.Context {
+	ctx := self.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if self.Token != "" {
+		ctx = WithToken(ctx, self.Token)
 	}
-	localFileSize := localFileInfo.Size()
+	return ctx
+}
+
+func (self Config) retry() RetryPolicy {
+	if self.Retry.MaxAttempts == 0 {
+		policy := DefaultRetryPolicy
+		policy.MaxAttempts = 8
+		return policy
+	}
+	return self.Retry
+}
+
+func Upload(file *os.File, debug bool, leaderAddress string) (string, error) {
+	return UploadWith(Config{LeaderAddress: leaderAddress, Debug: debug, Parallel: 1}, file)
+}
 
-	conn, err := net.Dial("tcp", leaderAddress)
+// Uploads anything, though regular files don't need to be copied aside
+// block by block first. Blocks are sent Parallel at a time, each down its
+// own pipeline. They're requested from the leader in order, and the leader
+// is told that order when the blob is committed, so it doesn't matter which
+// finishes first. If anything goes wrong the rest is abandoned, and the
+// leader lets go of the blob once its session times out.
+func UploadWith(conf Config, r io.Reader) (string, error) {
+	source, err := sourceFor(r)
 	if err != nil {
-		log.Fatal("Dial error:", err)
+		return "", err
 	}
-	defer conn.Close()
-	codec := jsonrpc.NewClientCodec(conn)
-	if debug {
-		codec = LoggingClientCodec(
-			conn.RemoteAddr().String(),
-			codec)
+	file, ok := source.(*fileSource)
+	if conf.Checkpoint != "" && !ok {
+		// Checked before anything's created, since there'd be no going back
+		// to what was read from a pipe
+		return "", NewError(InvalidArgument, "Only regular files can be resumed")
 	}
-	client := rpc.NewClientWithCodec(codec)
+	parent := conf.context()
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	client, err := dialLeader(conf)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
 
 	var blobId string
-	err = client.Call("CreateBlob", nil, &blobId)
+	var blocks []BlockInfo
+	var cp *checkpoint
+	if conf.Checkpoint != "" {
+		if cp, err = loadCheckpoint(conf.Checkpoint); err != nil {
+			return "", err
+		}
+	}
+	if cp != nil {
+		var replicated []BlockID
+		err = CallContext(ctx, client, "ResumeBlob", &ResumeBlob{cp.BlobID, cp.blockIDs()}, &replicated)
+		if err != nil {
+			return "", err
+		}
+		blobId = cp.BlobID
+		conf.Policy = cp.Policy
+		conf.Codec = cp.Codec
+		if blocks, err = cp.Usable(file.file, replicated); err != nil {
+			return "", err
+		}
+		for _, b := range blocks {
+			file.offset += b.Size
+		}
+		log.Println("Resuming blob", blobId, "with", len(blocks), "blocks already sent")
+	} else {
+		err = CallContext(ctx, client, "CreateBlob", &CreateBlob{conf.Policy, conf.Codec, conf.Encrypt, conf.Zone, conf.Mode, conf.ACL}, &blobId)
+		if err != nil {
+			return "", err
+		}
+		if conf.Checkpoint != "" {
+			if cp, err = newCheckpoint(conf.Checkpoint, blobId, conf.Policy, conf.Codec); err != nil {
+				return "", err
+			}
+		}
+	}
+	policy, err := ParsePolicy(conf.Policy)
+	if err != nil {
+		return "", err
+	}
+	c, err := codec.Get(conf.Codec)
 	if err != nil {
-		panic(err)
-		log.Fatalln("CreateBlob error:", err)
+		return "", err
+	}
+	// Resumed blobs are encrypted if they were to start with
+	key, err := download.BlobKeyContext(ctx, conf.LeaderAddress, blobId, conf.Debug)
+	if err != nil {
+		return "", err
 	}
 
-	bytesLeft := localFileSize
-	for bytesLeft > 0 {
+	// The first thing to go wrong stops everything else
+	var failure error
+	var failOnce sync.Once
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			cancel()
+		})
+	}
+
+	parallel := conf.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	// Buffered so the next few blocks can be requested before a worker is
+	// free to take them
+	jobs := make(chan *blockJob, parallel)
+	var blocksLock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				// Still taken off the channel once there's been a failure,
+				// so nothing's left waiting to send more
+				if ctx.Err() == nil {
+					info, err := sendJob(ctx, conf, client, policy, c, key, job)
+					if err == nil && cp != nil {
+						err = cp.Done(job.index, info, job.data)
+					}
+					if err != nil {
+						fail(err)
+					} else {
+						blocksLock.Lock()
+						blocks[job.index] = info
+						blocksLock.Unlock()
+					}
+				}
+				job.done()
+			}
+		}()
+	}
+
+	for ctx.Err() == nil {
+		more, err := source.More()
+		if err != nil {
+			fail(err)
+			break
+		}
+		if !more {
+			break
+		}
 		var nodesMsg ForwardBlock
-		err = client.Call("Append", nil, &nodesMsg)
+		if err := CallContext(ctx, client, "Append", nil, &nodesMsg); err != nil {
+			fail(err)
+			break
+		}
+		data, done, err := source.Next(nodesMsg.Size)
+		if err != nil {
+			fail(err)
+			break
+		}
+		blocksLock.Lock()
+		blocks = append(blocks, BlockInfo{})
+		index := len(blocks) - 1
+		blocksLock.Unlock()
+		jobs <- &blockJob{index, nodesMsg, data, done}
+	}
+	close(jobs)
+	wg.Wait()
+	// Whatever failed, it was because the caller gave up
+	if err := parent.Err(); err != nil {
+		return "", err
+	}
+	if failure != nil {
+		return "", failure
+	}
+
+	if err := CallContext(ctx, client, "Commit", blocks, nil); err != nil {
+		return "", err
+	}
+	if cp != nil {
+		cp.Remove()
+	}
+	return blobId, nil
+}
+
+// Sends one block as it's stored: compressed, encrypted, deduplicated or
+// erasure coded, whichever the blob is
+func sendJob(ctx context.Context, conf Config, client *rpc.Client, policy *ErasurePolicy, c codec.Codec, key []byte, job *blockJob) (BlockInfo, error) {
+	data := job.data
+	var err error
+	if c != nil {
+		if data, err = compress(c, data); err != nil {
+			return BlockInfo{}, err
+		}
+	}
+	if key != nil {
+		if data, err = encrypt(key, job.index, data); err != nil {
+			return BlockInfo{}, err
+		}
+	}
+	var blockID BlockID
+	stored := false
+	switch {
+	case policy != nil:
+		blockID, err = uploadGroup(ctx, client, *policy, job.nodesMsg, data, conf.Debug)
+		stored = true
+	case conf.Dedup:
+		blockID, stored, err = dedup(ctx, client, job.nodesMsg.BlockID, data)
+	}
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	if !stored {
+		sent, _, err := uploadBlock(ctx, conf.retry(), client, job.nodesMsg, data, conf.Debug)
 		if err != nil {
-			log.Fatal("Append error:", err)
-		}
-		blockSize := nodesMsg.Size
-
-		var dataNode net.Conn
-		var forwardTo []string
-		// Find a DataNode
-		for i, addr := range nodesMsg.Nodes {
-			dataNode, err = net.Dial("tcp", addr)
-			if err == nil {
-				forwardTo = append(nodesMsg.Nodes[:i], nodesMsg.Nodes[i+1:]...)
-				break
+			return BlockInfo{}, err
+		}
+		blockID = sent.BlockID
+	}
+	return BlockInfo{blockID, job.data.Size(), data.Size()}, nil
+}
+
+func dialLeader(conf Config) (*rpc.Client, error) {
+	return DialLeaderContext(conf.context(), conf.LeaderAddress, conf.Debug)
+}
+
+type blockJob struct {
+	index    int
+	nodesMsg ForwardBlock
+	data     *io.SectionReader
+	done     func()
+}
+
+// The block as it's stored on the DataNodes. Whole blocks are compressed in
+// memory, which is no more than the leader's block size at a time per
+// worker.
+func compress(c codec.Codec, data *io.SectionReader) (*io.SectionReader, error) {
+	compressed, err := codec.CompressBlock(c, io.NewSectionReader(data, 0, data.Size()), data.Size())
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(bytes.NewReader(compressed), 0, int64(len(compressed))), nil
+}
+
+func encrypt(key []byte, index int, data *io.SectionReader) (*io.SectionReader, error) {
+	sealed, err := crypt.EncryptBlock(key, index, io.NewSectionReader(data, 0, data.Size()), data.Size())
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(bytes.NewReader(sealed), 0, int64(len(sealed))), nil
+}
+
+// Asks the leader whether it has a block like this one already
+func dedup(ctx context.Context, client *rpc.Client, block BlockID, data *io.SectionReader) (BlockID, bool, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(data, 0, data.Size())); err != nil {
+		return "", false, err
+	}
+	var existing BlockID
+	err := CallContext(ctx, client, "Dedup",
+		&DedupBlock{block, hex.EncodeToString(hash.Sum(nil)), data.Size()},
+		&existing)
+	if err != nil || existing == "" {
+		return "", false, err
+	}
+	log.Println("Block", block, "is already stored as", existing)
+	return existing, true, nil
+}
+
+// Returns the block it ended up as, which changes if the leader had to be
+// asked for a different set of DataNodes, and the nodes that have it.
+func uploadBlock(ctx context.Context, policy RetryPolicy, client *rpc.Client, nodesMsg ForwardBlock, data *io.SectionReader, debug bool) (ForwardBlock, []string, error) {
+	// If nobody will take the block, the leader's list of DataNodes may
+	// just be out of date. Give it a moment and ask for some others.
+	var good, failed []string
+	attempt := 0
+	err := policy.Do(ctx, "", func() error {
+		if attempt++; attempt > 1 {
+			err := CallContext(ctx, client, "AppendExcluding",
+				&AppendExcluding{nodesMsg.BlockID, failed},
+				&nodesMsg)
+			if err != nil {
+				return err
 			}
-			dataNode = nil
 		}
-		// TODO: Can't compare an interface to nil
-		if dataNode == nil {
-			log.Fatalln("Couldn't connect to any DataNodes in:", strings.Join(nodesMsg.Nodes, " "))
+		if good, failed = writeBlock(ctx, client, nodesMsg, data, debug); len(good) > 0 {
+			return nil
 		}
-		defer dataNode.Close()
+		log.Println("No DataNodes took block", nodesMsg.BlockID)
+		return errors.New("Couldn't connect to any DataNodes in: " + strings.Join(failed, " "))
+	})
+	if err != nil && ctx.Err() != nil {
+		return nodesMsg, nil, ctx.Err()
+	}
+	return nodesMsg, good, err
+}
+
+// Gets a block onto as many DataNodes as the leader asked for. When part of
+// the pipeline fails, the leader is asked for replacements for just the
+// nodes that didn't take the block, and it's sent again to those. Returns
+// the nodes that have the block, and the ones that wouldn't take it.
+func writeBlock(ctx context.Context, leader *rpc.Client, nodesMsg ForwardBlock, data *io.SectionReader, debug bool) ([]string, []string) {
+	want := len(nodesMsg.Nodes)
+	pipeline := nodesMsg.Nodes
+	var good []string
+	var failed []string
+	for attempt := 1; ; attempt++ {
+		statuses := pushBlock(ctx, pipeline, nodesMsg.BlockID, nodesMsg.Token, data, debug)
 
-		dataNodeCodec := jsonrpc.NewClientCodec(dataNode)
-		if debug {
-			dataNodeCodec = LoggingClientCodec(
-				dataNode.RemoteAddr().String(),
-				dataNodeCodec)
+		// Nodes that never heard about the block are still worth trying
+		untouched := map[string]bool{}
+		for _, addr := range pipeline {
+			untouched[addr] = true
+		}
+		var newlyFailed []string
+		for _, status := range statuses {
+			delete(untouched, status.Addr)
+			if status.Error == "" {
+				RecordAttempt(status.Addr, nil)
+				good = append(good, status.Addr)
+			} else {
+				log.Println("DataNode", status.Addr, "didn't take block", nodesMsg.BlockID, "->", status.Error)
+				RecordAttempt(status.Addr, DecodeError(status.Error))
+				newlyFailed = append(newlyFailed, status.Addr)
+			}
+		}
+		failed = append(failed, newlyFailed...)
+		if len(good) >= want && want > 0 {
+			return good, failed
 		}
-		dataNodeClient := rpc.NewClientWithCodec(dataNodeCodec)
 
-		var size int64
-		if blockSize > bytesLeft {
-			size = bytesLeft
-			bytesLeft = 0
-		} else {
-			size = blockSize
-			bytesLeft = bytesLeft - blockSize
+		pipeline = nil
+		for _, addr := range nodesMsg.Nodes {
+			if untouched[addr] {
+				pipeline = append(pipeline, addr)
+			}
+		}
+		if need := want - len(good) - len(pipeline); need > 0 && attempt < maxPipelineAttempts {
+			var replacements []string
+			exclude := append(append([]string{}, good...), pipeline...)
+			exclude = append(exclude, failed...)
+			err := CallContext(ctx, leader, "ReplaceNodes",
+				&ReplaceNodes{nodesMsg.BlockID, newlyFailed, exclude, need},
+				&replacements)
+			if err != nil {
+				// Whatever it's made it to so far will have to do
+				log.Println("ReplaceNodes error:", err)
+			}
+			pipeline = append(pipeline, replacements...)
 		}
 
-		err = dataNodeClient.Call("Forward",
-			&ForwardBlock{nodesMsg.BlockID, forwardTo, size},
-			nil)
-		if err != nil {
-			log.Fatal("ForwardBlock error: ", err)
+		if len(pipeline) == 0 || attempt >= maxPipelineAttempts {
+			if len(good) > 0 {
+				// The leader will re-replicate it eventually
+				log.Println("Block", nodesMsg.BlockID, "only made it to", strings.Join(good, " "))
+			}
+			return good, failed
 		}
+		log.Println("Rebuilding pipeline for", nodesMsg.BlockID, "with", strings.Join(pipeline, " "))
+	}
+}
 
-		hash := crc32.NewIEEE()
-		io.CopyN(dataNode, io.TeeReader(file, hash), size)
+const maxPipelineAttempts = 5
 
-		log.Println("Uploading block with checksum", hex.EncodeToString(hash.Sum([]byte{})))
-		err = dataNodeClient.Call("Confirm", fmt.Sprint(hash.Sum32()), nil)
-		if err != nil {
-			log.Fatal("Confirm error: ", err)
+// Sends the block down one pipeline and reports how each node in it did.
+// Nodes past a failure in the pipeline may not be mentioned at all.
+func pushBlock(ctx context.Context, pipeline []string, blockID BlockID, token *BlockToken, data *io.SectionReader, debug bool) []ReplicaStatus {
+	var statuses []ReplicaStatus
+	var dataNode *TransferConn
+	var first string
+	var forwardTo []string
+	var err error
+	// Find a DataNode
+	for i, addr := range pipeline {
+		dataNode, err = DialTransferContext(ctx, addr, debug)
+		if err == nil {
+			first = addr
+			forwardTo = pipeline[i+1:]
+			break
 		}
+		statuses = append(statuses, ReplicaStatus{addr, err.Error()})
+		dataNode = nil
+	}
+	if dataNode == nil {
+		return statuses
+	}
+	defer dataNode.Close()
+	fail := func(err error) []ReplicaStatus {
+		return append(statuses, ReplicaStatus{first, err.Error()})
 	}
 
-	err = client.Call("Commit", nil, nil)
+	size := data.Size()
+	err = dataNode.Call("Forward",
+		&ForwardBlock{blockID, forwardTo, size, token},
+		nil)
 	if err != nil {
-		log.Fatal("Commit error:", err)
+		return fail(err)
 	}
-	fmt.Println("Blob ID:", blobId)
 
-	return blobId
+	hash := crc32.NewIEEE()
+	if _, err := data.Seek(0, 0); err != nil {
+		log.Fatalln("Seek error:", err)
+	}
+	err = dataNode.SendBlock(io.TeeReader(data, hash), size)
+	if err != nil {
+		return fail(err)
+	}
+
+	log.Println("Uploading block with checksum", hex.EncodeToString(hash.Sum([]byte{})))
+	var replicas []ReplicaStatus
+	err = dataNode.Call("Confirm", fmt.Sprint(hash.Sum32()), &replicas)
+	if err != nil {
+		return fail(err)
+	}
+	return append(statuses, replicas...)
 }
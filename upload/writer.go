@@ -0,0 +1,298 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/rpc"
+
+	"golang-distributed-filesystem/codec"
+	"golang-distributed-filesystem/download"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Sends whatever's been written once there's this much of it
+const writerBuffer = 4 * 1024 * 1024
+
+// Writes a blob a bit at a time, for logs and the like that grow while
+// they're being read. Nothing written is visible to readers until Hflush
+// or Close, and readers that opened the blob before then keep seeing the
+// length it had when they did.
+//
+// Data goes onto the end of the blob's last block for as long as that has
+// room. Every replica of the block is extended in place; if any of them
+// can't be, the block is rewritten with the new data as a fresh block
+// instead, and the old one is deleted when the blob is closed. Compressed
+// and encrypted blocks can't be added to, so every send to such a blob is a
+// new block.
+type Writer struct {
+	conf      Config
+	client    *rpc.Client
+	blobID    string
+	blockSize int64
+	blocks    []BlockInfo
+	// DataNodes with the last block, if it can be added to in place, and
+	// the token to write to it with
+	last      []string
+	lastToken *BlockToken
+	buf       bytes.Buffer
+	// Nil if the blob isn't compressed
+	compression codec.Codec
+	// Nil if the blob isn't encrypted
+	key []byte
+}
+
+// Starts a new blob. Erasure-coded blobs have to be uploaded in one go.
+func Create(conf Config) (*Writer, error) {
+	if conf.Policy != "" {
+		return nil, errors.New("Can't write an erasure-coded blob a bit at a time")
+	}
+	compression, err := codec.Get(conf.Codec)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dialLeader(conf)
+	if err != nil {
+		return nil, err
+	}
+	self := &Writer{conf: conf, client: client, compression: compression}
+	if err := CallContext(conf.context(), client, "CreateBlob", &CreateBlob{"", conf.Codec, conf.Encrypt, conf.Zone, conf.Mode, conf.ACL}, &self.blobID); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if conf.Encrypt || conf.Zone != "" {
+		if self.key, err = download.BlobKeyContext(conf.context(), conf.LeaderAddress, self.blobID, conf.Debug); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return self, nil
+}
+
+// Reopens a committed blob to add to the end of it. Only one Writer can
+// have a blob open at a time.
+func OpenForAppend(conf Config, blobID string) (*Writer, error) {
+	client, err := dialLeader(conf)
+	if err != nil {
+		return nil, err
+	}
+	var opened OpenedBlob
+	if err := CallContext(conf.context(), client, "OpenForAppend", blobID, &opened); err != nil {
+		client.Close()
+		return nil, err
+	}
+	compression, err := codec.Get(opened.Codec)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	var key []byte
+	if opened.Encrypted {
+		if key, err = download.BlobKeyContext(conf.context(), conf.LeaderAddress, blobID, conf.Debug); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return &Writer{
+		conf:        conf,
+		client:      client,
+		blobID:      blobID,
+		blockSize:   opened.BlockSize,
+		blocks:      opened.Blocks,
+		last:        opened.Last,
+		lastToken:   opened.Token,
+		compression: compression,
+		key:         key,
+	}, nil
+}
+
+// Blocks the blob shares with others stay until they're all gone
+func Delete(conf Config, blobID string) error {
+	return CallLeaderContext(conf.context(), conf.LeaderAddress, conf.Debug, "DeleteBlob", blobID, nil)
+}
+
+// Changes who may read and write the blob. Only its owner can.
+func SetPermissions(conf Config, blobID string, perms Permissions) error {
+	var ok string
+	return CallLeaderContext(conf.context(), conf.LeaderAddress, conf.Debug, "SetPermissions", &BlobPermissions{blobID, perms}, &ok)
+}
+
+func (self *Writer) BlobID() string {
+	return self.blobID
+}
+
+// Everything written so far, flushed or not
+func (self *Writer) Size() int64 {
+	size := int64(self.buf.Len())
+	for _, b := range self.blocks {
+		size += b.Size
+	}
+	return size
+}
+
+func (self *Writer) Write(p []byte) (int, error) {
+	self.buf.Write(p)
+	for self.buf.Len() >= writerBuffer {
+		if err := self.send(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Once this returns, everything written so far is stored on the DataNodes
+// and visible to anyone who opens the blob.
+func (self *Writer) Hflush() error {
+	for self.buf.Len() > 0 {
+		if err := self.send(); err != nil {
+			return err
+		}
+	}
+	return CallContext(self.conf.context(), self.client, "Flush", self.blocks, nil)
+}
+
+// Flushes and commits the blob
+func (self *Writer) Close() error {
+	defer self.client.Close()
+	for self.buf.Len() > 0 {
+		if err := self.send(); err != nil {
+			return err
+		}
+	}
+	return CallContext(self.conf.context(), self.client, "Commit", self.blocks, nil)
+}
+
+// The last block, if there's room left in it
+func (self *Writer) tail() *BlockInfo {
+	if len(self.blocks) == 0 || self.blockSize == 0 || self.compression != nil || self.key != nil {
+		return nil
+	}
+	last := &self.blocks[len(self.blocks)-1]
+	if last.Size >= self.blockSize {
+		return nil
+	}
+	return last
+}
+
+// Sends some of what's buffered, either onto the end of the last block or
+// as a new one
+func (self *Writer) send() error {
+	n := int64(self.buf.Len())
+	if n > writerBuffer {
+		n = writerBuffer
+	}
+
+	tail := self.tail()
+	if tail == nil {
+		var nodesMsg ForwardBlock
+		if err := CallContext(self.conf.context(), self.client, "Append", nil, &nodesMsg); err != nil {
+			return err
+		}
+		self.blockSize = nodesMsg.Size
+		if n > nodesMsg.Size {
+			n = nodesMsg.Size
+		}
+		data := io.NewSectionReader(bytes.NewReader(self.buf.Next(int(n))), 0, n)
+		var err error
+		if self.compression != nil {
+			if data, err = compress(self.compression, data); err != nil {
+				return err
+			}
+		}
+		if self.key != nil {
+			if data, err = encrypt(self.key, len(self.blocks), data); err != nil {
+				return err
+			}
+		}
+		sent, good, err := uploadBlock(self.conf.context(), self.conf.retry(), self.client, nodesMsg, data, self.conf.Debug)
+		if err != nil {
+			return err
+		}
+		self.blocks = append(self.blocks, BlockInfo{sent.BlockID, n, data.Size()})
+		self.last, self.lastToken = good, sent.Token
+		return nil
+	}
+
+	if room := self.blockSize - tail.Size; n > room {
+		n = room
+	}
+	data := self.buf.Next(int(n))
+	if len(self.last) > 0 {
+		err := appendInPlace(self.conf.context(), self.last, self.lastToken, *tail, data, self.conf.Debug)
+		if err == nil {
+			tail.Size += n
+			return nil
+		}
+		log.Println("Couldn't append to", tail.BlockID, "in place, rewriting it ->", err)
+	}
+	return self.rewriteTail(tail, data)
+}
+
+// Copies the last block and data into a new block that replaces it
+func (self *Writer) rewriteTail(tail *BlockInfo, data []byte) error {
+	var nodesMsg ForwardBlock
+	if err := CallContext(self.conf.context(), self.client, "Append", nil, &nodesMsg); err != nil {
+		return err
+	}
+	old := download.OpenBlockContext(self.conf.context(), self.conf.LeaderAddress, *tail, self.conf.Debug)
+	defer old.Close()
+	source := newStreamSource(io.MultiReader(
+		io.NewSectionReader(old, 0, tail.Size),
+		bytes.NewReader(data)))
+	size := tail.Size + int64(len(data))
+	combined, done, err := source.Next(size)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if combined.Size() != size {
+		return errors.New("Couldn't read block " + string(tail.BlockID))
+	}
+	sent, good, err := uploadBlock(self.conf.context(), self.conf.retry(), self.client, nodesMsg, combined, self.conf.Debug)
+	if err != nil {
+		return err
+	}
+	*tail = BlockInfo{sent.BlockID, size, size}
+	self.last, self.lastToken = good, sent.Token
+	return nil
+}
+
+// Adds data to the end of a block on every one of nodes, which must all
+// have it at the same length
+func appendInPlace(ctx context.Context, nodes []string, token *BlockToken, block BlockInfo, data []byte, debug bool) error {
+	dataNode, err := DialTransferContext(ctx, nodes[0], debug)
+	if err != nil {
+		return err
+	}
+	defer dataNode.Close()
+
+	size := int64(len(data))
+	err = dataNode.Call("Append", &AppendBlock{block.BlockID, nodes[1:], block.Size, size, token}, nil)
+	if err != nil {
+		return err
+	}
+	if err := dataNode.SendBlock(bytes.NewReader(data), size); err != nil {
+		return err
+	}
+	var replicas []ReplicaStatus
+	err = dataNode.Call("Confirm", fmt.Sprint(crc32.ChecksumIEEE(data)), &replicas)
+	if err != nil {
+		return err
+	}
+	appended := 0
+	for _, status := range replicas {
+		if status.Error != "" {
+			return errors.New(status.Addr + ": " + status.Error)
+		}
+		appended++
+	}
+	if appended < len(nodes) {
+		return errors.New("Not every DataNode took the data")
+	}
+	return nil
+}
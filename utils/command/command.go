@@ -37,6 +37,7 @@ type AppConfig struct {
 	help        bool
 	globalFlags []flag
 	global      func(Flags)
+	setup       func()
 	commands    []command
 }
 
@@ -94,6 +95,11 @@ func (self *AppConfig) Global(f func(Flags)) {
 	f(&flagDummy{&self.globalFlags})
 }
 
+// Runs once the global flags are parsed, before the command
+func (self *AppConfig) Setup(f func()) {
+	self.setup = f
+}
+
 func (self *AppConfig) Command(name string, description string, f func(Flags)) {
 	var flags []flag
 	defer func() {
@@ -160,6 +166,9 @@ func (self *AppConfig) Run() {
 	if len(commandArgs) == 0 {
 		self.Usage()
 	}
+	if self.setup != nil {
+		self.setup()
+	}
 	command := commandArgs[0]
 	os.Args = commandArgs[1:]
 	for _, c := range self.commands {
@@ -55,12 +55,16 @@ func (self *fileFlag) Set(s string) error {
 	self.set = true
 	return nil
 }
+// "-" means stdin
 func (self *fileFlag) Get() *os.File {
 	if !self.set {
 		fmt.Println("flag must be provided:", "-"+self.name)
 		fmt.Println("run with command 'help' for usage information")
 		os.Exit(2)
 	}
+	if self.filename == "-" {
+		return os.Stdin
+	}
 	file, err := os.Open(self.filename)
 	if err != nil {
 		log.Fatal(err)